@@ -2,17 +2,17 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/green-guardian-gateway/pkg/cbor"
 	"github.com/pojntfx/green-guardian-gateway/pkg/services"
 	uutils "github.com/pojntfx/green-guardian-gateway/pkg/utils"
 	"github.com/pojntfx/r3map/pkg/utils"
@@ -27,72 +27,478 @@ func main() {
 	crypto := filepath.Join(pwd, "crypto")
 
 	laddr := flag.String("laddr", uutils.GetStringEnvOrDefault("LADDR", ":1337"), "Listen address")
+	adminLaddr := flag.String("admin-laddr", uutils.GetStringEnvOrDefault("ADMIN_LADDR", ""), "Listen address for the admin HTTP server exposing health and registrations (empty disables it)")
 	verbose := flag.Bool("verbose", uutils.GetBoolEnvOrDefault("VERBOSE", false), "Whether to enable verbose logging")
+	jsonLogs := flag.Bool("json-logs", uutils.GetBoolEnvOrDefault("JSON_LOGS", false), "Whether to log in JSON format")
 	awsKey := flag.String("aws-key", uutils.GetStringEnvOrDefault("AWS_KEY", filepath.Join(crypto, "key.pem")), "AWS mTLS secret key")
 	awsCert := flag.String("aws-cert", uutils.GetStringEnvOrDefault("AWS_CERT", filepath.Join(crypto, "cert.pem")), "AWS mTLS certificate")
 	awsCA := flag.String("aws-ca", uutils.GetStringEnvOrDefault("AWS_CA", filepath.Join(crypto, "ca.pem")), "AWS mTLS CA")
 	endpoint := flag.String("endpoint", uutils.GetStringEnvOrDefault("ENDPOINT", "ssl://ad218s2flbk57-ats.iot.eu-central-1.amazonaws.com:8883"), "AWS MQTT endpoint to connect to")
 	thingName := flag.String("thing-name", uutils.GetStringEnvOrDefault("THING_NAME", "DEVICE-Device_1"), "Thing name (for topic to publish too; invalid thing names are denied using the )")
 
-	flag.Parse()
+	topicPrefix := flag.String("topic-prefix", uutils.GetStringEnvOrDefault("TOPIC_PREFIX", "/gateways"), "Prefix to namespace all MQTT topics under")
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	temperatureLeafTopic := flag.String("temperature-leaf-topic", uutils.GetStringEnvOrDefault("TEMPERATURE_LEAF_TOPIC", services.DeviceTypeTemperature), "Last topic level of temperature measurements")
+	moistureLeafTopic := flag.String("moisture-leaf-topic", uutils.GetStringEnvOrDefault("MOISTURE_LEAF_TOPIC", services.DeviceTypeMoisture), "Last topic level of moisture measurements")
+	fanLeafTopic := flag.String("fan-leaf-topic", uutils.GetStringEnvOrDefault("FAN_LEAF_TOPIC", services.DeviceTypeFan), "Last topic level of fan commands")
+	sprinklerLeafTopic := flag.String("sprinkler-leaf-topic", uutils.GetStringEnvOrDefault("SPRINKLER_LEAF_TOPIC", services.DeviceTypeSprinkler), "Last topic level of sprinkler commands")
+
+	username := flag.String("username", uutils.GetStringEnvOrDefault("USERNAME", ""), "MQTT username (optional)")
+	password := flag.String("password", uutils.GetStringEnvOrDefault("PASSWORD", ""), "MQTT password (optional)")
+
+	clientID := flag.String("client-id", uutils.GetStringEnvOrDefault("CLIENT_ID", ""), "MQTT client ID (defaults to the thing name)")
+	randomClientIDSuffix := flag.Bool("random-client-id-suffix", uutils.GetBoolEnvOrDefault("RANDOM_CLIENT_ID_SUFFIX", false), "Whether to append a random suffix to the MQTT client ID to prevent collisions with other gateways")
+
+	publishQoSDefault, err := uutils.GetIntEnvOrDefault("PUBLISH_QOS", 0)
+	if err != nil {
+		panic(err)
+	}
+	publishQoS := flag.Int("publish-qos", publishQoSDefault, "MQTT QoS level to use for forwarded measurements (0, 1 or 2)")
+
+	subscribeQoSDefault, err := uutils.GetIntEnvOrDefault("SUBSCRIBE_QOS", 0)
+	if err != nil {
+		panic(err)
+	}
+	subscribeQoS := flag.Int("subscribe-qos", subscribeQoSDefault, "MQTT QoS level to use for fan and sprinkler commands (0, 1 or 2)")
 
-	cert, err := tls.LoadX509KeyPair(*awsCert, *awsKey)
+	temperaturePublishQoSDefault, err := uutils.GetIntEnvOrDefault("TEMPERATURE_PUBLISH_QOS", -1)
 	if err != nil {
 		panic(err)
 	}
+	temperaturePublishQoS := flag.Int("temperature-publish-qos", temperaturePublishQoSDefault, "MQTT QoS level to use for forwarded temperature measurements (0, 1 or 2; -1 uses the global level)")
 
-	ca, err := os.ReadFile(*awsCA)
+	moisturePublishQoSDefault, err := uutils.GetIntEnvOrDefault("MOISTURE_PUBLISH_QOS", -1)
 	if err != nil {
 		panic(err)
 	}
+	moisturePublishQoS := flag.Int("moisture-publish-qos", moisturePublishQoSDefault, "MQTT QoS level to use for forwarded moisture measurements (0, 1 or 2; -1 uses the global level)")
 
-	pool := x509.NewCertPool()
-	pool.AppendCertsFromPEM(ca)
+	fanSubscribeQoSDefault, err := uutils.GetIntEnvOrDefault("FAN_SUBSCRIBE_QOS", -1)
+	if err != nil {
+		panic(err)
+	}
+	fanSubscribeQoS := flag.Int("fan-subscribe-qos", fanSubscribeQoSDefault, "MQTT QoS level to use for fan commands (0, 1 or 2; -1 uses the global level)")
 
-	tlsConfig := &tls.Config{
-		RootCAs:      pool,
-		Certificates: []tls.Certificate{cert},
+	sprinklerSubscribeQoSDefault, err := uutils.GetIntEnvOrDefault("SPRINKLER_SUBSCRIBE_QOS", -1)
+	if err != nil {
+		panic(err)
 	}
+	sprinklerSubscribeQoS := flag.Int("sprinkler-subscribe-qos", sprinklerSubscribeQoSDefault, "MQTT QoS level to use for sprinkler commands (0, 1 or 2; -1 uses the global level)")
+
+	retainActuatorState := flag.Bool("retain-actuator-state", uutils.GetBoolEnvOrDefault("RETAIN_ACTUATOR_STATE", false), "Whether to publish applied fan and sprinkler states as retained messages")
+
+	allowRegistrationOverwrite := flag.Bool("allow-registration-overwrite", uutils.GetBoolEnvOrDefault("ALLOW_REGISTRATION_OVERWRITE", false), "Whether to allow hubs to take over rooms and plants registered by other hubs")
+	allowMultiplePeers := flag.Bool("allow-multiple-peers", uutils.GetBoolEnvOrDefault("ALLOW_MULTIPLE_PEERS", false), "Whether to allow multiple hubs to register the same rooms and plants, sending commands to all of them")
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(*endpoint)
-	opts.SetClientID(*thingName)
-	opts.SetTLSConfig(tlsConfig)
+	rejectUnregisteredMeasurements := flag.Bool("reject-unregistered-measurements", uutils.GetBoolEnvOrDefault("REJECT_UNREGISTERED_MEASUREMENTS", false), "Whether to reject measurements for rooms and plants that no hub has registered")
+	dropOrphanedMeasurements := flag.Bool("drop-orphaned-measurements", uutils.GetBoolEnvOrDefault("DROP_ORPHANED_MEASUREMENTS", false), "Whether to reject measurements for rooms and plants whose registering hubs have all disconnected")
+	reconcileOnPeerGone := flag.Bool("reconcile-on-peer-gone", uutils.GetBoolEnvOrDefault("RECONCILE_ON_PEER_GONE", false), "Whether to unregister the devices of disconnected hubs once a measurement for one of them is rejected")
 
-	client := mqtt.NewClient(opts)
+	multiSegmentIDs := flag.Bool("multi-segment-ids", uutils.GetBoolEnvOrDefault("MULTI_SEGMENT_IDS", false), "Whether to allow room, plant and zone IDs to span multiple topic levels (e.g. building1/floor2/room3)")
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	sharedSubscriptionGroup := flag.String("shared-subscription-group", uutils.GetStringEnvOrDefault("SHARED_SUBSCRIPTION_GROUP", ""), "Shared subscription group to subscribe to commands in, so that each command is delivered to only one gateway replica (empty disables shared subscriptions)")
+
+	temperatureUnit := flag.String("temperature-unit", uutils.GetStringEnvOrDefault("TEMPERATURE_UNIT", "celsius"), "Unit to convert temperature measurements to before forwarding them (celsius, fahrenheit or kelvin)")
+
+	codecName := flag.String("codec", uutils.GetStringEnvOrDefault("CODEC", "json"), "Encoding of MQTT payloads (json or cbor)")
+
+	maxRegistrationsPerPeerDefault, err := uutils.GetIntEnvOrDefault("MAX_REGISTRATIONS_PER_PEER", 0)
+	if err != nil {
+		panic(err)
 	}
-	defer client.Disconnect(1000)
+	maxRegistrationsPerPeer := flag.Int("max-registrations-per-peer", maxRegistrationsPerPeerDefault, "Maximum amount of rooms or plants a single hub may register per device type (0 disables this)")
 
-	log.Println("Connected to", *endpoint)
+	publishRegistrationEvents := flag.Bool("publish-registration-events", uutils.GetBoolEnvOrDefault("PUBLISH_REGISTRATION_EVENTS", false), "Whether to publish an event whenever a hub registers or unregisters devices")
+
+	publishCommandAcks := flag.Bool("publish-command-acks", uutils.GetBoolEnvOrDefault("PUBLISH_COMMAND_ACKS", false), "Whether to publish an acknowledgement after a hub has applied a command")
+
+	publishShadow := flag.Bool("publish-shadow", uutils.GetBoolEnvOrDefault("PUBLISH_SHADOW", false), "Whether to publish a retained shadow document with the states of all actuators whenever one of them changes")
+
+	pruneUnsupportedActuators := flag.Bool("prune-unsupported-actuators", uutils.GetBoolEnvOrDefault("PRUNE_UNSUPPORTED_ACTUATORS", false), "Whether to unregister all devices of a type that a hub has registered once it reports that it doesn't support them")
+
+	dryRun := flag.Bool("dry-run", uutils.GetBoolEnvOrDefault("DRY_RUN", false), "Whether to only log measurements, state updates and hub calls instead of publishing or calling them")
+
+	measurementBufferSizeDefault, err := uutils.GetIntEnvOrDefault("MEASUREMENT_BUFFER_SIZE", 0)
+	if err != nil {
+		panic(err)
+	}
+	measurementBufferSize := flag.Int("measurement-buffer-size", measurementBufferSizeDefault, "Amount of measurements to buffer while the broker is disconnected (0 disables buffering)")
+
+	measurementFlushIntervalDefault, err := uutils.GetDurationEnvOrDefault("MEASUREMENT_FLUSH_INTERVAL", time.Second)
+	if err != nil {
+		panic(err)
+	}
+	measurementFlushInterval := flag.Duration("measurement-flush-interval", measurementFlushIntervalDefault, "Interval in which buffered measurements are republished")
+
+	measurementFlushRateDefault, err := uutils.GetFloatEnvOrDefault("MEASUREMENT_FLUSH_RATE", 0)
+	if err != nil {
+		panic(err)
+	}
+	measurementFlushRate := flag.Float64("measurement-flush-rate", measurementFlushRateDefault, "Maximum amount of buffered measurements to republish per second (0 republishes them all at once)")
+
+	measurementFlushJitterDefault, err := uutils.GetDurationEnvOrDefault("MEASUREMENT_FLUSH_JITTER", 0)
+	if err != nil {
+		panic(err)
+	}
+	measurementFlushJitter := flag.Duration("measurement-flush-jitter", measurementFlushJitterDefault, "Maximum random delay to add between republishing buffered measurements")
+
+	temperatureMeasurementBufferTTLDefault, err := uutils.GetDurationEnvOrDefault("TEMPERATURE_MEASUREMENT_BUFFER_TTL", 0)
+	if err != nil {
+		panic(err)
+	}
+	temperatureMeasurementBufferTTL := flag.Duration("temperature-measurement-buffer-ttl", temperatureMeasurementBufferTTLDefault, "Amount of time after which temperature measurements in the local buffer are dropped instead of republished; the broker doesn't expire them (0 disables this)")
+
+	moistureMeasurementBufferTTLDefault, err := uutils.GetDurationEnvOrDefault("MOISTURE_MEASUREMENT_BUFFER_TTL", 0)
+	if err != nil {
+		panic(err)
+	}
+	moistureMeasurementBufferTTL := flag.Duration("moisture-measurement-buffer-ttl", moistureMeasurementBufferTTLDefault, "Amount of time after which moisture measurements in the local buffer are dropped instead of republished; the broker doesn't expire them (0 disables this)")
+
+	staleTemperatureTimeoutDefault, err := uutils.GetDurationEnvOrDefault("STALE_TEMPERATURE_TIMEOUT", 0)
+	if err != nil {
+		panic(err)
+	}
+	staleTemperatureTimeout := flag.Duration("stale-temperature-timeout", staleTemperatureTimeoutDefault, "Amount of time after which the default temperature is forwarded for rooms that have stopped reporting (0 disables this)")
+
+	sprinklerDebounceIntervalDefault, err := uutils.GetDurationEnvOrDefault("SPRINKLER_DEBOUNCE_INTERVAL", 0)
+	if err != nil {
+		panic(err)
+	}
+	sprinklerDebounceInterval := flag.Duration("sprinkler-debounce-interval", sprinklerDebounceIntervalDefault, "Window in which rapid sprinkler commands are coalesced so that only the latest one is applied (0 disables this)")
+
+	commandRedeliveryTTLDefault, err := uutils.GetDurationEnvOrDefault("COMMAND_REDELIVERY_TTL", 0)
+	if err != nil {
+		panic(err)
+	}
+	commandRedeliveryTTL := flag.Duration("command-redelivery-ttl", commandRedeliveryTTLDefault, "Window in which QoS 1 or 2 commands that the broker flags as redeliveries are suppressed (0 disables this)")
+
+	commandRedeliveryCacheSizeDefault, err := uutils.GetIntEnvOrDefault("COMMAND_REDELIVERY_CACHE_SIZE", 1024)
+	if err != nil {
+		panic(err)
+	}
+	commandRedeliveryCacheSize := flag.Int("command-redelivery-cache-size", commandRedeliveryCacheSizeDefault, "Maximum amount of commands to remember for suppressing redeliveries")
+
+	fanMinDwellTimeDefault, err := uutils.GetDurationEnvOrDefault("FAN_MIN_DWELL_TIME", 0)
+	if err != nil {
+		panic(err)
+	}
+	fanMinDwellTime := flag.Duration("fan-min-dwell-time", fanMinDwellTimeDefault, "Minimum amount of time a fan has to stay on or off before it is switched again; earlier commands are deferred (0 disables this)")
+
+	dehumidifierMinDwellTimeDefault, err := uutils.GetDurationEnvOrDefault("DEHUMIDIFIER_MIN_DWELL_TIME", 0)
+	if err != nil {
+		panic(err)
+	}
+	dehumidifierMinDwellTime := flag.Duration("dehumidifier-min-dwell-time", dehumidifierMinDwellTimeDefault, "Minimum amount of time a dehumidifier has to stay on or off before it is switched again; earlier commands are deferred (0 disables this)")
+
+	unknownCommandStrategyName := flag.String("unknown-command-strategy", uutils.GetStringEnvOrDefault("UNKNOWN_COMMAND_STRATEGY", "error"), "How to handle commands for rooms or plants that no hub has registered (error, ignore or buffer)")
+
+	pendingCommandTTLDefault, err := uutils.GetDurationEnvOrDefault("PENDING_COMMAND_TTL", time.Second*10)
+	if err != nil {
+		panic(err)
+	}
+	pendingCommandTTL := flag.Duration("pending-command-ttl", pendingCommandTTLDefault, "Maximum amount of time to hold a command until its room or plant is registered if the unknown command strategy is buffer")
+
+	maxPendingCommandsDefault, err := uutils.GetIntEnvOrDefault("MAX_PENDING_COMMANDS", 100)
+	if err != nil {
+		panic(err)
+	}
+	maxPendingCommands := flag.Int("max-pending-commands", maxPendingCommandsDefault, "Maximum amount of commands to hold until their rooms or plants are registered if the unknown command strategy is buffer")
+
+	rateLimitDefault, err := uutils.GetFloatEnvOrDefault("RATE_LIMIT", 0)
+	if err != nil {
+		panic(err)
+	}
+	rateLimit := flag.Float64("rate-limit", rateLimitDefault, "Maximum amount of measurements to forward per second and room or plant; excess measurements are coalesced (0 disables rate limiting)")
+
+	rateLimitBurstDefault, err := uutils.GetIntEnvOrDefault("RATE_LIMIT_BURST", 1)
+	if err != nil {
+		panic(err)
+	}
+	rateLimitBurst := flag.Int("rate-limit-burst", rateLimitBurstDefault, "Amount of measurements that may be forwarded in a burst per room or plant if rate limiting is enabled")
 
-	gateway := services.NewGateway(
+	dedup := flag.Bool("dedup", uutils.GetBoolEnvOrDefault("DEDUP", false), "Whether to suppress forwarding measurements that are identical to the previous one")
+
+	dedupMaxSkipsDefault, err := uutils.GetIntEnvOrDefault("DEDUP_MAX_SKIPS", 0)
+	if err != nil {
+		panic(err)
+	}
+	dedupMaxSkips := flag.Int("dedup-max-skips", dedupMaxSkipsDefault, "Amount of consecutive duplicate measurements after which a measurement is forwarded anyways (0 disables this)")
+
+	dedupMaxIntervalDefault, err := uutils.GetDurationEnvOrDefault("DEDUP_MAX_INTERVAL", time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	dedupMaxInterval := flag.Duration("dedup-max-interval", dedupMaxIntervalDefault, "Amount of time after which a duplicate measurement is forwarded anyways (0 disables this)")
+
+	batchWindowDefault, err := uutils.GetDurationEnvOrDefault("BATCH_WINDOW", 0)
+	if err != nil {
+		panic(err)
+	}
+	batchWindow := flag.Duration("batch-window", batchWindowDefault, "Window within which the measurements of a room or plant are aggregated into a single message (0 disables batching)")
+	batchAggregation := flag.String("batch-aggregation", uutils.GetStringEnvOrDefault("BATCH_AGGREGATION", string(services.BatchAggregationAverage)), "Aggregation to forward for batched measurements (average, minimum or maximum)")
+
+	compressionThresholdDefault, err := uutils.GetIntEnvOrDefault("COMPRESSION_THRESHOLD", 0)
+	if err != nil {
+		panic(err)
+	}
+	compressionThreshold := flag.Int("compression-threshold", compressionThresholdDefault, "Size in bytes above which published payloads are gzip-compressed (0 disables compression)")
+
+	publishTimeoutDefault, err := uutils.GetDurationEnvOrDefault("PUBLISH_TIMEOUT", time.Second*5)
+	if err != nil {
+		panic(err)
+	}
+	publishTimeout := flag.Duration("publish-timeout", publishTimeoutDefault, "Amount of time to wait for the broker to acknowledge a measurement")
+
+	heartbeatIntervalDefault, err := uutils.GetDurationEnvOrDefault("HEARTBEAT_INTERVAL", 0)
+	if err != nil {
+		panic(err)
+	}
+	heartbeatInterval := flag.Duration("heartbeat-interval", heartbeatIntervalDefault, "Interval in which to publish a heartbeat while the gateway is running (0 disables heartbeats)")
+
+	hubCallTimeoutDefault, err := uutils.GetDurationEnvOrDefault("HUB_CALL_TIMEOUT", time.Second*10)
+	if err != nil {
+		panic(err)
+	}
+	hubCallTimeout := flag.Duration("hub-call-timeout", hubCallTimeoutDefault, "Amount of time to wait for a hub to apply a fan or sprinkler command")
+
+	maxConcurrentHubCallsDefault, err := uutils.GetIntEnvOrDefault("MAX_CONCURRENT_HUB_CALLS", 0)
+	if err != nil {
+		panic(err)
+	}
+	maxConcurrentHubCalls := flag.Int("max-concurrent-hub-calls", maxConcurrentHubCallsDefault, "Maximum amount of concurrent calls to all hubs (0 disables this)")
+
+	maxWaitingHubCallsDefault, err := uutils.GetIntEnvOrDefault("MAX_WAITING_HUB_CALLS", 0)
+	if err != nil {
+		panic(err)
+	}
+	maxWaitingHubCalls := flag.Int("max-waiting-hub-calls", maxWaitingHubCallsDefault, "Maximum amount of hub calls to queue if the concurrency limit is reached before dropping them (0 disables this)")
+
+	circuitBreakerThresholdDefault, err := uutils.GetIntEnvOrDefault("CIRCUIT_BREAKER_THRESHOLD", 0)
+	if err != nil {
+		panic(err)
+	}
+	circuitBreakerThreshold := flag.Int("circuit-breaker-threshold", circuitBreakerThresholdDefault, "Amount of consecutive failed calls after which calls to a hub are short-circuited for the cooldown (0 disables this)")
+
+	circuitBreakerCooldownDefault, err := uutils.GetDurationEnvOrDefault("CIRCUIT_BREAKER_COOLDOWN", time.Second*30)
+	if err != nil {
+		panic(err)
+	}
+	circuitBreakerCooldown := flag.Duration("circuit-breaker-cooldown", circuitBreakerCooldownDefault, "Amount of time after which a short-circuited hub is called again to test whether it has recovered")
+
+	commandWorkersDefault, err := uutils.GetIntEnvOrDefault("COMMAND_WORKERS", 4)
+	if err != nil {
+		panic(err)
+	}
+	commandWorkers := flag.Int("command-workers", commandWorkersDefault, "Amount of workers that apply fan and sprinkler commands concurrently")
+
+	commandQueueSizeDefault, err := uutils.GetIntEnvOrDefault("COMMAND_QUEUE_SIZE", 64)
+	if err != nil {
+		panic(err)
+	}
+	commandQueueSize := flag.Int("command-queue-size", commandQueueSizeDefault, "Amount of commands to queue per worker before dropping them")
+
+	errorBufferSizeDefault, err := uutils.GetIntEnvOrDefault("ERROR_BUFFER_SIZE", 16)
+	if err != nil {
+		panic(err)
+	}
+	errorBufferSize := flag.Int("error-buffer-size", errorBufferSizeDefault, "Amount of errors to buffer until they are dropped if they aren't handled")
+
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var codec services.Codec
+	switch *codecName {
+	case "json":
+		codec = services.JSONCodec{}
+
+	case "cbor":
+		codec = cbor.Codec{}
+
+	default:
+		panic(fmt.Errorf("unknown codec %q, must be json or cbor", *codecName))
+	}
+
+	getQoSOverride := func(qos int) *byte {
+		if qos < 0 {
+			return nil
+		}
+
+		rv := byte(qos)
+
+		return &rv
+	}
+
+	var unknownCommandStrategy services.UnknownCommandStrategy
+	switch *unknownCommandStrategyName {
+	case "error":
+		unknownCommandStrategy = services.UnknownCommandStrategyError
+
+	case "ignore":
+		unknownCommandStrategy = services.UnknownCommandStrategyIgnore
+
+	case "buffer":
+		unknownCommandStrategy = services.UnknownCommandStrategyBuffer
+
+	default:
+		panic(fmt.Errorf("unknown command strategy %q, must be error, ignore or buffer", *unknownCommandStrategyName))
+	}
+
+	logLevel := &slog.LevelVar{}
+	if *verbose {
+		logLevel.Set(slog.LevelDebug)
+	}
+
+	var logHandler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+	})
+	if *jsonLogs {
+		logHandler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: logLevel,
+		})
+	}
+
+	gateway, err := services.NewGatewayWithBroker(
 		*verbose,
 		ctx,
-		client,
+		&services.BrokerConfig{
+			URL: *endpoint,
+
+			ClientID:             *clientID,
+			RandomClientIDSuffix: *randomClientIDSuffix,
+
+			CAPath:   *awsCA,
+			CertPath: *awsCert,
+			KeyPath:  *awsKey,
+
+			Username: *username,
+			Password: *password,
+		},
 		*thingName,
-	)
+		&services.GatewayOptions{
+			TopicPrefix: *topicPrefix,
 
-	errs := make(chan error)
-	go func() {
-		if err := services.WaitGateway(gateway); err != nil {
-			errs <- err
-		}
-	}()
+			LeafTopics: map[string]string{
+				services.DeviceTypeTemperature: *temperatureLeafTopic,
+				services.DeviceTypeMoisture:    *moistureLeafTopic,
+				services.DeviceTypeFan:         *fanLeafTopic,
+				services.DeviceTypeSprinkler:   *sprinklerLeafTopic,
+			},
 
-	if err := services.OpenGateway(gateway, ctx); err != nil {
+			PublishQoS:   byte(*publishQoS),
+			SubscribeQoS: byte(*subscribeQoS),
+
+			QoS: map[string]services.QoSConfig{
+				services.DeviceTypeTemperature: {Publish: getQoSOverride(*temperaturePublishQoS)},
+				services.DeviceTypeMoisture:    {Publish: getQoSOverride(*moisturePublishQoS)},
+				services.DeviceTypeFan:         {Subscribe: getQoSOverride(*fanSubscribeQoS)},
+				services.DeviceTypeSprinkler:   {Subscribe: getQoSOverride(*sprinklerSubscribeQoS)},
+			},
+
+			RetainActuatorState: *retainActuatorState,
+
+			AllowRegistrationOverwrite: *allowRegistrationOverwrite,
+			AllowMultiplePeers:         *allowMultiplePeers,
+
+			RejectUnregisteredMeasurements: *rejectUnregisteredMeasurements,
+
+			DropOrphanedMeasurements: *dropOrphanedMeasurements,
+			ReconcileOnPeerGone:      *reconcileOnPeerGone,
+
+			MultiSegmentIDs: *multiSegmentIDs,
+
+			SharedSubscriptionGroup: *sharedSubscriptionGroup,
+
+			MaxRegistrationsPerPeer: *maxRegistrationsPerPeer,
+
+			DryRun: *dryRun,
+
+			TemperatureUnit: *temperatureUnit,
+
+			Codec: codec,
+
+			PublishRegistrationEvents: *publishRegistrationEvents,
+
+			PublishCommandAcks: *publishCommandAcks,
+
+			PublishShadow: *publishShadow,
+
+			PruneUnsupportedActuators: *pruneUnsupportedActuators,
+
+			HeartbeatInterval: *heartbeatInterval,
+
+			MeasurementBufferSize:    *measurementBufferSize,
+			MeasurementFlushInterval: *measurementFlushInterval,
+			MeasurementFlushRate:     *measurementFlushRate,
+			MeasurementFlushJitter:   *measurementFlushJitter,
+
+			MeasurementBufferTTLs: map[string]time.Duration{
+				services.DeviceTypeTemperature: *temperatureMeasurementBufferTTL,
+				services.DeviceTypeMoisture:    *moistureMeasurementBufferTTL,
+			},
+
+			Logger:   slog.New(logHandler),
+			LogLevel: logLevel,
+
+			StaleTemperatureTimeout: *staleTemperatureTimeout,
+
+			SprinklerDebounceInterval: *sprinklerDebounceInterval,
+
+			CommandRedeliveryTTL:       *commandRedeliveryTTL,
+			CommandRedeliveryCacheSize: *commandRedeliveryCacheSize,
+
+			MinimumDwellTimes: map[string]time.Duration{
+				services.DeviceTypeFan:          *fanMinDwellTime,
+				services.DeviceTypeDehumidifier: *dehumidifierMinDwellTime,
+			},
+
+			UnknownCommandStrategy: unknownCommandStrategy,
+			PendingCommandTTL:      *pendingCommandTTL,
+			MaxPendingCommands:     *maxPendingCommands,
+
+			PublishTimeout: *publishTimeout,
+
+			HubCallTimeout: *hubCallTimeout,
+
+			MaxConcurrentHubCalls: *maxConcurrentHubCalls,
+			MaxWaitingHubCalls:    *maxWaitingHubCalls,
+
+			CircuitBreakerThreshold: *circuitBreakerThreshold,
+			CircuitBreakerCooldown:  *circuitBreakerCooldown,
+
+			CommandWorkers:   *commandWorkers,
+			CommandQueueSize: *commandQueueSize,
+
+			RateLimit:      *rateLimit,
+			RateLimitBurst: *rateLimitBurst,
+
+			Dedup: services.DedupConfig{
+				Enabled: *dedup,
+
+				MaxSkips:    *dedupMaxSkips,
+				MaxInterval: *dedupMaxInterval,
+			},
+
+			Batch: services.BatchConfig{
+				Window:      *batchWindow,
+				Aggregation: services.BatchAggregation(*batchAggregation),
+			},
+
+			CompressionThreshold: *compressionThreshold,
+
+			ErrorBufferSize: *errorBufferSize,
+		},
+	)
+	if err != nil {
 		panic(err)
 	}
-	defer services.CloseGateway(gateway)
+
+	log.Println("Connected to", *endpoint)
 
 	clients := 0
 	registry := rpc.NewRegistry(
-		gateway,
+		services.NewGatewayRPC(gateway),
 		services.HubRemote{},
 
 		time.Second*10,
@@ -113,6 +519,26 @@ func main() {
 	)
 	gateway.Peers = registry.Peers
 
+	errs := make(chan error)
+	go func() {
+		if err := services.WaitGateway(gateway); err != nil {
+			errs <- err
+		}
+	}()
+
+	if err := services.OpenGateway(gateway, ctx); err != nil {
+		panic(err)
+	}
+	defer services.CloseGateway(gateway)
+
+	if *adminLaddr != "" {
+		if err := gateway.StartAdminServer(*adminLaddr); err != nil {
+			panic(err)
+		}
+
+		log.Println("Admin server listening on", *adminLaddr)
+	}
+
 	lis, err := net.Listen("tcp", *laddr)
 	if err != nil {
 		panic(err)
@@ -60,6 +60,9 @@ func main() {
 	temperatureSensors := flag.String("temperature-sensors", uutils.GetStringEnvOrDefault("TEMPERATURE_SENSORS", `{"1": "/dev/ttyACM0"}`), "JSON description in the format { roomID: devicePath }")
 	sprinklers := flag.String("sprinklers", uutils.GetStringEnvOrDefault("SPRINKLERS", `{"1": "/dev/ttyACM0"}`), "JSON description in the format { plantID: devicePath }")
 	moistureSensors := flag.String("moisture-sensors", uutils.GetStringEnvOrDefault("MOISTURE_SENSORS", `{"1": "/dev/ttyACM0"}`), "JSON description in the format { roomID: devicePath }")
+	dehumidifiers := flag.String("dehumidifiers", uutils.GetStringEnvOrDefault("DEHUMIDIFIERS", `{}`), "JSON description in the format { roomID: devicePath }")
+	lamps := flag.String("lamps", uutils.GetStringEnvOrDefault("LAMPS", `{}`), "JSON description in the format { roomID: devicePath }")
+	dosers := flag.String("dosers", uutils.GetStringEnvOrDefault("DOSERS", `{}`), "JSON description in the format { plantID: devicePath }")
 
 	mockDefault, err := uutils.GetIntEnvOrDefault("MOCK", 0)
 	if err != nil {
@@ -140,6 +143,57 @@ func main() {
 		moistureSensorBindings[roomID] = it
 	}
 
+	dehumidifierDevices := map[string]string{}
+	if err := json.Unmarshal([]byte(*dehumidifiers), &dehumidifierDevices); err != nil {
+		panic(err)
+	}
+
+	dehumidifierBindings := map[string]*iotee.IoTee{}
+	for roomID, dev := range dehumidifierDevices {
+		it := iotee.NewIoTee(dev, *baud)
+
+		if err := it.Open(); err != nil {
+			panic(err)
+		}
+		defer it.Close()
+
+		dehumidifierBindings[roomID] = it
+	}
+
+	lampDevices := map[string]string{}
+	if err := json.Unmarshal([]byte(*lamps), &lampDevices); err != nil {
+		panic(err)
+	}
+
+	lampBindings := map[string]*iotee.IoTee{}
+	for roomID, dev := range lampDevices {
+		it := iotee.NewIoTee(dev, *baud)
+
+		if err := it.Open(); err != nil {
+			panic(err)
+		}
+		defer it.Close()
+
+		lampBindings[roomID] = it
+	}
+
+	doserDevices := map[string]string{}
+	if err := json.Unmarshal([]byte(*dosers), &doserDevices); err != nil {
+		panic(err)
+	}
+
+	doserBindings := map[string]*iotee.IoTee{}
+	for plantID, dev := range doserDevices {
+		it := iotee.NewIoTee(dev, *baud)
+
+		if err := it.Open(); err != nil {
+			panic(err)
+		}
+		defer it.Close()
+
+		doserBindings[plantID] = it
+	}
+
 	hub := services.NewHub(
 		*verbose,
 		ctx,
@@ -152,6 +206,10 @@ func main() {
 		moistureSensorBindings,
 		*defaultMoisture,
 
+		dehumidifierBindings,
+		lampBindings,
+		doserBindings,
+
 		*measureInterval,
 		*measureTimeout,
 
@@ -160,7 +218,7 @@ func main() {
 
 	ready := make(chan struct{})
 	registry := rpc.NewRegistry(
-		hub,
+		services.NewHubRPC(hub),
 		services.GatewayRemote{},
 
 		time.Second*10,
@@ -1,14 +1,107 @@
 package mqtt
 
+import "time"
+
+const (
+	GatewayStatusOnline  = "online"
+	GatewayStatusOffline = "offline"
+)
+
+const (
+	UnitCelsius    = "celsius"
+	UnitFahrenheit = "fahrenheit"
+	UnitKelvin     = "kelvin"
+)
+
+const (
+	RegistrationActionRegister   = "register"
+	RegistrationActionUnregister = "unregister"
+)
+
 type FanState struct {
 	On bool `json:"on"`
 }
 
 type SprinklerState = FanState
 
+type DehumidifierState = FanState
+
+type LampState = FanState
+
+type DoserState = FanState
+
+type CommandAck struct {
+	On        bool      `json:"on"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
 type TemperatureMeasurement struct {
-	Measurement  int `json:"measurement"`
-	DefaultValue int `json:"default"`
+	Measurement  int       `json:"measurement"`
+	DefaultValue int       `json:"default"`
+	Unit         string    `json:"unit,omitempty"`
+	TakenAt      time.Time `json:"takenAt"`
+	Sequence     uint64    `json:"sequence"`
+}
+
+type TemperatureMeasurementFloat struct {
+	Measurement  float64   `json:"measurement"`
+	DefaultValue float64   `json:"default"`
+	Unit         string    `json:"unit"`
+	Precision    int       `json:"precision"`
+	TakenAt      time.Time `json:"takenAt"`
+	Sequence     uint64    `json:"sequence"`
 }
 
 type MoistureMeasurement = TemperatureMeasurement
+
+type HumidityMeasurement = TemperatureMeasurement
+
+type LightMeasurement = TemperatureMeasurement
+
+type PHMeasurement = TemperatureMeasurement
+
+type RegistrationEvent struct {
+	Action     string    `json:"action"`
+	DeviceType string    `json:"deviceType"`
+	IDs        []string  `json:"ids"`
+	PeerID     string    `json:"peerID"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type RegistrationSnapshot struct {
+	Fans          map[string][]string `json:"fans"`
+	Sprinklers    map[string][]string `json:"sprinklers"`
+	Dehumidifiers map[string][]string `json:"dehumidifiers"`
+	Lamps         map[string][]string `json:"lamps"`
+	Dosers        map[string][]string `json:"dosers"`
+	Timestamp     time.Time           `json:"timestamp"`
+}
+
+type ActuatorStates struct {
+	Fans          map[string]bool `json:"fans"`
+	Sprinklers    map[string]bool `json:"sprinklers"`
+	Dehumidifiers map[string]bool `json:"dehumidifiers"`
+	Lamps         map[string]bool `json:"lamps"`
+	Dosers        map[string]bool `json:"dosers"`
+}
+
+type ShadowState struct {
+	Reported ActuatorStates `json:"reported"`
+}
+
+type Shadow struct {
+	State     ShadowState `json:"state"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+type GatewayStatus struct {
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Heartbeat struct {
+	Sequence  uint64    `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+}
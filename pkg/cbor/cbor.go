@@ -0,0 +1,756 @@
+// Package cbor implements a CBOR (RFC 8949) codec for the gateway's MQTT messages without external dependencies.
+// Structs are encoded as maps with the names from their `json` tags, so messages look the same as with JSON.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported type")
+	ErrInvalidData     = errors.New("invalid CBOR data")
+	ErrUnknownField    = errors.New("unknown field")
+	ErrTrailingData    = errors.New("unexpected trailing data")
+	ErrTooDeep         = errors.New("data is nested too deeply")
+)
+
+// maxDepth limits how deeply arrays, maps and tags may be nested, so that crafted data can't exhaust the stack
+const maxDepth = 64
+
+const (
+	majorUnsigned = 0
+	majorNegative = 1
+	majorBytes    = 2
+	majorText     = 3
+	majorArray    = 4
+	majorMap      = 5
+	majorTag      = 6
+	majorSimple   = 7
+
+	simpleFalse     = 20
+	simpleTrue      = 21
+	simpleNull      = 22
+	simpleUndefined = 23
+	simpleFloat16   = 25
+	simpleFloat32   = 26
+	simpleFloat64   = 27
+
+	tagDateTimeString = 0
+	tagEpochDateTime  = 1
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Codec implements `services.Codec`
+type Codec struct{}
+
+func (c Codec) Marshal(v any) ([]byte, error) {
+	var e encoder
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return e.buf.Bytes(), nil
+}
+
+// Unmarshal decodes `data` into `v`, which must be a non-nil pointer. Like `services.JSONCodec`, it rejects unknown fields.
+func (c Codec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("%w: %T, must be a non-nil pointer", ErrUnsupportedType, v)
+	}
+
+	d := decoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+
+	if d.off != len(d.data) {
+		return ErrTrailingData
+	}
+
+	return nil
+}
+
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+func getFields(t reflect.Type) []field {
+	fields := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, field{
+			name:      name,
+			index:     i,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+
+	return fields
+}
+
+// isEmpty matches the values that `encoding/json` omits with `omitempty`
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return v.IsZero()
+
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+
+	return false
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) writeHead(major byte, n uint64) {
+	switch {
+	case n < 24:
+		e.buf.WriteByte(major<<5 | byte(n))
+
+	case n <= math.MaxUint8:
+		e.buf.WriteByte(major<<5 | 24)
+		e.buf.WriteByte(byte(n))
+
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(major<<5 | 25)
+		e.buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+
+	case n <= math.MaxUint32:
+		e.buf.WriteByte(major<<5 | 26)
+		e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+
+	default:
+		e.buf.WriteByte(major<<5 | 27)
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func (e *encoder) writeText(s string) {
+	e.writeHead(majorText, uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf.WriteByte(majorSimple<<5 | simpleNull)
+
+		return nil
+	}
+
+	if v.Type() == timeType {
+		e.writeHead(majorTag, tagDateTimeString)
+		e.writeText(v.Interface().(time.Time).Format(time.RFC3339Nano))
+
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf.WriteByte(majorSimple<<5 | simpleTrue)
+		} else {
+			e.buf.WriteByte(majorSimple<<5 | simpleFalse)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n >= 0 {
+			e.writeHead(majorUnsigned, uint64(n))
+		} else {
+			e.writeHead(majorNegative, uint64(-1-n))
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeHead(majorUnsigned, v.Uint())
+
+	case reflect.Float32, reflect.Float64:
+		e.buf.WriteByte(majorSimple<<5 | simpleFloat64)
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v.Float())))
+
+	case reflect.String:
+		e.writeText(v.String())
+
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf.WriteByte(majorSimple<<5 | simpleNull)
+
+			return nil
+		}
+
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeHead(majorBytes, uint64(v.Len()))
+			e.buf.Write(v.Bytes())
+
+			return nil
+		}
+
+		return e.encodeArray(v)
+
+	case reflect.Array:
+		return e.encodeArray(v)
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("%w: %v, map keys must be strings", ErrUnsupportedType, v.Type())
+		}
+
+		if v.IsNil() {
+			e.buf.WriteByte(majorSimple<<5 | simpleNull)
+
+			return nil
+		}
+
+		// We sort the keys so that equal maps are always encoded to the same bytes
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		e.writeHead(majorMap, uint64(len(keys)))
+		for _, key := range keys {
+			e.writeText(key.String())
+
+			if err := e.encode(v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		fields := []field{}
+		for _, f := range getFields(v.Type()) {
+			if f.omitEmpty && isEmpty(v.Field(f.index)) {
+				continue
+			}
+
+			fields = append(fields, f)
+		}
+
+		e.writeHead(majorMap, uint64(len(fields)))
+		for _, f := range fields {
+			e.writeText(f.name)
+
+			if err := e.encode(v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf.WriteByte(majorSimple<<5 | simpleNull)
+
+			return nil
+		}
+
+		return e.encode(v.Elem())
+
+	default:
+		return fmt.Errorf("%w: %v", ErrUnsupportedType, v.Type())
+	}
+
+	return nil
+}
+
+func (e *encoder) encodeArray(v reflect.Value) error {
+	e.writeHead(majorArray, uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type decoder struct {
+	data  []byte
+	off   int
+	depth int
+}
+
+func (d *decoder) enter() error {
+	if d.depth >= maxDepth {
+		return fmt.Errorf("%w: maximum depth is %v", ErrTooDeep, maxDepth)
+	}
+
+	d.depth++
+
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+func (d *decoder) read(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.off) {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidData)
+	}
+
+	b := d.data[d.off : d.off+int(n)]
+	d.off += int(n)
+
+	return b, nil
+}
+
+// readHead reads the initial byte and argument of an item; for simple values and floats, `n` holds their raw bits
+func (d *decoder) readHead() (major byte, info byte, n uint64, err error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	major, info = b[0]>>5, b[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+
+	case info <= 27:
+		arg, err := d.read(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		for _, b := range arg {
+			n = n<<8 | uint64(b)
+		}
+
+		return major, info, n, nil
+	}
+
+	return 0, 0, 0, fmt.Errorf("%w: unsupported additional information %v", ErrInvalidData, info)
+}
+
+// readLength reads the argument of a string, array or map and rejects lengths that can't fit in the remaining data
+func (d *decoder) readLength(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.off) {
+		return 0, fmt.Errorf("%w: length %v exceeds data", ErrInvalidData, n)
+	}
+
+	return int(n), nil
+}
+
+func decodeFloat(info byte, n uint64) (float64, error) {
+	switch info {
+	case simpleFloat16:
+		return decodeFloat16(uint16(n)), nil
+
+	case simpleFloat32:
+		return float64(math.Float32frombits(uint32(n))), nil
+
+	case simpleFloat64:
+		return math.Float64frombits(n), nil
+	}
+
+	return 0, fmt.Errorf("%w: not a float", ErrInvalidData)
+}
+
+func decodeFloat16(bits uint16) float64 {
+	exponent := int(bits>>10) & 0x1f
+	mantissa := float64(bits & 0x3ff)
+
+	value := 0.0
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+
+	case 0x1f:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+
+	if bits&0x8000 != 0 {
+		return -value
+	}
+
+	return value
+}
+
+func (d *decoder) mismatch(major byte, t reflect.Type) error {
+	return fmt.Errorf("%w: can't decode major type %v into %v", ErrInvalidData, major, t)
+}
+
+func (d *decoder) decode(v reflect.Value) error {
+	if d.off < len(d.data) {
+		if b := d.data[d.off]; b == majorSimple<<5|simpleNull || b == majorSimple<<5|simpleUndefined {
+			d.off++
+
+			switch v.Kind() {
+			case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+				v.Set(reflect.Zero(v.Type()))
+			}
+
+			return nil
+		}
+	}
+
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		return d.decode(v.Elem())
+	}
+
+	if v.Type() == timeType {
+		return d.decodeTime(v)
+	}
+
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("%w: %v", ErrUnsupportedType, v.Type())
+		}
+
+		value, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+
+		return nil
+	}
+
+	major, info, n, err := d.readHead()
+	if err != nil {
+		return err
+	}
+
+	switch major {
+	case majorArray, majorMap, majorTag:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+	}
+
+	switch major {
+	case majorUnsigned, majorNegative:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if n > math.MaxInt64 {
+				return fmt.Errorf("%w: %v overflows %v", ErrInvalidData, n, v.Type())
+			}
+
+			i := int64(n)
+			if major == majorNegative {
+				i = -1 - i
+			}
+
+			if v.OverflowInt(i) {
+				return fmt.Errorf("%w: %v overflows %v", ErrInvalidData, i, v.Type())
+			}
+
+			v.SetInt(i)
+
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if major == majorNegative || v.OverflowUint(n) {
+				return fmt.Errorf("%w: value overflows %v", ErrInvalidData, v.Type())
+			}
+
+			v.SetUint(n)
+
+		case reflect.Float32, reflect.Float64:
+			f := float64(n)
+			if major == majorNegative {
+				f = -1 - f
+			}
+
+			v.SetFloat(f)
+
+		default:
+			return d.mismatch(major, v.Type())
+		}
+
+	case majorBytes, majorText:
+		length, err := d.readLength(n)
+		if err != nil {
+			return err
+		}
+
+		b, err := d.read(uint64(length))
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case major == majorText && v.Kind() == reflect.String:
+			v.SetString(string(b))
+
+		case major == majorBytes && v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte{}, b...))
+
+		default:
+			return d.mismatch(major, v.Type())
+		}
+
+	case majorArray:
+		length, err := d.readLength(n)
+		if err != nil {
+			return err
+		}
+
+		switch v.Kind() {
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), length, length))
+
+		case reflect.Array:
+			if length != v.Len() {
+				return fmt.Errorf("%w: array of length %v doesn't fit %v", ErrInvalidData, length, v.Type())
+			}
+
+		default:
+			return d.mismatch(major, v.Type())
+		}
+
+		for i := 0; i < length; i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case majorMap:
+		length, err := d.readLength(n)
+		if err != nil {
+			return err
+		}
+
+		switch v.Kind() {
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return fmt.Errorf("%w: %v, map keys must be strings", ErrUnsupportedType, v.Type())
+			}
+
+			if v.IsNil() {
+				v.Set(reflect.MakeMapWithSize(v.Type(), length))
+			}
+
+			for i := 0; i < length; i++ {
+				key, err := d.decodeText()
+				if err != nil {
+					return err
+				}
+
+				value := reflect.New(v.Type().Elem()).Elem()
+				if err := d.decode(value); err != nil {
+					return err
+				}
+
+				v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), value)
+			}
+
+		case reflect.Struct:
+			fields := map[string]int{}
+			for _, f := range getFields(v.Type()) {
+				fields[f.name] = f.index
+			}
+
+			for i := 0; i < length; i++ {
+				key, err := d.decodeText()
+				if err != nil {
+					return err
+				}
+
+				index, ok := fields[key]
+				if !ok {
+					return fmt.Errorf("%w: %q in %v", ErrUnknownField, key, v.Type())
+				}
+
+				if err := d.decode(v.Field(index)); err != nil {
+					return err
+				}
+			}
+
+		default:
+			return d.mismatch(major, v.Type())
+		}
+
+	case majorTag:
+		// We don't know any tags for values other than times, so we decode their content as-is
+		return d.decode(v)
+
+	case majorSimple:
+		switch {
+		case (info == simpleFalse || info == simpleTrue) && v.Kind() == reflect.Bool:
+			v.SetBool(info == simpleTrue)
+
+		case info >= simpleFloat16 && (v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64):
+			f, err := decodeFloat(info, n)
+			if err != nil {
+				return err
+			}
+
+			v.SetFloat(f)
+
+		default:
+			return d.mismatch(major, v.Type())
+		}
+	}
+
+	return nil
+}
+
+func (d *decoder) decodeText() (string, error) {
+	major, _, n, err := d.readHead()
+	if err != nil {
+		return "", err
+	}
+
+	if major != majorText {
+		return "", fmt.Errorf("%w: map keys must be text strings", ErrInvalidData)
+	}
+
+	length, err := d.readLength(n)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := d.read(uint64(length))
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (d *decoder) decodeTime(v reflect.Value) error {
+	major, _, n, err := d.readHead()
+	if err != nil {
+		return err
+	}
+
+	if major != majorTag {
+		return d.mismatch(major, v.Type())
+	}
+
+	switch n {
+	case tagDateTimeString:
+		s, err := d.decodeText()
+		if err != nil {
+			return err
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidData, err)
+		}
+
+		v.Set(reflect.ValueOf(t))
+
+	case tagEpochDateTime:
+		var seconds float64
+		if err := d.decode(reflect.ValueOf(&seconds).Elem()); err != nil {
+			return err
+		}
+
+		whole, fraction := math.Modf(seconds)
+		v.Set(reflect.ValueOf(time.Unix(int64(whole), int64(fraction*1e9)).UTC()))
+
+	default:
+		return fmt.Errorf("%w: unsupported tag %v for %v", ErrInvalidData, n, v.Type())
+	}
+
+	return nil
+}
+
+// decodeAny decodes the next item into the same types as `encoding/json` does for `any`
+func (d *decoder) decodeAny() (any, error) {
+	if d.off >= len(d.data) {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidData)
+	}
+
+	switch major := d.data[d.off] >> 5; major {
+	case majorUnsigned, majorNegative:
+		var f float64
+		err := d.decode(reflect.ValueOf(&f).Elem())
+
+		return f, err
+
+	case majorBytes:
+		var b []byte
+		err := d.decode(reflect.ValueOf(&b).Elem())
+
+		return b, err
+
+	case majorText:
+		return d.decodeText()
+
+	case majorArray:
+		var a []any
+		err := d.decode(reflect.ValueOf(&a).Elem())
+
+		return a, err
+
+	case majorMap:
+		var m map[string]any
+		err := d.decode(reflect.ValueOf(&m).Elem())
+
+		return m, err
+
+	case majorTag:
+		var t time.Time
+		err := d.decodeTime(reflect.ValueOf(&t).Elem())
+
+		return t, err
+
+	default:
+		_, info, n, err := d.readHead()
+		if err != nil {
+			return nil, err
+		}
+
+		switch info {
+		case simpleFalse, simpleTrue:
+			return info == simpleTrue, nil
+
+		case simpleNull, simpleUndefined:
+			return nil, nil
+		}
+
+		return decodeFloat(info, n)
+	}
+}
@@ -0,0 +1,245 @@
+package cbor_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/cbor"
+)
+
+var testTimestamp = time.Date(2023, 6, 20, 14, 10, 5, 123456789, time.UTC)
+
+func getMessages() []any {
+	return []any{
+		&mqttapi.FanState{On: true},
+		&mqttapi.SprinklerState{},
+		&mqttapi.CommandAck{
+			On:        true,
+			Success:   false,
+			Error:     "timed out waiting for hub to respond",
+			Timestamp: testTimestamp,
+		},
+		&mqttapi.CommandAck{
+			On:        true,
+			Success:   true,
+			Timestamp: testTimestamp,
+		},
+		&mqttapi.TemperatureMeasurement{
+			Measurement:  -24,
+			DefaultValue: 20,
+			Unit:         mqttapi.UnitCelsius,
+			TakenAt:      testTimestamp,
+			Sequence:     1 << 40,
+		},
+		&mqttapi.MoistureMeasurement{
+			Measurement:  65,
+			DefaultValue: 50,
+			TakenAt:      testTimestamp,
+			Sequence:     42,
+		},
+		&mqttapi.TemperatureMeasurementFloat{
+			Measurement:  22.4,
+			DefaultValue: -20.5,
+			Unit:         mqttapi.UnitKelvin,
+			Precision:    2,
+			TakenAt:      testTimestamp,
+			Sequence:     42,
+		},
+		&mqttapi.RegistrationEvent{
+			Action:     mqttapi.RegistrationActionRegister,
+			DeviceType: "fan",
+			IDs:        []string{"1", "building1/floor2/room3"},
+			PeerID:     "3f5c9a2e-1b7d-4e0a-9c61-8d2f4b7a6e13",
+			Timestamp:  testTimestamp,
+		},
+		&mqttapi.RegistrationSnapshot{
+			Fans: map[string][]string{
+				"1": {"3f5c9a2e-1b7d-4e0a-9c61-8d2f4b7a6e13"},
+			},
+			Sprinklers:    map[string][]string{},
+			Dehumidifiers: map[string][]string{},
+			Lamps:         map[string][]string{},
+			Dosers:        map[string][]string{},
+			Timestamp:     testTimestamp,
+		},
+		&mqttapi.Shadow{
+			State: mqttapi.ShadowState{
+				Reported: mqttapi.ActuatorStates{
+					Fans:          map[string]bool{"1": true},
+					Sprinklers:    map[string]bool{"1": false},
+					Dehumidifiers: map[string]bool{},
+					Lamps:         map[string]bool{},
+					Dosers:        map[string]bool{},
+				},
+			},
+			Timestamp: testTimestamp,
+		},
+		&mqttapi.GatewayStatus{
+			Status:    mqttapi.GatewayStatusOnline,
+			Timestamp: testTimestamp,
+		},
+		&mqttapi.Heartbeat{
+			Sequence:  42,
+			Timestamp: testTimestamp,
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, message := range getMessages() {
+		t.Run(fmt.Sprintf("%T", message), func(t *testing.T) {
+			data, err := cbor.Codec{}.Marshal(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded := reflect.New(reflect.TypeOf(message).Elem()).Interface()
+			if err := (cbor.Codec{}).Unmarshal(data, decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(message, decoded) {
+				t.Fatalf("expected %+v, got %+v", message, decoded)
+			}
+		})
+	}
+}
+
+func TestMarshalFanState(t *testing.T) {
+	data, err := cbor.Codec{}.Marshal(mqttapi.FanState{On: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// {"on": true}
+	if expected := []byte{0xa1, 0x62, 'o', 'n', 0xf5}; !bytes.Equal(data, expected) {
+		t.Fatalf("expected %x, got %x", expected, data)
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	for _, message := range getMessages() {
+		t.Run(fmt.Sprintf("%T", message), func(t *testing.T) {
+			data, err := cbor.Codec{}.Marshal(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < len(data); i++ {
+				decoded := reflect.New(reflect.TypeOf(message).Elem()).Interface()
+				if err := (cbor.Codec{}).Unmarshal(data[:i], decoded); !errors.Is(err, cbor.ErrInvalidData) {
+					t.Fatalf("expected %v for %v of %v bytes, got %v", cbor.ErrInvalidData, i, len(data), err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{"unknown field", []byte{0xa1, 0x63, 'o', 'f', 'f', 0xf5}, cbor.ErrUnknownField},
+		{"wrong type", []byte{0xa1, 0x62, 'o', 'n', 0x01}, cbor.ErrInvalidData},
+		{"not a map", []byte{0x81, 0xf5}, cbor.ErrInvalidData},
+		{"non-text key", []byte{0xa1, 0x01, 0xf5}, cbor.ErrInvalidData},
+		{"reserved additional information", []byte{0xbc}, cbor.ErrInvalidData},
+		{"indefinite length", []byte{0xbf, 0x62, 'o', 'n', 0xf5, 0xff}, cbor.ErrInvalidData},
+		{"length exceeds data", []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, cbor.ErrInvalidData},
+		{"key length exceeds data", []byte{0xa1, 0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, cbor.ErrInvalidData},
+		{"trailing data", []byte{0xa1, 0x62, 'o', 'n', 0xf5, 0x00}, cbor.ErrTrailingData},
+		{"empty", []byte{}, cbor.ErrInvalidData},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var state mqttapi.FanState
+			if err := (cbor.Codec{}).Unmarshal(tt.data, &state); !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMalformedTimestamp(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"untagged", []byte{0x64, 'n', 'o', 'w', '!'}},
+		{"invalid date/time string", []byte{0xc0, 0x63, 'n', 'o', 'w'}},
+		{"unsupported tag", []byte{0xc2, 0x01}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte{0xa2, 0x66, 's', 't', 'a', 't', 'u', 's', 0x66, 'o', 'n', 'l', 'i', 'n', 'e', 0x69, 't', 'i', 'm', 'e', 's', 't', 'a', 'm', 'p'}, tt.data...)
+
+			var status mqttapi.GatewayStatus
+			if err := (cbor.Codec{}).Unmarshal(data, &status); !errors.Is(err, cbor.ErrInvalidData) {
+				t.Fatalf("expected %v, got %v", cbor.ErrInvalidData, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalEpochTimestamp(t *testing.T) {
+	// {"status": "online", "timestamp": 1(1687270205)}
+	data := []byte{0xa2, 0x66, 's', 't', 'a', 't', 'u', 's', 0x66, 'o', 'n', 'l', 'i', 'n', 'e', 0x69, 't', 'i', 'm', 'e', 's', 't', 'a', 'm', 'p', 0xc1, 0x1a, 0x64, 0x91, 0xb3, 0x3d}
+
+	var status mqttapi.GatewayStatus
+	if err := (cbor.Codec{}).Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := time.Date(2023, 6, 20, 14, 10, 5, 0, time.UTC); !status.Timestamp.Equal(expected) {
+		t.Fatalf("expected %v, got %v", expected, status.Timestamp)
+	}
+}
+
+func getNested(head byte, depth int, item byte) []byte {
+	return append(bytes.Repeat([]byte{head}, depth), item)
+}
+
+func TestUnmarshalDeeplyNested(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+		v    any
+	}{
+		{"arrays into any", getNested(0x81, 5_000_000, 0x00), new(any)},
+		{"arrays into a slice", getNested(0x81, 5_000_000, 0x00), new([]any)},
+		{"maps into any", append(bytes.Repeat([]byte{0xa1, 0x61, 'a'}, 5_000_000), 0x00), new(any)},
+		{"tags into an epoch timestamp", append([]byte{0xc1}, getNested(0xc6, 5_000_000, 0x00)...), new(time.Time)},
+		{"tags into a field", append([]byte{0xa1, 0x62, 'o', 'n'}, getNested(0xc6, 5_000_000, 0xf5)...), new(mqttapi.FanState)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (cbor.Codec{}).Unmarshal(tt.data, tt.v); !errors.Is(err, cbor.ErrTooDeep) {
+				t.Fatalf("expected %v, got %v", cbor.ErrTooDeep, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalNested(t *testing.T) {
+	var v any
+	if err := (cbor.Codec{}).Unmarshal(getNested(0x81, 32, 0x00), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 32; i++ {
+		a, ok := v.([]any)
+		if !ok || len(a) != 1 {
+			t.Fatalf("expected an array of length 1 at depth %v, got %v", i, v)
+		}
+
+		v = a[0]
+	}
+
+	if v != 0.0 {
+		t.Fatalf("expected 0, got %v", v)
+	}
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+var (
+	ErrAdminServerRunning = errors.New("admin server is already running")
+)
+
+func (w *Gateway) writeAdminResponse(rw http.ResponseWriter, status int, body any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		w.log.Debug("Could not write admin response", "err", err)
+	}
+}
+
+// StartAdminServer serves the gateway's health and registrations as JSON on `addr` until the gateway is closed.
+// If the configured `Metrics` implement `http.Handler`, they are served on `/metrics` as well.
+func (w *Gateway) StartAdminServer(addr string) error {
+	w.lifecycleLock.Lock()
+	defer w.lifecycleLock.Unlock()
+
+	if !w.opened || w.closed {
+		return ErrNotOpen
+	}
+
+	if w.adminServer != nil {
+		return ErrAdminServerRunning
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
+		health := w.Health()
+
+		status := http.StatusOK
+		if !health.BrokerConnected || !health.Opened {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.writeAdminResponse(rw, status, health)
+	})
+
+	mux.HandleFunc("/fans", func(rw http.ResponseWriter, r *http.Request) {
+		w.writeAdminResponse(rw, http.StatusOK, w.ListFans())
+	})
+
+	mux.HandleFunc("/sprinklers", func(rw http.ResponseWriter, r *http.Request) {
+		w.writeAdminResponse(rw, http.StatusOK, w.ListSprinklers())
+	})
+
+	if handler, ok := w.metrics.(http.Handler); ok {
+		mux.Handle("/metrics", handler)
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	w.adminServer = &http.Server{
+		Handler: mux,
+	}
+
+	w.log.Debug("Admin server listening", "addr", lis.Addr().String())
+
+	go func(server *http.Server) {
+		if err := server.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			w.log.Warn("Admin server stopped", "err", err)
+		}
+	}(w.adminServer)
+
+	// Handlers may need the lifecycle lock, which is held while closing, so we can't shut down synchronously
+	go func(server *http.Server) {
+		<-w.ctx.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), w.drainTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			w.log.Warn("Could not shut down admin server gracefully", "err", err)
+
+			_ = server.Close()
+		}
+	}(w.adminServer)
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidBatchAggregation = errors.New("invalid batch aggregation")
+)
+
+type BatchAggregation string
+
+const (
+	BatchAggregationAverage BatchAggregation = "average"
+	BatchAggregationMinimum BatchAggregation = "minimum"
+	BatchAggregationMaximum BatchAggregation = "maximum"
+)
+
+type BatchConfig struct {
+	Window time.Duration
+
+	// Aggregation selects the value that is forwarded for all measurements within a window; defaults to `BatchAggregationAverage`
+	Aggregation BatchAggregation
+}
+
+type measurementBatch struct {
+	min,
+	max,
+	sum float64
+	count int
+
+	publish func(aggregate float64) error
+	timer   Timer
+}
+
+type batcher struct {
+	window      time.Duration
+	aggregation BatchAggregation
+
+	log   *slog.Logger
+	clock Clock
+
+	batches map[string]*measurementBatch
+	closed  bool
+
+	lock sync.Mutex
+}
+
+func newBatcher(config BatchConfig, log *slog.Logger, clock Clock) (*batcher, error) {
+	aggregation := config.Aggregation
+	switch aggregation {
+	case "":
+		aggregation = BatchAggregationAverage
+
+	case BatchAggregationAverage, BatchAggregationMinimum, BatchAggregationMaximum:
+
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBatchAggregation, aggregation)
+	}
+
+	return &batcher{
+		window:      config.Window,
+		aggregation: aggregation,
+
+		log:   log,
+		clock: clock,
+
+		batches: map[string]*measurementBatch{},
+	}, nil
+}
+
+// add records `measurement` in the batch for `key`, which is flushed once the window that the batch's first
+// measurement started ends. Only the latest `publish` is called, so the aggregate carries the latest metadata.
+func (b *batcher) add(key string, measurement float64, publish func(aggregate float64) error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &measurementBatch{
+			min: measurement,
+			max: measurement,
+		}
+
+		batch.timer = b.clock.AfterFunc(b.window, func() {
+			b.flush(key, batch)
+		})
+
+		b.batches[key] = batch
+	}
+
+	batch.min = math.Min(batch.min, measurement)
+	batch.max = math.Max(batch.max, measurement)
+	batch.sum += measurement
+	batch.count++
+
+	batch.publish = publish
+}
+
+func (b *batcher) flush(key string, batch *measurementBatch) {
+	b.lock.Lock()
+	if b.batches[key] != batch {
+		// The batch has been removed or the batcher has been closed in the meantime
+		b.lock.Unlock()
+
+		return
+	}
+
+	delete(b.batches, key)
+
+	aggregate := batch.sum / float64(batch.count)
+	switch b.aggregation {
+	case BatchAggregationMinimum:
+		aggregate = batch.min
+
+	case BatchAggregationMaximum:
+		aggregate = batch.max
+	}
+	b.lock.Unlock()
+
+	if err := batch.publish(aggregate); err != nil {
+		b.log.Warn("Could not forward batched measurement", "key", key, "count", batch.count, "err", err)
+	}
+}
+
+func (b *batcher) remove(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if batch, ok := b.batches[key]; ok {
+		batch.timer.Stop()
+
+		delete(b.batches, key)
+	}
+}
+
+func (b *batcher) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+
+	for key, batch := range b.batches {
+		batch.timer.Stop()
+
+		delete(b.batches, key)
+	}
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrMeasurementOutOfRange = errors.New("measurement out of range")
+)
+
+// MeasurementRange bounds the measurements of a device type; a nil Min or Max leaves that side unbounded
+type MeasurementRange struct {
+	Min *float64
+	Max *float64
+}
+
+func formatBound(bound *float64) string {
+	if bound == nil {
+		return "none"
+	}
+
+	return fmt.Sprintf("%v", *bound)
+}
+
+type rangeValidator struct {
+	ranges   map[string]MeasurementRange
+	rejected int
+
+	lock sync.Mutex
+}
+
+func newRangeValidator(ranges map[string]MeasurementRange) *rangeValidator {
+	rv := map[string]MeasurementRange{}
+	for deviceType, r := range ranges {
+		rv[deviceType] = r
+	}
+
+	return &rangeValidator{
+		ranges: rv,
+	}
+}
+
+func (v *rangeValidator) check(deviceType, id string, measurement float64) error {
+	r, ok := v.ranges[deviceType]
+	if !ok || ((r.Min == nil || measurement >= *r.Min) && (r.Max == nil || measurement <= *r.Max)) {
+		return nil
+	}
+
+	v.lock.Lock()
+	v.rejected++
+	v.lock.Unlock()
+
+	return fmt.Errorf("%w: deviceType=%v id=%v measurement=%v min=%v max=%v", ErrMeasurementOutOfRange, deviceType, id, measurement, formatBound(r.Min), formatBound(r.Max))
+}
+
+func (v *rangeValidator) rejectedCount() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.rejected
+}
@@ -0,0 +1,49 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+	"github.com/pojntfx/green-guardian-gateway/pkg/testutil"
+)
+
+func TestMeasurementRangesWithOneBound(t *testing.T) {
+	min, max := 10.0, 30.0
+
+	for _, test := range []struct {
+		name     string
+		r        services.MeasurementRange
+		rejected []int
+		accepted []int
+	}{
+		{"unbounded", services.MeasurementRange{}, nil, []int{-100, 0, 100}},
+		{"min", services.MeasurementRange{Min: &min}, []int{-100, 0, 9}, []int{10, 30, 100}},
+		{"max", services.MeasurementRange{Max: &max}, []int{31, 100}, []int{-100, 0, 30}},
+		{"both", services.MeasurementRange{Min: &min, Max: &max}, []int{0, 9, 31}, []int{10, 20, 30}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			gateway := openTestGateway(t, testutil.NewFakeBroker(), testutil.NewFakeHub().Remote(), &services.GatewayOptions{
+				MeasurementRanges: map[string]services.MeasurementRange{
+					services.DeviceTypeTemperature: test.r,
+				},
+			})
+
+			if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, measurement := range test.rejected {
+				if err := gateway.ForwardTemperatureMeasurement(getPeerContext(), "1", measurement, 20); !errors.Is(err, services.ErrMeasurementOutOfRange) {
+					t.Fatalf("expected %v for measurement %v, got %v", services.ErrMeasurementOutOfRange, measurement, err)
+				}
+			}
+
+			for _, measurement := range test.accepted {
+				if err := gateway.ForwardTemperatureMeasurement(getPeerContext(), "1", measurement, 20); err != nil {
+					t.Fatalf("expected measurement %v to be accepted, got %v", measurement, err)
+				}
+			}
+		})
+	}
+}
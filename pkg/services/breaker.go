@@ -0,0 +1,110 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit open, hub has failed repeatedly")
+)
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+}
+
+// circuitBreaker short-circuits calls to a peer after `threshold` consecutive failures. Once `cooldown` has
+// elapsed, a single call is let through to probe the peer; it closes the circuit if it succeeds and
+// re-opens it if it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	clock Clock
+
+	circuits map[string]*circuit
+
+	lock sync.Mutex
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, clock Clock) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = time.Second * 30
+	}
+
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+
+		clock: clock,
+
+		circuits: map[string]*circuit{},
+	}
+}
+
+// allow reports whether a call to `peerID` may be attempted. If it returns nil, the call's outcome must
+// be passed to `record` or `abort`.
+func (c *circuitBreaker) allow(peerID string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	circuit, ok := c.circuits[peerID]
+	if !ok || !circuit.open {
+		return nil
+	}
+
+	if circuit.probing || c.clock.Now().Sub(circuit.openedAt) < c.cooldown {
+		return ErrCircuitOpen
+	}
+
+	circuit.probing = true
+
+	return nil
+}
+
+func (c *circuitBreaker) record(peerID string, failed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !failed {
+		delete(c.circuits, peerID)
+
+		return
+	}
+
+	state, ok := c.circuits[peerID]
+	if !ok {
+		state = &circuit{}
+
+		c.circuits[peerID] = state
+	}
+
+	state.failures++
+
+	if state.probing || state.failures >= c.threshold {
+		state.open = true
+		state.openedAt = c.clock.Now()
+		state.probing = false
+	}
+}
+
+// abort releases a probe without an outcome, e.g. because the gateway is closing
+func (c *circuitBreaker) abort(peerID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if circuit, ok := c.circuits[peerID]; ok {
+		circuit.probing = false
+	}
+}
+
+func (c *circuitBreaker) remove(peerID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.circuits, peerID)
+}
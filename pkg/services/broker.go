@@ -0,0 +1,119 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	ErrMissingBrokerURL          = errors.New("missing broker URL")
+	ErrMissingClientID           = errors.New("missing client ID")
+	ErrCouldNotParseCA           = errors.New("could not parse CA certificate")
+	ErrIncompleteCertificatePair = errors.New("client certificate and key must both be provided")
+)
+
+// Broker is the subset of `mqtt.Client` that the gateway uses, so that other transports or test doubles can be injected instead
+type Broker interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Unsubscribe(topics ...string) mqtt.Token
+	IsConnected() bool
+}
+
+var _ Broker = mqtt.Client(nil)
+
+type BrokerConfig struct {
+	URL      string
+	ClientID string
+
+	// RandomClientIDSuffix appends a random suffix to the client ID so that gateways with the same thing name don't knock each other off the broker
+	RandomClientIDSuffix bool
+
+	CAPath   string
+	CertPath string
+	KeyPath  string
+
+	Username string
+	Password string
+}
+
+func getClientID(config *BrokerConfig) (string, error) {
+	if config.ClientID == "" {
+		return "", ErrMissingClientID
+	}
+
+	if !config.RandomClientIDSuffix {
+		return config.ClientID, nil
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return config.ClientID + "-" + hex.EncodeToString(suffix), nil
+}
+
+func newBrokerClientOptions(config *BrokerConfig) (*mqtt.ClientOptions, error) {
+	if config.URL == "" {
+		return nil, ErrMissingBrokerURL
+	}
+
+	clientID, err := getClientID(config)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.URL)
+	opts.SetClientID(clientID)
+
+	if config.Username != "" {
+		opts.SetUsername(config.Username)
+		opts.SetPassword(config.Password)
+	}
+
+	if config.CAPath == "" && config.CertPath == "" && config.KeyPath == "" {
+		return opts, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if config.CAPath != "" {
+		ca, err := os.ReadFile(config.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificate %v: %w", config.CAPath, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: %v", ErrCouldNotParseCA, config.CAPath)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertPath != "" || config.KeyPath != "" {
+		if config.CertPath == "" || config.KeyPath == "" {
+			return nil, ErrIncompleteCertificatePair
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.CertPath, config.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate %v: %w", config.CertPath, err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	opts.SetTLSConfig(tlsConfig)
+
+	return opts, nil
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type bufferedMeasurement struct {
+	topic   string
+	payload []byte
+	qos     byte
+
+	// expiresAt is the zero time if the measurement never expires
+	expiresAt time.Time
+}
+
+func (m bufferedMeasurement) expired(now time.Time) bool {
+	return !m.expiresAt.IsZero() && !now.Before(m.expiresAt)
+}
+
+type measurementBuffer struct {
+	entries []bufferedMeasurement
+	head    int
+	count   int
+
+	lock sync.Mutex
+}
+
+func newMeasurementBuffer(size int) *measurementBuffer {
+	return &measurementBuffer{
+		entries: make([]bufferedMeasurement, size),
+	}
+}
+
+func (b *measurementBuffer) push(measurement bufferedMeasurement) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.count == len(b.entries) {
+		// Drop the oldest entry if the buffer is full
+		b.head = (b.head + 1) % len(b.entries)
+		b.count--
+	}
+
+	b.entries[(b.head+b.count)%len(b.entries)] = measurement
+	b.count++
+}
+
+func (b *measurementBuffer) pushFront(measurement bufferedMeasurement) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.count == len(b.entries) {
+		// The buffered entries are newer than the one we are trying to re-queue, so we drop it
+		return
+	}
+
+	b.head = (b.head - 1 + len(b.entries)) % len(b.entries)
+	b.entries[b.head] = measurement
+	b.count++
+}
+
+func (b *measurementBuffer) pop() (bufferedMeasurement, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.count == 0 {
+		return bufferedMeasurement{}, false
+	}
+
+	measurement := b.entries[b.head]
+	b.entries[b.head] = bufferedMeasurement{}
+
+	b.head = (b.head + 1) % len(b.entries)
+	b.count--
+
+	return measurement, true
+}
+
+func (b *measurementBuffer) len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.count
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type cachedMeasurement struct {
+	measurement Measurement
+	timestamp   time.Time
+}
+
+type measurementCache struct {
+	entries map[string]cachedMeasurement
+	lock    sync.Mutex
+}
+
+func newMeasurementCache() *measurementCache {
+	return &measurementCache{
+		entries: map[string]cachedMeasurement{},
+	}
+}
+
+func (c *measurementCache) set(id string, measurement Measurement, timestamp time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[id] = cachedMeasurement{
+		measurement: measurement,
+		timestamp:   timestamp,
+	}
+}
+
+func (c *measurementCache) get(id string) (Measurement, time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[id]
+
+	return entry.measurement, entry.timestamp, ok
+}
+
+func (c *measurementCache) delete(ids []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, id := range ids {
+		delete(c.entries, id)
+	}
+}
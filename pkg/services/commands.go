@@ -0,0 +1,66 @@
+package services
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+var (
+	// ErrCommandQueueFull wraps `ErrHubCallQueueFull`, since commands are dropped for the same reason before they reach a worker
+	ErrCommandQueueFull = fmt.Errorf("%w: too many commands waiting for a worker", ErrHubCallQueueFull)
+)
+
+func (w *Gateway) startCommandWorkers() {
+	w.commandWorkersOnce.Do(func() {
+		for _, queue := range w.commandQueues {
+			go func(queue chan func()) {
+				for {
+					select {
+					case <-w.commandsStop:
+						return
+
+					case command := <-queue:
+						command()
+					}
+				}
+			}(queue)
+		}
+	})
+}
+
+// dispatchCommand queues `command` on a worker chosen by `topic`, so that commands for the
+// same device are always applied in the order in which they were received
+func (w *Gateway) dispatchCommand(deviceType, topic string, command func()) {
+	if !w.beginCallback() {
+		return
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(topic))
+
+	// This runs on the MQTT client's goroutine, so we drop commands instead of blocking it if the worker is overloaded
+	select {
+	case w.commandQueues[hash.Sum32()%uint32(len(w.commandQueues))] <- func() {
+		defer w.callbacksWg.Done()
+
+		command()
+	}:
+	default:
+		w.callbacksWg.Done()
+
+		w.droppedCommandsLock.Lock()
+		w.droppedCommands++
+		w.droppedCommandsLock.Unlock()
+
+		w.metrics.CommandDropped(deviceType)
+
+		w.reportError(fmt.Errorf("%w: topic=%v", ErrCommandQueueFull, topic))
+	}
+}
+
+func (w *Gateway) DroppedCommands() int {
+	w.droppedCommandsLock.Lock()
+	defer w.droppedCommandsLock.Unlock()
+
+	return w.droppedCommands
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrPayloadTooLarge = errors.New("decompressed payload exceeds maximum size")
+)
+
+const (
+	maxDecompressedPayloadSize = 1 << 20
+)
+
+// gzipMagic starts every gzip stream and can't start a JSON document, so it marks compressed payloads
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func compressPayload(payload []byte, threshold int) ([]byte, error) {
+	if threshold <= 0 || len(payload) <= threshold {
+		return payload, nil
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	// Payloads that don't shrink are sent as-is, so consumers don't have to decompress them
+	if buf.Len() >= len(payload) {
+		return payload, nil
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompressPayload(payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, gzipMagic) {
+		return payload, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxDecompressedPayloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxDecompressedPayloadSize {
+		return nil, fmt.Errorf("%w: limit=%v", ErrPayloadTooLarge, maxDecompressedPayloadSize)
+	}
+
+	return data, nil
+}
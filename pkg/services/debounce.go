@@ -0,0 +1,95 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type debouncedCommand struct {
+	apply func()
+	timer Timer
+}
+
+type debouncer struct {
+	interval time.Duration
+	clock    Clock
+
+	pending map[string]*debouncedCommand
+	closed  bool
+
+	lock sync.Mutex
+}
+
+func newDebouncer(interval time.Duration, clock Clock) *debouncer {
+	return &debouncer{
+		interval: interval,
+		clock:    clock,
+
+		pending: map[string]*debouncedCommand{},
+	}
+}
+
+// submit defers `apply` until the window for `key` ends. If a command is already pending for `key`,
+// it is replaced so that only the latest command within the window is applied.
+func (d *debouncer) submit(key string, apply func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	if command, ok := d.pending[key]; ok {
+		command.apply = apply
+
+		return
+	}
+
+	command := &debouncedCommand{
+		apply: apply,
+	}
+
+	command.timer = d.clock.AfterFunc(d.interval, func() {
+		d.lock.Lock()
+		if d.pending[key] != command {
+			// The command has been removed or the debouncer has been closed in the meantime
+			d.lock.Unlock()
+
+			return
+		}
+
+		delete(d.pending, key)
+		apply := command.apply
+		d.lock.Unlock()
+
+		apply()
+	})
+
+	d.pending[key] = command
+}
+
+func (d *debouncer) remove(keys []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, key := range keys {
+		if command, ok := d.pending[key]; ok {
+			command.timer.Stop()
+
+			delete(d.pending, key)
+		}
+	}
+}
+
+func (d *debouncer) close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.closed = true
+
+	for key, command := range d.pending {
+		command.timer.Stop()
+
+		delete(d.pending, key)
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type DedupConfig struct {
+	Enabled bool
+
+	MaxSkips    int
+	MaxInterval time.Duration
+}
+
+type dedupState struct {
+	measurement any
+	skips       int
+	forwardedAt time.Time
+}
+
+type deduplicator struct {
+	maxSkips    int
+	maxInterval time.Duration
+
+	states     map[string]*dedupState
+	suppressed int
+
+	lock sync.Mutex
+}
+
+func newDeduplicator(config DedupConfig) *deduplicator {
+	maxInterval := config.MaxInterval
+	if config.MaxSkips <= 0 && maxInterval <= 0 {
+		// Without any escape hatch, the hub would never hear about a constant measurement again
+		maxInterval = time.Minute
+	}
+
+	return &deduplicator{
+		maxSkips:    config.MaxSkips,
+		maxInterval: maxInterval,
+
+		states: map[string]*dedupState{},
+	}
+}
+
+func (d *deduplicator) skip(key string, measurement any, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	state, ok := d.states[key]
+	if !ok || state.measurement != measurement {
+		return false
+	}
+
+	if d.maxSkips > 0 && state.skips >= d.maxSkips {
+		return false
+	}
+
+	if d.maxInterval > 0 && now.Sub(state.forwardedAt) >= d.maxInterval {
+		return false
+	}
+
+	state.skips++
+	d.suppressed++
+
+	return true
+}
+
+func (d *deduplicator) record(key string, measurement any, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.states[key] = &dedupState{
+		measurement: measurement,
+		forwardedAt: now,
+	}
+}
+
+func (d *deduplicator) remove(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.states, key)
+}
+
+func (d *deduplicator) suppressedCount() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.suppressed
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type deferredCommand struct {
+	retry func()
+	timer Timer
+}
+
+type dwellState struct {
+	on        bool
+	changedAt time.Time
+
+	deferred *deferredCommand
+}
+
+// dwellEnforcer makes sure that actuators stay in a state for a minimum amount of time before they
+// are switched again, which protects e.g. compressors from rapid cycling
+type dwellEnforcer struct {
+	durations map[string]time.Duration
+	clock     Clock
+
+	states map[string]*dwellState
+	closed bool
+
+	lock sync.Mutex
+}
+
+func newDwellEnforcer(durations map[string]time.Duration, clock Clock) *dwellEnforcer {
+	rv := map[string]time.Duration{}
+	for deviceType, duration := range durations {
+		rv[deviceType] = duration
+	}
+
+	return &dwellEnforcer{
+		durations: rv,
+		clock:     clock,
+
+		states: map[string]*dwellState{},
+	}
+}
+
+func (d *dwellEnforcer) cancelDeferred(state *dwellState) {
+	if state.deferred != nil {
+		state.deferred.timer.Stop()
+
+		state.deferred = nil
+	}
+}
+
+// admit reports whether a command may be applied right now. If it may not, `retry` is called once
+// the minimum dwell time has elapsed; later commands replace it so that the latest state wins.
+func (d *dwellEnforcer) admit(deviceType, id string, on bool, retry func()) bool {
+	duration := d.durations[deviceType]
+	if duration <= 0 {
+		return true
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return false
+	}
+
+	state, ok := d.states[getMeasurementKey(deviceType, id)]
+	if !ok {
+		return true
+	}
+
+	remaining := duration - d.clock.Now().Sub(state.changedAt)
+	if state.on == on || remaining <= 0 {
+		// The latest command doesn't need to wait, so any deferred command is superseded
+		d.cancelDeferred(state)
+
+		return true
+	}
+
+	if state.deferred != nil {
+		state.deferred.retry = retry
+
+		return false
+	}
+
+	deferred := &deferredCommand{
+		retry: retry,
+	}
+
+	deferred.timer = d.clock.AfterFunc(remaining, func() {
+		d.lock.Lock()
+		if state.deferred != deferred {
+			d.lock.Unlock()
+
+			return
+		}
+
+		state.deferred = nil
+		retry := deferred.retry
+		d.lock.Unlock()
+
+		retry()
+	})
+
+	state.deferred = deferred
+
+	return false
+}
+
+// applied records that at least one hub has switched the actuator to `on`
+func (d *dwellEnforcer) applied(deviceType, id string, on bool) {
+	if d.durations[deviceType] <= 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key := getMeasurementKey(deviceType, id)
+
+	state, ok := d.states[key]
+	if !ok {
+		d.states[key] = &dwellState{
+			on:        on,
+			changedAt: d.clock.Now(),
+		}
+
+		return
+	}
+
+	if state.on != on {
+		state.on = on
+		state.changedAt = d.clock.Now()
+	}
+}
+
+func (d *dwellEnforcer) remove(deviceType string, ids []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, id := range ids {
+		key := getMeasurementKey(deviceType, id)
+
+		if state, ok := d.states[key]; ok {
+			d.cancelDeferred(state)
+
+			delete(d.states, key)
+		}
+	}
+}
+
+func (d *dwellEnforcer) close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.closed = true
+
+	for key, state := range d.states {
+		d.cancelDeferred(state)
+
+		delete(d.states, key)
+	}
+}
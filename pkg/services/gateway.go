@@ -2,263 +2,4053 @@ package services
 
 import (
 	"context"
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
 	"path"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/pojntfx/dudirekta/pkg/rpc"
 	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/topics"
 )
 
+var (
+	ErrInvalidQoS = errors.New("invalid QoS, must be 0, 1 or 2")
+
+	ErrInvalidID = errors.New("invalid ID, must be non-empty, must not be . or .. and must not contain MQTT wildcards or path separators")
+
+	ErrAlreadyOpen = errors.New("gateway is already open")
+	ErrNotOpen     = errors.New("gateway is not open")
+	ErrNoPeers     = errors.New("gateway has no peers configured")
+
+	ErrInvalidActuatorState = errors.New("invalid actuator state")
+
+	ErrMalformedTopic = errors.New("malformed topic")
+
+	ErrInvalidLeafTopic = errors.New("invalid leaf topic, must be a unique, valid topic level for a known device type")
+
+	ErrInvalidSharedSubscriptionGroup = errors.New("invalid shared subscription group, must not contain MQTT wildcards or path separators")
+
+	ErrDrainTimedOut = errors.New("timed out waiting for in-flight commands to finish")
+
+	ErrHubCallTimedOut = errors.New("timed out waiting for hub to respond")
+
+	ErrDeliveryTimedOut = errors.New("timed out waiting for broker to confirm delivery")
+
+	ErrPublishTimeout = errors.New("timed out waiting for broker to acknowledge publish")
+
+	ErrInvalidIDRange = errors.New("invalid ID range, start must not be negative or greater than end and the range must not exceed the maximum amount of IDs")
+
+	ErrInvalidIDPattern = errors.New("invalid ID pattern, must be a valid glob pattern")
+
+	ErrInvalidTopic = errors.New("invalid topic, must be below the gateway's topics, must not contain MQTT wildcards and must not be one of the gateway's own topics")
+
+	ErrRoomAlreadyRegistered  = errors.New("room already registered by another peer")
+	ErrPlantAlreadyRegistered = errors.New("plant already registered by another peer")
+
+	ErrNotRegisteredByPeer = errors.New("not registered by this peer")
+
+	ErrPeerGone = errors.New("peer that registered the device is no longer connected")
+
+	ErrRegistrationLimitExceeded = errors.New("registration limit for this peer exceeded")
+
+	ErrPaused = errors.New("gateway is paused")
+
+	ErrNoSuchZone = errors.New("no such zone")
+)
+
+type ErrorPolicy int
+
+const (
+	// ErrorPolicyFailFast makes `RunGateway` close the gateway and return the first error
+	ErrorPolicyFailFast ErrorPolicy = iota
+	// ErrorPolicyContinue makes `RunGateway` log errors and keep running until its context is cancelled
+	ErrorPolicyContinue
+)
+
+// LogLevelOff is above all log levels, so no messages are logged while it is set
+const LogLevelOff = slog.Level(math.MaxInt32)
+
+const (
+	floatMeasurementPrecision = 2
+
+	maxPatternIDs = 1024
+)
+
+type UnregisterError struct {
+	Skipped []string
+
+	idName string
+}
+
+func (e *UnregisterError) Error() string {
+	return fmt.Sprintf("%v: %vs=%v", ErrNotRegisteredByPeer, e.idName, strings.Join(e.Skipped, ","))
+}
+
+func (e *UnregisterError) Unwrap() error {
+	return ErrNotRegisteredByPeer
+}
+
+type MessageEvent struct {
+	Topic      string
+	Payload    []byte
+	DeviceType string
+	ID         string
+}
+
+type MeasurementEvent struct {
+	DeviceType   string
+	ID           string
+	Measurement  float64
+	DefaultValue float64
+	TakenAt      time.Time
+}
+
+type Measurement struct {
+	Measurement  int `json:"measurement"`
+	DefaultValue int `json:"default"`
+}
+
+type FanMeta struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+
+	// CalibrationOffset is added to the room's temperature measurements, in the gateway's temperature unit
+	CalibrationOffset float64 `json:"calibrationOffset"`
+}
+
+type SprinklerMeta struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+
+	// CalibrationOffset is added to the plant's moisture measurements
+	CalibrationOffset float64 `json:"calibrationOffset"`
+}
+
+type MeasurementFloat struct {
+	Measurement  float64 `json:"measurement"`
+	DefaultValue float64 `json:"default"`
+}
+
+type GatewayHealth struct {
+	BrokerConnected      bool `json:"brokerConnected"`
+	RegisteredFans       int  `json:"registeredFans"`
+	RegisteredSprinklers int  `json:"registeredSprinklers"`
+	Opened               bool `json:"opened"`
+}
+
 type GatewayRemote struct {
-	RegisterFans                  func(ctx context.Context, roomIDs []string) error
-	UnregisterFans                func(ctx context.Context, roomIDs []string) error
-	ForwardTemperatureMeasurement func(ctx context.Context, roomID string, measurement, defaultValue int) error
+	RegisterFans                   func(ctx context.Context, roomIDs []string) error
+	UnregisterFans                 func(ctx context.Context, roomIDs []string) error
+	ForwardTemperatureMeasurement  func(ctx context.Context, roomID string, measurement, defaultValue int) error
+	ForwardTemperatureMeasurements func(ctx context.Context, measurements map[string]Measurement) error
+
+	RegisterFansPattern    func(ctx context.Context, prefix string, from, to int) error
+	RegisterFansInZone     func(ctx context.Context, zoneID string, roomIDs []string) error
+	RegisterFansWithMeta   func(ctx context.Context, meta map[string]FanMeta) error
+	UnregisterFansMatching func(ctx context.Context, pattern string) (int, error)
+
+	ForwardTemperatureMeasurementFloat     func(ctx context.Context, roomID string, measurement, defaultValue float64) error
+	ForwardTemperatureMeasurementWithUnit  func(ctx context.Context, roomID string, measurement, defaultValue int, unit string) error
+	ForwardTemperatureMeasurementConfirmed func(ctx context.Context, roomID string, measurement, defaultValue int) error
+	ForwardTemperatureMeasurementAt        func(ctx context.Context, roomID string, measurement, defaultValue int, takenAt time.Time) error
+	ForwardTemperatureMeasurementTo        func(ctx context.Context, roomID string, targetTopic string, measurement, defaultValue int) error
+
+	RegisterSprinklers          func(ctx context.Context, plantIDs []string) error
+	UnregisterSprinklers        func(ctx context.Context, plantIDs []string) error
+	ForwardMoistureMeasurement  func(ctx context.Context, plantID string, measurement, defaultValue int) error
+	ForwardMoistureMeasurements func(ctx context.Context, measurements map[string]Measurement) error
+
+	RegisterSprinklersWithMeta func(ctx context.Context, meta map[string]SprinklerMeta) error
+
+	ForwardMoistureMeasurementAt func(ctx context.Context, plantID string, measurement, defaultValue int, takenAt time.Time) error
+
+	RegisterDehumidifiers       func(ctx context.Context, roomIDs []string) error
+	UnregisterDehumidifiers     func(ctx context.Context, roomIDs []string) error
+	ForwardHumidityMeasurement  func(ctx context.Context, roomID string, measurement, defaultValue int) error
+	ForwardHumidityMeasurements func(ctx context.Context, measurements map[string]Measurement) error
+
+	RegisterLamps            func(ctx context.Context, roomIDs []string) error
+	UnregisterLamps          func(ctx context.Context, roomIDs []string) error
+	ForwardLightMeasurement  func(ctx context.Context, roomID string, measurement, defaultValue int) error
+	ForwardLightMeasurements func(ctx context.Context, measurements map[string]Measurement) error
+
+	RegisterDosers        func(ctx context.Context, plantIDs []string) error
+	UnregisterDosers      func(ctx context.Context, plantIDs []string) error
+	ForwardPHMeasurement  func(ctx context.Context, plantID string, measurement, defaultValue int) error
+	ForwardPHMeasurements func(ctx context.Context, measurements map[string]Measurement) error
+
+	RegisterRoom   func(ctx context.Context, roomID string, capabilities []string) error
+	UnregisterRoom func(ctx context.Context, roomID string) error
+
+	UnregisterAllForPeer func(ctx context.Context) error
+}
+
+type Gateway struct {
+	log      *slog.Logger
+	logLevel *slog.LevelVar
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	errs       chan error
+	errsClosed bool
+	errsLock   sync.Mutex
+	onError    func(err error)
+
+	errorPolicy ErrorPolicy
+
+	debugMessages chan<- MessageEvent
+
+	measurementEvents chan<- MeasurementEvent
+
+	onForward func(deviceType, id string, measurement, defaultValue int)
+
+	droppedErrors     int
+	droppedErrorsLock sync.Mutex
+
+	broker        Broker
+	ownedBroker   mqtt.Client
+	publishStatus bool
+	thingName     string
+	topicPrefix   string
+	leafTopics    map[string]string
+
+	publishQoS,
+	subscribeQoS byte
+
+	qos map[string]QoSConfig
+
+	retained bool
+
+	allowRegistrationOverwrite bool
+	allowMultiplePeers         bool
+
+	rejectUnregistered bool
+
+	dropOrphaned        bool
+	reconcileOnPeerGone bool
+	reconciling         atomic.Bool
+
+	multiSegmentIDs bool
+
+	sharedSubscriptionGroup string
+
+	maxRegistrationsPerPeer int
+
+	dryRun bool
+
+	registrationEvents bool
+
+	commandAcks bool
+
+	shadow *shadow
+
+	pruneUnsupported bool
+
+	heartbeatInterval time.Duration
+
+	buffer        *measurementBuffer
+	flushInterval time.Duration
+	flushDelay    time.Duration
+	flushJitter   time.Duration
+
+	publishTimeout time.Duration
+
+	measurementBufferTTLs map[string]time.Duration
+	expiredMeasurements   int
+	expiredLock           sync.Mutex
+
+	metrics Metrics
+
+	clock Clock
+
+	codec Codec
+
+	publishHook func(topic string, payload []byte) ([]byte, error)
+
+	compressionThreshold int
+
+	temperatureUnit string
+
+	limiter   *rateLimiter
+	dedup     *deduplicator
+	batcher   *batcher
+	ranges    *rangeValidator
+	sequences *sequencer
+
+	disabledDeviceTypes     map[string]struct{}
+	disabledDeviceTypesLock sync.Mutex
+
+	paused            bool
+	pauseMeasurements bool
+	pausedLock        sync.Mutex
+
+	lastTemperatures *measurementCache
+	lastMoistures    *measurementCache
+	lastHumidities   *measurementCache
+	lastLights       *measurementCache
+	lastPHs          *measurementCache
+
+	staleTemperatureTimeout    time.Duration
+	staleTemperatureTimers     map[string]Timer
+	staleTemperatureTimersLock sync.Mutex
+
+	sprinklerDebouncer *debouncer
+
+	redeliveries *redeliveryFilter
+
+	dwell *dwellEnforcer
+
+	unknownCommandStrategy UnknownCommandStrategy
+	pendingCommands        *pendingCommands
+
+	workerWg sync.WaitGroup
+
+	opened        bool
+	closed        bool
+	openCtx       context.Context
+	lifecycleLock sync.Mutex
+
+	callbacksWg   sync.WaitGroup
+	callbacksLock sync.Mutex
+	closing       bool
+	drainTimeout  time.Duration
+
+	commandQueues       []chan func()
+	commandsStop        chan struct{}
+	commandWorkersOnce  sync.Once
+	droppedCommands     int
+	droppedCommandsLock sync.Mutex
+
+	hubCallTimeout time.Duration
+	hubCalls       *hubCallLimiter
+	breaker        *circuitBreaker
+
+	adminServer *http.Server
+
+	fans     map[string]map[string]struct{}
+	fanZones map[string]string
+	fanMeta  map[string]FanMeta
+	fansLock sync.Mutex
+
+	sprinklers     map[string]map[string]struct{}
+	sprinklerMeta  map[string]SprinklerMeta
+	sprinklersLock sync.Mutex
+
+	dehumidifiers     map[string]map[string]struct{}
+	dehumidifiersLock sync.Mutex
+
+	lamps     map[string]map[string]struct{}
+	lampsLock sync.Mutex
+
+	dosers     map[string]map[string]struct{}
+	dosersLock sync.Mutex
+
+	// Peers returns the connected hubs by peer ID. It is called once per callback, and the returned map must not be
+	// mutated afterwards, e.g. by returning a copy. If it is set, it takes precedence over the peers tracked via `TrackPeers`.
+	Peers func() map[string]HubRemote
+
+	trackPeers       bool
+	trackedPeers     map[string]HubRemote
+	trackedPeersLock sync.Mutex
+}
+
+type GatewayOptions struct {
+	TopicPrefix string
+
+	// LeafTopics maps device types to the last topic level of their measurements or commands,
+	// e.g. `temperature` to `temp_c`; device types that aren't set use their own name
+	LeafTopics map[string]string
+
+	PublishQoS   byte
+	SubscribeQoS byte
+
+	// QoS overrides PublishQoS and SubscribeQoS per device type. For sensors, the publish QoS applies to their measurements;
+	// for actuators, it applies to their states and acknowledgements, and the subscribe QoS applies to their commands.
+	QoS map[string]QoSConfig
+
+	RetainActuatorState bool
+
+	AllowRegistrationOverwrite bool
+	AllowMultiplePeers         bool
+
+	RejectUnregisteredMeasurements bool
+
+	// DropOrphanedMeasurements rejects measurements with `ErrPeerGone` instead of forwarding them if none of the peers that
+	// registered the room's or plant's actuator is still connected. ReconcileOnPeerGone additionally triggers `Reconcile` in the background.
+	DropOrphanedMeasurements bool
+	ReconcileOnPeerGone      bool
+
+	// TrackPeers makes the gateway track the connected hubs itself via `RegisterPeer` and `UnregisterPeer`
+	// instead of requiring `Peers` to be set
+	TrackPeers bool
+
+	// MultiSegmentIDs allows room, plant and zone IDs to span multiple topic levels (e.g. `building1/floor2/room3`)
+	MultiSegmentIDs bool
+
+	// SharedSubscriptionGroup makes the gateway subscribe to commands as part of this shared subscription group
+	// (`$share/<group>/...`), so that the broker delivers each command to only one of the gateway replicas in the group.
+	// Since the broker picks the replica, every replica in the group has to be able to apply every command.
+	SharedSubscriptionGroup string
+
+	MaxRegistrationsPerPeer int
+
+	DryRun bool
+
+	PublishRegistrationEvents bool
+
+	PublishCommandAcks bool
+
+	// PublishShadow publishes a retained document with the states of all actuators whenever one of them changes
+	PublishShadow bool
+
+	// PruneUnsupportedActuators unregisters all devices of a type that a hub has registered once it returns `ErrUnsupportedActuator` for one of them
+	PruneUnsupportedActuators bool
+
+	// HeartbeatInterval is the interval in which a heartbeat is published while the gateway is open, so that
+	// consumers can detect a gateway that has stopped working without disconnecting (0 disables heartbeats)
+	HeartbeatInterval time.Duration
+
+	MeasurementBufferSize    int
+	MeasurementFlushInterval time.Duration
+
+	// MeasurementFlushRate limits the amount of buffered measurements that are republished per second once the broker is reachable
+	// again (0 republishes them all at once), and MeasurementFlushJitter adds a random delay of up to this amount between them
+	MeasurementFlushRate   float64
+	MeasurementFlushJitter time.Duration
+
+	// MeasurementBufferTTLs maps measurement device types to the amount of time after which measurements in the gateway's
+	// local buffer are dropped instead of being flushed. Broker-side expiry isn't provided: the MQTT 3.1.1 client can't set
+	// the MQTT 5 message expiry interval, so measurements that the broker has already accepted are delivered regardless of their age.
+	MeasurementBufferTTLs map[string]time.Duration
+
+	Metrics Metrics
+
+	Clock Clock
+
+	Codec Codec
+
+	// PublishHook can rewrite every payload before it is published, e.g. to add site metadata; returning an error aborts the publish.
+	// The empty payloads that clear retained actuator states are published as-is.
+	PublishHook func(topic string, payload []byte) ([]byte, error)
+
+	// CompressionThreshold is the size in bytes above which payloads are gzip-compressed after the `PublishHook` has been applied
+	// (0 disables compression). Compressed payloads start with the gzip magic number `1f 8b`, and compressed commands are decompressed transparently.
+	CompressionThreshold int
+
+	TemperatureUnit string
+
+	Logger *slog.Logger
+
+	// LogLevel is the level of the default logger, which can be changed with `SetLogLevel`. To make a custom
+	// `Logger` adjustable, pass the same variable as its handler's level.
+	LogLevel *slog.LevelVar
+
+	DrainTimeout time.Duration
+
+	// PublishTimeout is the amount of time to wait for the broker to acknowledge a publish, e.g. of a measurement, actuator state or
+	// acknowledgement, so that a stalled broker can't block command handling or registration; defaults to 5 seconds
+	PublishTimeout time.Duration
+
+	HubCallTimeout time.Duration
+
+	MaxConcurrentHubCalls int
+	MaxWaitingHubCalls    int
+
+	// CircuitBreakerThreshold is the amount of consecutive failed calls after which calls to a hub are short-circuited
+	// for `CircuitBreakerCooldown` (0 disables this)
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+
+	// CommandQueueSize bounds the amount of commands waiting for each of the `CommandWorkers`; commands that don't fit are dropped,
+	// reported as `ErrCommandQueueFull` and counted by `Metrics.CommandDropped`, so that an overloaded worker can't block the MQTT client
+	CommandWorkers   int
+	CommandQueueSize int
+
+	StaleTemperatureTimeout time.Duration
+
+	SprinklerDebounceInterval time.Duration
+
+	// CommandRedeliveryTTL suppresses QoS 1 and 2 commands that the broker flags as duplicates of a command delivered within this window,
+	// so that hubs don't have to be idempotent. At most `CommandRedeliveryCacheSize` commands are remembered.
+	CommandRedeliveryTTL       time.Duration
+	CommandRedeliveryCacheSize int
+
+	// MinimumDwellTimes maps actuator device types to the minimum amount of time an actuator has to stay in a state before it may be switched again
+	MinimumDwellTimes map[string]time.Duration
+
+	// UnknownCommandStrategy selects how commands for rooms or plants that no hub has registered are handled; defaults to `UnknownCommandStrategyError`.
+	// With `UnknownCommandStrategyBuffer`, up to MaxPendingCommands (defaults to 100) commands are held for PendingCommandTTL (defaults to 10s).
+	UnknownCommandStrategy UnknownCommandStrategy
+	PendingCommandTTL      time.Duration
+	MaxPendingCommands     int
+
+	RateLimit      float64
+	RateLimitBurst int
+
+	Dedup DedupConfig
+
+	// Batch aggregates the measurements of each room and plant within a window into a single message if its window is set
+	Batch BatchConfig
+
+	MeasurementRanges map[string]MeasurementRange
+
+	PauseMeasurements bool
+
+	OnError func(err error)
+
+	ErrorPolicy ErrorPolicy
+
+	DebugMessages chan<- MessageEvent
+
+	MeasurementEvents chan<- MeasurementEvent
+
+	// OnForward is called synchronously once a measurement has been forwarded without error, but not if forwarding has failed; decimal
+	// measurements are rounded. If buffering, batching, deduplication or rate limiting is enabled, publishing may still be pending.
+	OnForward func(deviceType, id string, measurement, defaultValue int)
+
+	ErrorBufferSize int
+}
+
+func NewGateway(
+	verbose bool,
+	ctx context.Context,
+	broker Broker,
+	thingName string,
+	options *GatewayOptions,
+) (*Gateway, error) {
+	if options == nil {
+		options = &GatewayOptions{}
+	}
+
+	if options.PublishQoS > 2 || options.SubscribeQoS > 2 {
+		return nil, ErrInvalidQoS
+	}
+
+	qos, err := getQoSConfigs(options.QoS)
+	if err != nil {
+		return nil, err
+	}
+
+	temperatureUnit := options.TemperatureUnit
+	if temperatureUnit == "" {
+		temperatureUnit = mqttapi.UnitCelsius
+	}
+
+	if err := validateTemperatureUnit(temperatureUnit); err != nil {
+		return nil, err
+	}
+
+	leafTopics, err := newLeafTopics(options.LeafTopics)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ContainsAny(options.SharedSubscriptionGroup, "/"+topics.Wildcard+topics.MultiLevelWildcard) {
+		return nil, fmt.Errorf("%w: group=%q", ErrInvalidSharedSubscriptionGroup, options.SharedSubscriptionGroup)
+	}
+
+	var buffer *measurementBuffer
+	if options.MeasurementBufferSize > 0 {
+		buffer = newMeasurementBuffer(options.MeasurementBufferSize)
+	}
+
+	topicPrefix := options.TopicPrefix
+	if topicPrefix == "" {
+		topicPrefix = "/gateways"
+	}
+
+	flushInterval := options.MeasurementFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	var flushDelay time.Duration
+	if options.MeasurementFlushRate > 0 {
+		flushDelay = time.Duration(float64(time.Second) / options.MeasurementFlushRate)
+	}
+
+	logLevel := options.LogLevel
+	if logLevel == nil {
+		logLevel = &slog.LevelVar{}
+
+		if verbose {
+			logLevel.Set(slog.LevelDebug)
+		} else {
+			logLevel.Set(LogLevelOff)
+		}
+	}
+
+	logger := options.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: logLevel,
+		}))
+	}
+
+	var clock Clock = realClock{}
+	if options.Clock != nil {
+		clock = options.Clock
+	}
+
+	var limiter *rateLimiter
+	if options.RateLimit > 0 {
+		limiter = newRateLimiter(options.RateLimit, options.RateLimitBurst, logger, clock)
+	}
+
+	var sprinklerDebouncer *debouncer
+	if options.SprinklerDebounceInterval > 0 {
+		sprinklerDebouncer = newDebouncer(options.SprinklerDebounceInterval, clock)
+	}
+
+	var actuatorShadow *shadow
+	if options.PublishShadow {
+		actuatorShadow = newShadow()
+	}
+
+	var breaker *circuitBreaker
+	if options.CircuitBreakerThreshold > 0 {
+		breaker = newCircuitBreaker(options.CircuitBreakerThreshold, options.CircuitBreakerCooldown, clock)
+	}
+
+	var redeliveries *redeliveryFilter
+	if options.CommandRedeliveryTTL > 0 {
+		redeliveries = newRedeliveryFilter(options.CommandRedeliveryTTL, options.CommandRedeliveryCacheSize, clock)
+	}
+
+	var dedup *deduplicator
+	if options.Dedup.Enabled {
+		dedup = newDeduplicator(options.Dedup)
+	}
+
+	var batcher *batcher
+	if options.Batch.Window > 0 {
+		batcher, err = newBatcher(options.Batch, logger, clock)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	drainTimeout := options.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = time.Second * 10
+	}
+
+	publishTimeout := options.PublishTimeout
+	if publishTimeout <= 0 {
+		publishTimeout = time.Second * 5
+	}
+
+	hubCallTimeout := options.HubCallTimeout
+	if hubCallTimeout <= 0 {
+		hubCallTimeout = time.Second * 10
+	}
+
+	commandWorkers := options.CommandWorkers
+	if commandWorkers <= 0 {
+		commandWorkers = 4
+	}
+
+	commandQueueSize := options.CommandQueueSize
+	if commandQueueSize <= 0 {
+		commandQueueSize = 64
+	}
+
+	commandQueues := make([]chan func(), commandWorkers)
+	for i := range commandQueues {
+		commandQueues[i] = make(chan func(), commandQueueSize)
+	}
+
+	var pendingCommands *pendingCommands
+	switch options.UnknownCommandStrategy {
+	case UnknownCommandStrategyError, UnknownCommandStrategyIgnore:
+
+	case UnknownCommandStrategyBuffer:
+		pendingCommandTTL := options.PendingCommandTTL
+		if pendingCommandTTL <= 0 {
+			pendingCommandTTL = time.Second * 10
+		}
+
+		maxPendingCommands := options.MaxPendingCommands
+		if maxPendingCommands <= 0 {
+			maxPendingCommands = 100
+		}
+
+		pendingCommands = newPendingCommands(pendingCommandTTL, maxPendingCommands, clock)
+
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUnknownCommandStrategy, options.UnknownCommandStrategy)
+	}
+
+	errorBufferSize := options.ErrorBufferSize
+	if errorBufferSize <= 0 {
+		errorBufferSize = 16
+	}
+
+	var metrics Metrics = noopMetrics{}
+	if options.Metrics != nil {
+		metrics = options.Metrics
+	}
+
+	var codec Codec = JSONCodec{}
+	if options.Codec != nil {
+		codec = options.Codec
+	}
+
+	cancellableCtx, cancel := context.WithCancel(ctx)
+
+	return &Gateway{
+		log:      logger,
+		logLevel: logLevel,
+
+		ctx:    cancellableCtx,
+		cancel: cancel,
+
+		errs:    make(chan error, errorBufferSize),
+		onError: options.OnError,
+
+		errorPolicy: options.ErrorPolicy,
+
+		debugMessages: options.DebugMessages,
+
+		measurementEvents: options.MeasurementEvents,
+
+		onForward: options.OnForward,
+
+		fans:     map[string]map[string]struct{}{},
+		fanZones: map[string]string{},
+		fanMeta:  map[string]FanMeta{},
+
+		sprinklerMeta: map[string]SprinklerMeta{},
+
+		sprinklers: map[string]map[string]struct{}{},
+
+		dehumidifiers: map[string]map[string]struct{}{},
+
+		lamps: map[string]map[string]struct{}{},
+
+		dosers: map[string]map[string]struct{}{},
+
+		trackPeers:   options.TrackPeers,
+		trackedPeers: map[string]HubRemote{},
+
+		broker:      broker,
+		thingName:   thingName,
+		topicPrefix: topicPrefix,
+		leafTopics:  leafTopics,
+
+		publishQoS:   options.PublishQoS,
+		subscribeQoS: options.SubscribeQoS,
+		qos:          qos,
+
+		retained: options.RetainActuatorState,
+
+		allowRegistrationOverwrite: options.AllowRegistrationOverwrite,
+		allowMultiplePeers:         options.AllowMultiplePeers,
+
+		rejectUnregistered: options.RejectUnregisteredMeasurements,
+
+		dropOrphaned:        options.DropOrphanedMeasurements,
+		reconcileOnPeerGone: options.ReconcileOnPeerGone,
+
+		multiSegmentIDs: options.MultiSegmentIDs,
+
+		sharedSubscriptionGroup: options.SharedSubscriptionGroup,
+
+		maxRegistrationsPerPeer: options.MaxRegistrationsPerPeer,
+
+		dryRun: options.DryRun,
+
+		registrationEvents: options.PublishRegistrationEvents,
+
+		commandAcks: options.PublishCommandAcks,
+
+		shadow: actuatorShadow,
+
+		pruneUnsupported: options.PruneUnsupportedActuators,
+
+		heartbeatInterval: options.HeartbeatInterval,
+
+		buffer:        buffer,
+		flushInterval: flushInterval,
+		flushDelay:    flushDelay,
+		flushJitter:   options.MeasurementFlushJitter,
+
+		publishTimeout: publishTimeout,
+
+		measurementBufferTTLs: options.MeasurementBufferTTLs,
+
+		metrics: metrics,
+
+		clock: clock,
+
+		codec: codec,
+
+		publishHook: options.PublishHook,
+
+		compressionThreshold: options.CompressionThreshold,
+
+		temperatureUnit: temperatureUnit,
+
+		drainTimeout: drainTimeout,
+
+		hubCallTimeout: hubCallTimeout,
+		hubCalls:       newHubCallLimiter(options.MaxConcurrentHubCalls, options.MaxWaitingHubCalls),
+		breaker:        breaker,
+
+		commandQueues: commandQueues,
+		commandsStop:  make(chan struct{}),
+
+		limiter: limiter,
+		dedup:   dedup,
+		batcher: batcher,
+		ranges:  newRangeValidator(options.MeasurementRanges),
+
+		sequences: newSequencer(),
+
+		disabledDeviceTypes: map[string]struct{}{},
+
+		pauseMeasurements: options.PauseMeasurements,
+
+		lastTemperatures: newMeasurementCache(),
+		lastMoistures:    newMeasurementCache(),
+		lastHumidities:   newMeasurementCache(),
+		lastLights:       newMeasurementCache(),
+		lastPHs:          newMeasurementCache(),
+
+		staleTemperatureTimeout: options.StaleTemperatureTimeout,
+		staleTemperatureTimers:  map[string]Timer{},
+
+		sprinklerDebouncer: sprinklerDebouncer,
+
+		redeliveries: redeliveries,
+
+		dwell: newDwellEnforcer(options.MinimumDwellTimes, clock),
+
+		unknownCommandStrategy: options.UnknownCommandStrategy,
+		pendingCommands:        pendingCommands,
+	}, nil
+}
+
+func NewGatewayWithBroker(
+	verbose bool,
+	ctx context.Context,
+	config *BrokerConfig,
+	thingName string,
+	options *GatewayOptions,
+) (*Gateway, error) {
+	brokerConfig := *config
+	if brokerConfig.ClientID == "" {
+		brokerConfig.ClientID = thingName
+	}
+
+	opts, err := newBrokerClientOptions(&brokerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, err := NewGateway(verbose, ctx, nil, thingName, options)
+	if err != nil {
+		return nil, err
+	}
+
+	will, err := gateway.codec.Marshal(mqttapi.GatewayStatus{
+		Status:    mqttapi.GatewayStatusOffline,
+		Timestamp: gateway.clock.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	opts.SetBinaryWill(gateway.getStatusTopic(), will, gateway.publishQoS, true)
+	opts.SetOnConnectHandler(gateway.OnConnect)
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	gateway.broker = client
+	gateway.ownedBroker = client
+	gateway.publishStatus = true
+
+	return gateway, nil
+}
+
+func (w *Gateway) getStatusTopic() string {
+	return topics.Status(w.topicPrefix, w.thingName)
+}
+
+func (w *Gateway) getHeartbeatTopic() string {
+	return topics.Heartbeat(w.topicPrefix, w.thingName)
+}
+
+func (w *Gateway) getRegistrationEventsTopic() string {
+	return topics.RegistrationEvents(w.topicPrefix, w.thingName)
+}
+
+func (w *Gateway) getRegistrationsTopic() string {
+	return topics.Registrations(w.topicPrefix, w.thingName)
+}
+
+func (w *Gateway) getShadowTopic() string {
+	return topics.Shadow(w.topicPrefix, w.thingName)
+}
+
+func (w *Gateway) getFansTopic() string {
+	return topics.Room(w.topicPrefix, w.thingName, topics.Wildcard, w.leafTopics[DeviceTypeFan])
+}
+
+func (w *Gateway) getZoneFansTopic() string {
+	return topics.Zone(w.topicPrefix, w.thingName, topics.Wildcard, w.leafTopics[DeviceTypeFan])
+}
+
+func (w *Gateway) getSprinklersTopic() string {
+	return topics.Plant(w.topicPrefix, w.thingName, topics.Wildcard, w.leafTopics[DeviceTypeSprinkler])
+}
+
+func (w *Gateway) getDehumidifiersTopic() string {
+	return topics.Room(w.topicPrefix, w.thingName, topics.Wildcard, w.leafTopics[DeviceTypeDehumidifier])
+}
+
+func (w *Gateway) getLampsTopic() string {
+	return topics.Room(w.topicPrefix, w.thingName, topics.Wildcard, w.leafTopics[DeviceTypeLamp])
+}
+
+func (w *Gateway) getDosersTopic() string {
+	return topics.Plant(w.topicPrefix, w.thingName, topics.Wildcard, w.leafTopics[DeviceTypeDoser])
+}
+
+func (w *Gateway) getTemperatureTopic(roomID string) string {
+	return topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeTemperature])
+}
+
+func (w *Gateway) getMoistureTopic(plantID string) string {
+	return topics.Plant(w.topicPrefix, w.thingName, plantID, w.leafTopics[DeviceTypeMoisture])
+}
+
+func (w *Gateway) getHumidityTopic(roomID string) string {
+	return topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeHumidity])
+}
+
+func (w *Gateway) getLightTopic(roomID string) string {
+	return topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeLight])
+}
+
+func (w *Gateway) getPHTopic(plantID string) string {
+	return topics.Plant(w.topicPrefix, w.thingName, plantID, w.leafTopics[DeviceTypePH])
+}
+
+func (w *Gateway) getFanStateTopic(roomID string) string {
+	return topics.State(topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeFan]))
+}
+
+func (w *Gateway) getSprinklerStateTopic(plantID string) string {
+	return topics.State(topics.Plant(w.topicPrefix, w.thingName, plantID, w.leafTopics[DeviceTypeSprinkler]))
+}
+
+func (w *Gateway) getDehumidifierStateTopic(roomID string) string {
+	return topics.State(topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeDehumidifier]))
+}
+
+func (w *Gateway) getLampStateTopic(roomID string) string {
+	return topics.State(topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeLamp]))
+}
+
+func (w *Gateway) getDoserStateTopic(plantID string) string {
+	return topics.State(topics.Plant(w.topicPrefix, w.thingName, plantID, w.leafTopics[DeviceTypeDoser]))
+}
+
+func (w *Gateway) getFanAckTopic(roomID string) string {
+	return topics.Ack(topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeFan]))
+}
+
+func (w *Gateway) getSprinklerAckTopic(plantID string) string {
+	return topics.Ack(topics.Plant(w.topicPrefix, w.thingName, plantID, w.leafTopics[DeviceTypeSprinkler]))
+}
+
+func (w *Gateway) getDehumidifierAckTopic(roomID string) string {
+	return topics.Ack(topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeDehumidifier]))
+}
+
+func (w *Gateway) getLampAckTopic(roomID string) string {
+	return topics.Ack(topics.Room(w.topicPrefix, w.thingName, roomID, w.leafTopics[DeviceTypeLamp]))
+}
+
+func (w *Gateway) getDoserAckTopic(plantID string) string {
+	return topics.Ack(topics.Plant(w.topicPrefix, w.thingName, plantID, w.leafTopics[DeviceTypeDoser]))
+}
+
+// newLeafTopics fills in the default leaf topics. Leaves must be unique so that measurements and commands
+// can't be mistaken for each other, and must not be `state` or `ack`, which are used below commands.
+func newLeafTopics(overrides map[string]string) (map[string]string, error) {
+	leafTopics := map[string]string{}
+	for _, deviceType := range []string{
+		DeviceTypeTemperature,
+		DeviceTypeMoisture,
+		DeviceTypeHumidity,
+		DeviceTypeLight,
+		DeviceTypePH,
+		DeviceTypeFan,
+		DeviceTypeSprinkler,
+		DeviceTypeDehumidifier,
+		DeviceTypeLamp,
+		DeviceTypeDoser,
+	} {
+		leafTopics[deviceType] = deviceType
+	}
+
+	for deviceType, leaf := range overrides {
+		if _, ok := leafTopics[deviceType]; !ok {
+			return nil, fmt.Errorf("%w: deviceType=%v", ErrInvalidLeafTopic, deviceType)
+		}
+
+		if err := validateSegmentID(leaf); err != nil || leaf == "." || leaf == ".." || leaf == "state" || leaf == "ack" {
+			return nil, fmt.Errorf("%w: deviceType=%v leaf=%q", ErrInvalidLeafTopic, deviceType, leaf)
+		}
+
+		leafTopics[deviceType] = leaf
+	}
+
+	seen := map[string]string{}
+	for deviceType, leaf := range leafTopics {
+		if other, ok := seen[leaf]; ok {
+			return nil, fmt.Errorf("%w: deviceTypes=%v,%v leaf=%q", ErrInvalidLeafTopic, other, deviceType, leaf)
+		}
+
+		seen[leaf] = deviceType
+	}
+
+	return leafTopics, nil
+}
+
+// validateSegmentID rejects relative IDs too, since topics are joined with `path.Join`, which would collapse them into a different topic
+func validateSegmentID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/+#\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+
+	return nil
+}
+
+// validateMultiSegmentID validates each segment of `id` like a single-segment ID
+func validateMultiSegmentID(id string) error {
+	for _, segment := range strings.Split(id, "/") {
+		if err := validateSegmentID(segment); err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidID, id)
+		}
+	}
+
+	return nil
+}
+
+func (w *Gateway) validateID(id string) error {
+	if w.multiSegmentIDs {
+		return validateMultiSegmentID(id)
+	}
+
+	return validateSegmentID(id)
+}
+
+func (w *Gateway) validateIDs(ids []string) error {
+	for _, id := range ids {
+		if err := w.validateID(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRegistrationLimitLocked returns an error if registering `ids` would exceed the registration limit of `peerID`;
+// the caller must hold the lock of `devices`
+func (w *Gateway) checkRegistrationLimitLocked(devices map[string]map[string]struct{}, ids []string, peerID string) error {
+	if w.maxRegistrationsPerPeer <= 0 {
+		return nil
+	}
+
+	registered := 0
+	for _, candidates := range devices {
+		if _, ok := candidates[peerID]; ok {
+			registered++
+		}
+	}
+
+	added := map[string]struct{}{}
+	for _, id := range ids {
+		if _, ok := devices[id][peerID]; !ok {
+			added[id] = struct{}{}
+		}
+	}
+
+	if registered+len(added) > w.maxRegistrationsPerPeer {
+		return fmt.Errorf("%w: peerID=%v registered=%v requested=%v limit=%v", ErrRegistrationLimitExceeded, peerID, registered, len(added), w.maxRegistrationsPerPeer)
+	}
+
+	return nil
+}
+
+func (w *Gateway) registerDevices(deviceType string, lock *sync.Mutex, devices map[string]map[string]struct{}, ids []string, peerID string, errAlreadyRegistered error, idName string) error {
+	if err := w.validateIDs(ids); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	if !w.allowRegistrationOverwrite && !w.allowMultiplePeers {
+		for _, id := range ids {
+			if candidates, ok := devices[id]; ok {
+				if _, ok := candidates[peerID]; !ok {
+					lock.Unlock()
+
+					return fmt.Errorf("%w: %v=%v", errAlreadyRegistered, idName, id)
+				}
+			}
+		}
+	}
+
+	if err := w.checkRegistrationLimitLocked(devices, ids, peerID); err != nil {
+		lock.Unlock()
+
+		return err
+	}
+
+	for _, id := range ids {
+		if _, ok := devices[id]; !ok || !w.allowMultiplePeers {
+			devices[id] = map[string]struct{}{}
+		}
+
+		devices[id][peerID] = struct{}{}
+	}
+	w.metrics.RegisteredDevices(deviceType, len(devices))
+	lock.Unlock()
+
+	if w.pendingCommands != nil {
+		for _, retry := range w.pendingCommands.take(deviceType, ids) {
+			retry()
+		}
+	}
+
+	return w.publishRegistrationEvent(mqttapi.RegistrationActionRegister, deviceType, ids, peerID)
+}
+
+func removePeer(devices map[string]map[string]struct{}, id, peerID string) (unregistered bool, removed bool) {
+	candidates, ok := devices[id]
+	if !ok {
+		return false, false
+	}
+
+	if _, ok := candidates[peerID]; !ok {
+		return false, false
+	}
+
+	delete(candidates, peerID)
+
+	// The device is only gone once the last peer serving it has unregistered
+	if len(candidates) > 0 {
+		return true, false
+	}
+
+	delete(devices, id)
+
+	return true, true
+}
+
+func (w *Gateway) unregisterDevices(deviceType string, lock *sync.Mutex, devices map[string]map[string]struct{}, ids []string, peerID string, idName string, getStateTopic func(id string) string) error {
+	lock.Lock()
+	unregistered := []string{}
+	removed := []string{}
+	skipped := []string{}
+	for _, id := range ids {
+		// Hubs may only unregister the devices that they have registered themselves
+		ok, gone := removePeer(devices, id, peerID)
+		if !ok {
+			skipped = append(skipped, id)
+
+			continue
+		}
+
+		unregistered = append(unregistered, id)
+
+		if gone {
+			removed = append(removed, id)
+		}
+	}
+	w.metrics.RegisteredDevices(deviceType, len(devices))
+	lock.Unlock()
+
+	if err := w.finishUnregistration(deviceType, unregistered, removed, peerID, getStateTopic); err != nil {
+		return err
+	}
+
+	if len(skipped) > 0 {
+		return &UnregisterError{
+			Skipped: skipped,
+
+			idName: idName,
+		}
+	}
+
+	return nil
+}
+
+// unregisterDevicesMatching unregisters all of the devices of `peerID` whose IDs match the glob `pattern`
+// and returns the amount of unregistered devices
+func (w *Gateway) unregisterDevicesMatching(deviceType string, lock *sync.Mutex, devices map[string]map[string]struct{}, pattern string, peerID string, getStateTopic func(id string) string) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, fmt.Errorf("%w: pattern=%v", ErrInvalidIDPattern, pattern)
+	}
+
+	lock.Lock()
+	ids := []string{}
+	for id, candidates := range devices {
+		// Hubs may only unregister the devices that they have registered themselves
+		if _, ok := candidates[peerID]; !ok {
+			continue
+		}
+
+		if matched, _ := path.Match(pattern, id); matched {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	removed := []string{}
+	for _, id := range ids {
+		if _, gone := removePeer(devices, id, peerID); gone {
+			removed = append(removed, id)
+		}
+	}
+	w.metrics.RegisteredDevices(deviceType, len(devices))
+	lock.Unlock()
+
+	if err := w.finishUnregistration(deviceType, ids, removed, peerID, getStateTopic); err != nil {
+		return len(ids), err
+	}
+
+	return len(ids), nil
+}
+
+func (w *Gateway) RegisterFans(ctx context.Context, roomIDs []string) error {
+	w.log.Debug("RegisterFans", "roomIDs", roomIDs, "peerID", getPeerID(ctx))
+
+	return w.registerDevices(DeviceTypeFan, &w.fansLock, w.fans, roomIDs, getPeerID(ctx), ErrRoomAlreadyRegistered, "roomID")
+}
+
+func expandIDPattern(prefix string, from, to int) ([]string, error) {
+	if from < 0 || from > to || to-from >= maxPatternIDs {
+		return nil, fmt.Errorf("%w: from=%v to=%v", ErrInvalidIDRange, from, to)
+	}
+
+	ids := []string{}
+	for i := from; i <= to; i++ {
+		ids = append(ids, fmt.Sprintf("%v%v", prefix, i))
+	}
+
+	return ids, nil
+}
+
+func (w *Gateway) RegisterFansPattern(ctx context.Context, prefix string, from, to int) error {
+	w.log.Debug("RegisterFansPattern", "prefix", prefix, "from", from, "to", to, "peerID", getPeerID(ctx))
+
+	roomIDs, err := expandIDPattern(prefix, from, to)
+	if err != nil {
+		return err
+	}
+
+	return w.registerDevices(DeviceTypeFan, &w.fansLock, w.fans, roomIDs, getPeerID(ctx), ErrRoomAlreadyRegistered, "roomID")
+}
+
+// RegisterFansInZone registers the fans and assigns their rooms to `zoneID`, so that they can be commanded all at once
+func (w *Gateway) RegisterFansInZone(ctx context.Context, zoneID string, roomIDs []string) error {
+	w.log.Debug("RegisterFansInZone", "zoneID", zoneID, "roomIDs", roomIDs, "peerID", getPeerID(ctx))
+
+	if err := w.validateID(zoneID); err != nil {
+		return err
+	}
+
+	if err := w.registerDevices(DeviceTypeFan, &w.fansLock, w.fans, roomIDs, getPeerID(ctx), ErrRoomAlreadyRegistered, "roomID"); err != nil {
+		return err
+	}
+
+	w.fansLock.Lock()
+	defer w.fansLock.Unlock()
+
+	for _, roomID := range roomIDs {
+		w.fanZones[roomID] = zoneID
+	}
+
+	return nil
+}
+
+// RegisterFansWithMeta registers the fans of the rooms in `meta` and stores their metadata, replacing
+// any metadata that was stored for them before
+func (w *Gateway) RegisterFansWithMeta(ctx context.Context, meta map[string]FanMeta) error {
+	w.log.Debug("RegisterFansWithMeta", "meta", meta, "peerID", getPeerID(ctx))
+
+	roomIDs := []string{}
+	for roomID := range meta {
+		roomIDs = append(roomIDs, roomID)
+	}
+
+	sort.Strings(roomIDs)
+
+	if err := w.registerDevices(DeviceTypeFan, &w.fansLock, w.fans, roomIDs, getPeerID(ctx), ErrRoomAlreadyRegistered, "roomID"); err != nil {
+		return err
+	}
+
+	w.fansLock.Lock()
+	defer w.fansLock.Unlock()
+
+	for roomID, roomMeta := range meta {
+		w.fanMeta[roomID] = roomMeta
+	}
+
+	return nil
+}
+
+func (w *Gateway) ListFanMeta() map[string]FanMeta {
+	w.fansLock.Lock()
+	defer w.fansLock.Unlock()
+
+	meta := map[string]FanMeta{}
+	for roomID, roomMeta := range w.fanMeta {
+		meta[roomID] = roomMeta
+	}
+
+	return meta
+}
+
+func (w *Gateway) getFanCalibrationOffset(roomID string) float64 {
+	w.fansLock.Lock()
+	defer w.fansLock.Unlock()
+
+	return w.fanMeta[roomID].CalibrationOffset
+}
+
+func (w *Gateway) getZoneRoomIDs(zoneID string) []string {
+	w.fansLock.Lock()
+	defer w.fansLock.Unlock()
+
+	roomIDs := []string{}
+	for roomID, candidate := range w.fanZones {
+		if candidate == zoneID {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+
+	sort.Strings(roomIDs)
+
+	return roomIDs
+}
+
+func (w *Gateway) UnregisterFans(ctx context.Context, roomIDs []string) error {
+	w.log.Debug("UnregisterFans", "roomIDs", roomIDs, "peerID", getPeerID(ctx))
+
+	return w.unregisterDevices(DeviceTypeFan, &w.fansLock, w.fans, roomIDs, getPeerID(ctx), "roomID", w.getFanStateTopic)
+}
+
+// UnregisterFansMatching unregisters all of the calling peer's fans whose room IDs match the glob `pattern`
+// and returns the amount of unregistered fans. As with `path.Match`, `*` doesn't match across the segments of multi-segment IDs.
+func (w *Gateway) UnregisterFansMatching(ctx context.Context, pattern string) (int, error) {
+	w.log.Debug("UnregisterFansMatching", "pattern", pattern, "peerID", getPeerID(ctx))
+
+	return w.unregisterDevicesMatching(DeviceTypeFan, &w.fansLock, w.fans, pattern, getPeerID(ctx), w.getFanStateTopic)
+}
+
+func (w *Gateway) RegisterSprinklers(ctx context.Context, plantIDs []string) error {
+	w.log.Debug("RegisterSprinklers", "plantIDs", plantIDs, "peerID", getPeerID(ctx))
+
+	return w.registerDevices(DeviceTypeSprinkler, &w.sprinklersLock, w.sprinklers, plantIDs, getPeerID(ctx), ErrPlantAlreadyRegistered, "plantID")
+}
+
+// RegisterSprinklersWithMeta registers the sprinklers of the plants in `meta` and stores their metadata; see `RegisterFansWithMeta`.
+func (w *Gateway) RegisterSprinklersWithMeta(ctx context.Context, meta map[string]SprinklerMeta) error {
+	w.log.Debug("RegisterSprinklersWithMeta", "meta", meta, "peerID", getPeerID(ctx))
+
+	plantIDs := []string{}
+	for plantID := range meta {
+		plantIDs = append(plantIDs, plantID)
+	}
+
+	sort.Strings(plantIDs)
+
+	if err := w.registerDevices(DeviceTypeSprinkler, &w.sprinklersLock, w.sprinklers, plantIDs, getPeerID(ctx), ErrPlantAlreadyRegistered, "plantID"); err != nil {
+		return err
+	}
+
+	w.sprinklersLock.Lock()
+	defer w.sprinklersLock.Unlock()
+
+	for plantID, plantMeta := range meta {
+		w.sprinklerMeta[plantID] = plantMeta
+	}
+
+	return nil
+}
+
+func (w *Gateway) ListSprinklerMeta() map[string]SprinklerMeta {
+	w.sprinklersLock.Lock()
+	defer w.sprinklersLock.Unlock()
+
+	meta := map[string]SprinklerMeta{}
+	for plantID, plantMeta := range w.sprinklerMeta {
+		meta[plantID] = plantMeta
+	}
+
+	return meta
+}
+
+func (w *Gateway) getSprinklerCalibrationOffset(plantID string) float64 {
+	w.sprinklersLock.Lock()
+	defer w.sprinklersLock.Unlock()
+
+	return w.sprinklerMeta[plantID].CalibrationOffset
+}
+
+func (w *Gateway) UnregisterSprinklers(ctx context.Context, plantIDs []string) error {
+	w.log.Debug("UnregisterSprinklers", "plantIDs", plantIDs, "peerID", getPeerID(ctx))
+
+	return w.unregisterDevices(DeviceTypeSprinkler, &w.sprinklersLock, w.sprinklers, plantIDs, getPeerID(ctx), "plantID", w.getSprinklerStateTopic)
+}
+
+func (w *Gateway) RegisterDehumidifiers(ctx context.Context, roomIDs []string) error {
+	w.log.Debug("RegisterDehumidifiers", "roomIDs", roomIDs, "peerID", getPeerID(ctx))
+
+	return w.registerDevices(DeviceTypeDehumidifier, &w.dehumidifiersLock, w.dehumidifiers, roomIDs, getPeerID(ctx), ErrRoomAlreadyRegistered, "roomID")
+}
+
+func (w *Gateway) UnregisterDehumidifiers(ctx context.Context, roomIDs []string) error {
+	w.log.Debug("UnregisterDehumidifiers", "roomIDs", roomIDs, "peerID", getPeerID(ctx))
+
+	return w.unregisterDevices(DeviceTypeDehumidifier, &w.dehumidifiersLock, w.dehumidifiers, roomIDs, getPeerID(ctx), "roomID", w.getDehumidifierStateTopic)
+}
+
+func (w *Gateway) RegisterLamps(ctx context.Context, roomIDs []string) error {
+	w.log.Debug("RegisterLamps", "roomIDs", roomIDs, "peerID", getPeerID(ctx))
+
+	return w.registerDevices(DeviceTypeLamp, &w.lampsLock, w.lamps, roomIDs, getPeerID(ctx), ErrRoomAlreadyRegistered, "roomID")
+}
+
+func (w *Gateway) RegisterDosers(ctx context.Context, plantIDs []string) error {
+	w.log.Debug("RegisterDosers", "plantIDs", plantIDs, "peerID", getPeerID(ctx))
+
+	return w.registerDevices(DeviceTypeDoser, &w.dosersLock, w.dosers, plantIDs, getPeerID(ctx), ErrPlantAlreadyRegistered, "plantID")
+}
+
+func (w *Gateway) UnregisterLamps(ctx context.Context, roomIDs []string) error {
+	w.log.Debug("UnregisterLamps", "roomIDs", roomIDs, "peerID", getPeerID(ctx))
+
+	return w.unregisterDevices(DeviceTypeLamp, &w.lampsLock, w.lamps, roomIDs, getPeerID(ctx), "roomID", w.getLampStateTopic)
+}
+
+func (w *Gateway) UnregisterDosers(ctx context.Context, plantIDs []string) error {
+	w.log.Debug("UnregisterDosers", "plantIDs", plantIDs, "peerID", getPeerID(ctx))
+
+	return w.unregisterDevices(DeviceTypeDoser, &w.dosersLock, w.dosers, plantIDs, getPeerID(ctx), "plantID", w.getDoserStateTopic)
+}
+
+func (w *Gateway) finishUnregistration(deviceType string, unregistered, removed []string, peerID string, getStateTopic func(id string) string) error {
+	w.cleanupDevices(deviceType, removed)
+
+	if err := w.clearStates(deviceType, removed, getStateTopic); err != nil {
+		return err
+	}
+
+	if err := w.removeShadowStates(deviceType, removed); err != nil {
+		return err
+	}
+
+	return w.publishRegistrationEvent(mqttapi.RegistrationActionUnregister, deviceType, unregistered, peerID)
+}
+
+func (w *Gateway) cleanupDevices(deviceType string, ids []string) {
+	measurementType := ""
+	switch deviceType {
+	case DeviceTypeFan:
+		measurementType = DeviceTypeTemperature
+
+		w.lastTemperatures.delete(ids)
+
+		gone := []string{}
+		w.fansLock.Lock()
+		for _, id := range ids {
+			// The room might have been registered again in the meantime
+			if _, ok := w.fans[id]; !ok {
+				delete(w.fanZones, id)
+				delete(w.fanMeta, id)
+
+				gone = append(gone, id)
+			}
+		}
+		w.fansLock.Unlock()
+
+		for _, id := range gone {
+			w.stopStaleTemperatureTimer(id)
+		}
+
+	case DeviceTypeSprinkler:
+		measurementType = DeviceTypeMoisture
+
+		w.lastMoistures.delete(ids)
+
+		w.sprinklersLock.Lock()
+		for _, id := range ids {
+			if _, ok := w.sprinklers[id]; !ok {
+				delete(w.sprinklerMeta, id)
+			}
+		}
+		w.sprinklersLock.Unlock()
+
+		if w.sprinklerDebouncer != nil {
+			w.sprinklerDebouncer.remove(ids)
+		}
+
+	case DeviceTypeDehumidifier:
+		measurementType = DeviceTypeHumidity
+
+		w.lastHumidities.delete(ids)
+
+	case DeviceTypeLamp:
+		measurementType = DeviceTypeLight
+
+		w.lastLights.delete(ids)
+
+	case DeviceTypeDoser:
+		measurementType = DeviceTypePH
+
+		w.lastPHs.delete(ids)
+	}
+
+	w.dwell.remove(deviceType, ids)
+
+	for _, id := range ids {
+		key := getMeasurementKey(measurementType, id)
+
+		if w.limiter != nil {
+			w.limiter.remove(key)
+		}
+
+		if w.dedup != nil {
+			w.dedup.remove(key)
+		}
+
+		if w.batcher != nil {
+			w.batcher.remove(key)
+		}
+
+		w.sequences.remove(key)
+	}
+}
+
+func isRegistered(lock *sync.Mutex, devices map[string]map[string]struct{}, id string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, ok := devices[id]
+
+	return ok
+}
+
+// checkRegistered catches measurements for rooms or plants that no hub has registered, e.g. due to typos in their IDs
+func (w *Gateway) checkRegistered(lock *sync.Mutex, devices map[string]map[string]struct{}, id string, errNoSuchDevice error, idName string) error {
+	if w.rejectUnregistered && !isRegistered(lock, devices, id) {
+		return fmt.Errorf("%w: %v=%v", errNoSuchDevice, idName, id)
+	}
+
+	if w.dropOrphaned && w.hasPeers() {
+		lock.Lock()
+		peerIDs := []string{}
+		for peerID := range devices[id] {
+			peerIDs = append(peerIDs, peerID)
+		}
+		lock.Unlock()
+
+		// Unregistered devices are handled by `rejectUnregistered` above
+		if len(peerIDs) == 0 {
+			return nil
+		}
+
+		peers := w.getPeers()
+		for _, peerID := range peerIDs {
+			if _, ok := peers[peerID]; ok {
+				return nil
+			}
+		}
+
+		if w.reconcileOnPeerGone {
+			w.reconcileInBackground()
+		}
+
+		return fmt.Errorf("%w: %v=%v peerIDs=%v", ErrPeerGone, idName, id, peerIDs)
+	}
+
+	return nil
+}
+
+// reconcileInBackground runs `Reconcile` unless it is already running
+func (w *Gateway) reconcileInBackground() {
+	if !w.reconciling.CompareAndSwap(false, true) {
+		return
+	}
+
+	if !w.beginCallback() {
+		w.reconciling.Store(false)
+
+		return
+	}
+
+	go func() {
+		defer w.callbacksWg.Done()
+		defer w.reconciling.Store(false)
+
+		if _, err := w.Reconcile(); err != nil {
+			w.reportError(err)
+		}
+	}()
+}
+
+func removePeerDevices(devices map[string]map[string]struct{}, peerID string) (unregistered []string, removed []string) {
+	unregistered = []string{}
+	removed = []string{}
+	for id := range devices {
+		ok, gone := removePeer(devices, id, peerID)
+		if !ok {
+			continue
+		}
+
+		unregistered = append(unregistered, id)
+
+		if gone {
+			removed = append(removed, id)
+		}
+	}
+
+	return unregistered, removed
+}
+
+func (w *Gateway) UnregisterAllForPeer(ctx context.Context) error {
+	peerID := getPeerID(ctx)
+
+	w.log.Debug("UnregisterAllForPeer", "peerID", peerID)
+
+	w.fansLock.Lock()
+	w.sprinklersLock.Lock()
+	w.dehumidifiersLock.Lock()
+	w.lampsLock.Lock()
+	w.dosersLock.Lock()
+
+	roomIDs, removedRoomIDs := removePeerDevices(w.fans, peerID)
+	plantIDs, removedPlantIDs := removePeerDevices(w.sprinklers, peerID)
+	dehumidifierRoomIDs, removedDehumidifierRoomIDs := removePeerDevices(w.dehumidifiers, peerID)
+	lampRoomIDs, removedLampRoomIDs := removePeerDevices(w.lamps, peerID)
+	doserPlantIDs, removedDoserPlantIDs := removePeerDevices(w.dosers, peerID)
+
+	w.metrics.RegisteredDevices(DeviceTypeFan, len(w.fans))
+	w.metrics.RegisteredDevices(DeviceTypeSprinkler, len(w.sprinklers))
+	w.metrics.RegisteredDevices(DeviceTypeDehumidifier, len(w.dehumidifiers))
+	w.metrics.RegisteredDevices(DeviceTypeLamp, len(w.lamps))
+	w.metrics.RegisteredDevices(DeviceTypeDoser, len(w.dosers))
+
+	w.dosersLock.Unlock()
+	w.lampsLock.Unlock()
+	w.dehumidifiersLock.Unlock()
+	w.sprinklersLock.Unlock()
+	w.fansLock.Unlock()
+
+	w.forgetPeer(peerID)
+
+	if err := w.finishUnregistration(DeviceTypeFan, roomIDs, removedRoomIDs, peerID, w.getFanStateTopic); err != nil {
+		return err
+	}
+
+	if err := w.finishUnregistration(DeviceTypeSprinkler, plantIDs, removedPlantIDs, peerID, w.getSprinklerStateTopic); err != nil {
+		return err
+	}
+
+	if err := w.finishUnregistration(DeviceTypeDehumidifier, dehumidifierRoomIDs, removedDehumidifierRoomIDs, peerID, w.getDehumidifierStateTopic); err != nil {
+		return err
+	}
+
+	if err := w.finishUnregistration(DeviceTypeLamp, lampRoomIDs, removedLampRoomIDs, peerID, w.getLampStateTopic); err != nil {
+		return err
+	}
+
+	return w.finishUnregistration(DeviceTypeDoser, doserPlantIDs, removedDoserPlantIDs, peerID, w.getDoserStateTopic)
+}
+
+// forgetPeer drops the per-peer state of `peerID`, so that a peer that reconnects with the same ID starts afresh
+func (w *Gateway) forgetPeer(peerID string) {
+	if w.breaker != nil {
+		w.breaker.remove(peerID)
+	}
+}
+
+func clearDevices(devices map[string]map[string]struct{}) []string {
+	ids := []string{}
+	for id := range devices {
+		ids = append(ids, id)
+
+		delete(devices, id)
+	}
+
+	return ids
+}
+
+// Reset unregisters all devices of all peers and drops all cached measurement state, but keeps the broker connection.
+// Unlike unregistering, it neither clears the retained actuator states nor publishes registration events, since the
+// hubs are expected to re-register their devices afterwards.
+func (w *Gateway) Reset() {
+	w.log.Debug("Reset")
+
+	w.fansLock.Lock()
+	w.sprinklersLock.Lock()
+	w.dehumidifiersLock.Lock()
+	w.lampsLock.Lock()
+	w.dosersLock.Lock()
+
+	roomIDs := clearDevices(w.fans)
+	plantIDs := clearDevices(w.sprinklers)
+	dehumidifierRoomIDs := clearDevices(w.dehumidifiers)
+	lampRoomIDs := clearDevices(w.lamps)
+	doserPlantIDs := clearDevices(w.dosers)
+
+	w.metrics.RegisteredDevices(DeviceTypeFan, 0)
+	w.metrics.RegisteredDevices(DeviceTypeSprinkler, 0)
+	w.metrics.RegisteredDevices(DeviceTypeDehumidifier, 0)
+	w.metrics.RegisteredDevices(DeviceTypeLamp, 0)
+	w.metrics.RegisteredDevices(DeviceTypeDoser, 0)
+
+	w.dosersLock.Unlock()
+	w.lampsLock.Unlock()
+	w.dehumidifiersLock.Unlock()
+	w.sprinklersLock.Unlock()
+	w.fansLock.Unlock()
+
+	w.cleanupDevices(DeviceTypeFan, roomIDs)
+	w.cleanupDevices(DeviceTypeSprinkler, plantIDs)
+	w.cleanupDevices(DeviceTypeDehumidifier, dehumidifierRoomIDs)
+	w.cleanupDevices(DeviceTypeLamp, lampRoomIDs)
+	w.cleanupDevices(DeviceTypeDoser, doserPlantIDs)
+
+	w.stopStaleTemperatureTimers()
+}
+
+func getDeadPeerIDs(devices map[string]map[string]struct{}, peers map[string]HubRemote) []string {
+	dead := map[string]struct{}{}
+	for _, candidates := range devices {
+		for peerID := range candidates {
+			if _, ok := peers[peerID]; !ok {
+				dead[peerID] = struct{}{}
+			}
+		}
+	}
+
+	peerIDs := []string{}
+	for peerID := range dead {
+		peerIDs = append(peerIDs, peerID)
+	}
+
+	sort.Strings(peerIDs)
+
+	return peerIDs
+}
+
+// Reconcile unregisters all devices of peers that are no longer connected, e.g. because they have reconnected with a new peer ID,
+// and returns the affected IDs by device type
+func (w *Gateway) Reconcile() (map[string][]string, error) {
+	w.log.Debug("Reconcile")
+
+	if !w.hasPeers() {
+		return nil, ErrNoPeers
+	}
+
+	// We read the peers only once so that all device types are reconciled against the same set of peers
+	peers := w.getPeers()
+
+	tables := []struct {
+		deviceType    string
+		devices       map[string]map[string]struct{}
+		getStateTopic func(id string) string
+	}{
+		{DeviceTypeFan, w.fans, w.getFanStateTopic},
+		{DeviceTypeSprinkler, w.sprinklers, w.getSprinklerStateTopic},
+		{DeviceTypeDehumidifier, w.dehumidifiers, w.getDehumidifierStateTopic},
+		{DeviceTypeLamp, w.lamps, w.getLampStateTopic},
+		{DeviceTypeDoser, w.dosers, w.getDoserStateTopic},
+	}
+
+	type removal struct {
+		deviceType    string
+		peerID        string
+		unregistered  []string
+		removed       []string
+		getStateTopic func(id string) string
+	}
+
+	w.fansLock.Lock()
+	w.sprinklersLock.Lock()
+	w.dehumidifiersLock.Lock()
+	w.lampsLock.Lock()
+	w.dosersLock.Lock()
+
+	removals := []removal{}
+	for _, table := range tables {
+		for _, peerID := range getDeadPeerIDs(table.devices, peers) {
+			unregistered, removed := removePeerDevices(table.devices, peerID)
+
+			removals = append(removals, removal{table.deviceType, peerID, unregistered, removed, table.getStateTopic})
+		}
+
+		w.metrics.RegisteredDevices(table.deviceType, len(table.devices))
+	}
+
+	w.dosersLock.Unlock()
+	w.lampsLock.Unlock()
+	w.dehumidifiersLock.Unlock()
+	w.sprinklersLock.Unlock()
+	w.fansLock.Unlock()
+
+	affected := map[string]map[string]struct{}{}
+	for _, r := range removals {
+		if _, ok := affected[r.deviceType]; !ok {
+			affected[r.deviceType] = map[string]struct{}{}
+		}
+
+		for _, id := range r.unregistered {
+			affected[r.deviceType][id] = struct{}{}
+		}
+	}
+
+	rv := map[string][]string{}
+	for deviceType, ids := range affected {
+		for id := range ids {
+			rv[deviceType] = append(rv[deviceType], id)
+		}
+
+		sort.Strings(rv[deviceType])
+	}
+
+	for _, r := range removals {
+		w.log.Info("Unregistering devices of disconnected peer", "deviceType", r.deviceType, "peerID", r.peerID, "ids", r.unregistered)
+
+		w.forgetPeer(r.peerID)
+
+		if err := w.finishUnregistration(r.deviceType, r.unregistered, r.removed, r.peerID, r.getStateTopic); err != nil {
+			return rv, err
+		}
+	}
+
+	return rv, nil
+}
+
+func copyDevices(lock *sync.Mutex, devices map[string]map[string]struct{}) map[string][]string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return copyDevicesLocked(devices)
+}
+
+func copyDevicesLocked(devices map[string]map[string]struct{}) map[string][]string {
+	rv := map[string][]string{}
+	for id, candidates := range devices {
+		peerIDs := []string{}
+		for peerID := range candidates {
+			peerIDs = append(peerIDs, peerID)
+		}
+
+		sort.Strings(peerIDs)
+
+		rv[id] = peerIDs
+	}
+
+	return rv
+}
+
+func (w *Gateway) ListFans() map[string][]string {
+	return copyDevices(&w.fansLock, w.fans)
+}
+
+func (w *Gateway) ListSprinklers() map[string][]string {
+	return copyDevices(&w.sprinklersLock, w.sprinklers)
+}
+
+func (w *Gateway) ListDehumidifiers() map[string][]string {
+	return copyDevices(&w.dehumidifiersLock, w.dehumidifiers)
+}
+
+func (w *Gateway) ListLamps() map[string][]string {
+	return copyDevices(&w.lampsLock, w.lamps)
+}
+
+func (w *Gateway) ListDosers() map[string][]string {
+	return copyDevices(&w.dosersLock, w.dosers)
+}
+
+func getOwner(lock *sync.Mutex, devices map[string]map[string]struct{}, id string) (string, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	candidates, ok := devices[id]
+	if !ok || len(candidates) == 0 {
+		return "", false
+	}
+
+	peerIDs := []string{}
+	for peerID := range candidates {
+		peerIDs = append(peerIDs, peerID)
+	}
+
+	sort.Strings(peerIDs)
+
+	return peerIDs[0], true
+}
+
+// OwnerOfRoom returns the ID of the peer that has registered the room's fan. If multiple peers serve the room,
+// the first peer ID in sort order is returned; `ListFans` returns all of them.
+func (w *Gateway) OwnerOfRoom(roomID string) (string, bool) {
+	return getOwner(&w.fansLock, w.fans, roomID)
+}
+
+// OwnerOfPlant returns the ID of the peer that has registered the plant's sprinkler; see `OwnerOfRoom`.
+func (w *Gateway) OwnerOfPlant(plantID string) (string, bool) {
+	return getOwner(&w.sprinklersLock, w.sprinklers, plantID)
+}
+
+func (w *Gateway) Health() GatewayHealth {
+	health := GatewayHealth{
+		BrokerConnected: w.broker.IsConnected(),
+	}
+
+	w.fansLock.Lock()
+	health.RegisteredFans = len(w.fans)
+	w.fansLock.Unlock()
+
+	w.sprinklersLock.Lock()
+	health.RegisteredSprinklers = len(w.sprinklers)
+	w.sprinklersLock.Unlock()
+
+	w.lifecycleLock.Lock()
+	health.Opened = w.opened && !w.closed
+	w.lifecycleLock.Unlock()
+
+	return health
+}
+
+// checkOpen fails fast if measurements are forwarded to a gateway that isn't listening for commands
+func (w *Gateway) checkOpen() error {
+	w.lifecycleLock.Lock()
+	defer w.lifecycleLock.Unlock()
+
+	if !w.opened || w.closed {
+		return ErrNotOpen
+	}
+
+	return nil
+}
+
+func (w *Gateway) ForwardTemperatureMeasurement(ctx context.Context, roomID string, measurement, defaultValue int) error {
+	return w.ForwardTemperatureMeasurementWithUnit(ctx, roomID, measurement, defaultValue, w.temperatureUnit)
+}
+
+func (w *Gateway) ForwardTemperatureMeasurementWithUnit(ctx context.Context, roomID string, measurement, defaultValue int, unit string) error {
+	w.log.Debug("ForwardTemperatureMeasurement", "roomID", roomID, "measurement", measurement, "defaultValue", defaultValue, "unit", unit)
+
+	return w.forwardTemperatureMeasurement(roomID, measurement, defaultValue, unit, time.Time{}, func(measurement Measurement, topic string, newMsg func(value float64) ([]byte, error)) error {
+		return w.forwardMeasurement(DeviceTypeTemperature, roomID, measurement, float64(measurement.Measurement), topic, newMsg)
+	})
+}
+
+func (w *Gateway) ForwardTemperatureMeasurementConfirmed(ctx context.Context, roomID string, measurement, defaultValue int) error {
+	w.log.Debug("ForwardTemperatureMeasurementConfirmed", "roomID", roomID, "measurement", measurement, "defaultValue", defaultValue)
+
+	return w.forwardTemperatureMeasurement(roomID, measurement, defaultValue, w.temperatureUnit, time.Time{}, func(measurement Measurement, topic string, newMsg func(value float64) ([]byte, error)) error {
+		if !w.measurementsEnabled(DeviceTypeTemperature) {
+			w.log.Debug("Forwarding is disabled or paused, ignoring measurement", "deviceType", DeviceTypeTemperature, "id", roomID, "measurement", measurement)
+
+			return nil
+		}
+
+		msg, err := newMsg(float64(measurement.Measurement))
+		if err != nil {
+			return err
+		}
+
+		return w.publishMeasurementConfirmed(ctx, DeviceTypeTemperature, topic, msg)
+	})
+}
+
+// ForwardTemperatureMeasurementAt forwards a measurement that was taken at `takenAt` instead of when it was received,
+// e.g. because the sensor buffered it. A zero `takenAt` defaults to the current time.
+func (w *Gateway) ForwardTemperatureMeasurementAt(ctx context.Context, roomID string, measurement, defaultValue int, takenAt time.Time) error {
+	w.log.Debug("ForwardTemperatureMeasurementAt", "roomID", roomID, "measurement", measurement, "defaultValue", defaultValue, "takenAt", takenAt)
+
+	return w.forwardTemperatureMeasurement(roomID, measurement, defaultValue, w.temperatureUnit, takenAt, func(measurement Measurement, topic string, newMsg func(value float64) ([]byte, error)) error {
+		return w.forwardMeasurement(DeviceTypeTemperature, roomID, measurement, float64(measurement.Measurement), topic, newMsg)
+	})
+}
+
+// isReservedTopic reports whether the gateway subscribes to `topic` or publishes its own messages to it,
+// which includes the states and acknowledgements below the command topics
+func (w *Gateway) isReservedTopic(topic string) bool {
+	for _, reserved := range []string{
+		w.getStatusTopic(),
+		w.getHeartbeatTopic(),
+		w.getRegistrationEventsTopic(),
+		w.getRegistrationsTopic(),
+		w.getShadowTopic(),
+	} {
+		if topic == reserved {
+			return true
+		}
+	}
+
+	for _, filter := range []string{
+		w.getFansTopic(),
+		w.getZoneFansTopic(),
+		w.getSprinklersTopic(),
+		w.getDehumidifiersTopic(),
+		w.getLampsTopic(),
+		w.getDosersTopic(),
+	} {
+		for _, candidate := range []string{topic, path.Dir(topic)} {
+			if _, err := w.parseActuatorTopic(candidate, filter); err == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// validateTargetTopic makes sure that hubs can only direct measurements to topics below the gateway's own ones,
+// so that they can't forge messages for other gateways or the gateway's commands
+func (w *Gateway) validateTargetTopic(topic string) error {
+	root := path.Join(w.topicPrefix, w.thingName) + "/"
+
+	if !strings.HasPrefix(topic, root) || path.Clean(topic) != topic || strings.ContainsAny(topic, topics.Wildcard+topics.MultiLevelWildcard+"\x00") {
+		return fmt.Errorf("%w: topic=%q root=%q", ErrInvalidTopic, topic, root)
+	}
+
+	if w.isReservedTopic(topic) {
+		return fmt.Errorf("%w: topic=%q is reserved", ErrInvalidTopic, topic)
+	}
+
+	return nil
+}
+
+// ForwardTemperatureMeasurementTo publishes a measurement to `targetTopic` instead of the room's temperature topic, e.g. to direct it to a
+// test consumer. `targetTopic` must be below the gateway's topics and may not be one that the gateway subscribes to or publishes its own messages to.
+// Like `ForwardTemperatureMeasurementConfirmed`, it bypasses batching, deduplication and rate limiting, which are kept per room.
+func (w *Gateway) ForwardTemperatureMeasurementTo(ctx context.Context, roomID string, targetTopic string, measurement, defaultValue int) error {
+	w.log.Debug("ForwardTemperatureMeasurementTo", "roomID", roomID, "targetTopic", targetTopic, "measurement", measurement, "defaultValue", defaultValue)
+
+	if err := w.validateTargetTopic(targetTopic); err != nil {
+		return err
+	}
+
+	return w.forwardTemperatureMeasurement(roomID, measurement, defaultValue, w.temperatureUnit, time.Time{}, func(measurement Measurement, _ string, newMsg func(value float64) ([]byte, error)) error {
+		if !w.measurementsEnabled(DeviceTypeTemperature) {
+			w.log.Debug("Forwarding is disabled or paused, ignoring measurement", "deviceType", DeviceTypeTemperature, "id", roomID, "measurement", measurement)
+
+			return nil
+		}
+
+		msg, err := newMsg(float64(measurement.Measurement))
+		if err != nil {
+			return err
+		}
+
+		return w.publishMeasurement(DeviceTypeTemperature, targetTopic, msg)
+	})
+}
+
+func (w *Gateway) forwardTemperatureMeasurement(roomID string, measurement, defaultValue int, unit string, takenAt time.Time, forward func(measurement Measurement, topic string, newMsg func(value float64) ([]byte, error)) error) error {
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
+
+	if err := w.validateID(roomID); err != nil {
+		return err
+	}
+
+	if err := w.checkRegistered(&w.fansLock, w.fans, roomID, ErrNoSuchRoom, "roomID"); err != nil {
+		return err
+	}
+
+	// Hubs always receive measurements in the gateway's unit, no matter which unit the sensor reports in
+	measurement, err := convertTemperatureInt(measurement, unit, w.temperatureUnit)
+	if err != nil {
+		return err
+	}
+
+	defaultValue, err = convertTemperatureInt(defaultValue, unit, w.temperatureUnit)
+	if err != nil {
+		return err
+	}
+
+	measurement += int(math.Round(w.getFanCalibrationOffset(roomID)))
+
+	if err := w.ranges.check(DeviceTypeTemperature, roomID, float64(measurement)); err != nil {
+		return err
+	}
+
+	if takenAt.IsZero() {
+		takenAt = w.clock.Now()
+	}
+
+	newMsg := func(value float64) ([]byte, error) {
+		return w.codec.Marshal(mqttapi.TemperatureMeasurement{
+			Measurement:  int(math.Round(value)),
+			DefaultValue: defaultValue,
+			Unit:         w.temperatureUnit,
+			TakenAt:      takenAt,
+			Sequence:     w.sequences.next(getMeasurementKey(DeviceTypeTemperature, roomID)),
+		})
+	}
+
+	if err := forward(Measurement{measurement, defaultValue}, w.getTemperatureTopic(roomID), newMsg); err != nil {
+		return err
+	}
+
+	w.resetStaleTemperatureTimer(roomID, func(takenAt time.Time) any {
+		return mqttapi.TemperatureMeasurement{
+			Measurement:  defaultValue,
+			DefaultValue: defaultValue,
+			Unit:         w.temperatureUnit,
+			TakenAt:      takenAt,
+			Sequence:     w.sequences.next(getMeasurementKey(DeviceTypeTemperature, roomID)),
+		}
+	})
+
+	w.emitMeasurementEvent(DeviceTypeTemperature, roomID, float64(measurement), float64(defaultValue), takenAt)
+
+	// We only cache measurements for registered rooms so that stray IDs can't grow the cache
+	if isRegistered(&w.fansLock, w.fans, roomID) {
+		w.lastTemperatures.set(roomID, Measurement{measurement, defaultValue}, w.clock.Now())
+	}
+
+	return nil
+}
+
+func roundMeasurement(measurement float64, precision int) float64 {
+	factor := math.Pow10(precision)
+
+	return math.Round(measurement*factor) / factor
+}
+
+func (w *Gateway) ForwardTemperatureMeasurementFloat(ctx context.Context, roomID string, measurement, defaultValue float64) error {
+	w.log.Debug("ForwardTemperatureMeasurementFloat", "roomID", roomID, "measurement", measurement, "defaultValue", defaultValue)
+
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
+
+	if err := w.validateID(roomID); err != nil {
+		return err
+	}
+
+	if err := w.checkRegistered(&w.fansLock, w.fans, roomID, ErrNoSuchRoom, "roomID"); err != nil {
+		return err
+	}
+
+	measurement = roundMeasurement(measurement+w.getFanCalibrationOffset(roomID), floatMeasurementPrecision)
+	defaultValue = roundMeasurement(defaultValue, floatMeasurementPrecision)
+
+	if err := w.ranges.check(DeviceTypeTemperature, roomID, measurement); err != nil {
+		return err
+	}
+
+	takenAt := w.clock.Now()
+
+	newMsg := func(value float64) ([]byte, error) {
+		return w.codec.Marshal(mqttapi.TemperatureMeasurementFloat{
+			Measurement:  roundMeasurement(value, floatMeasurementPrecision),
+			DefaultValue: defaultValue,
+			Unit:         w.temperatureUnit,
+			Precision:    floatMeasurementPrecision,
+			TakenAt:      takenAt,
+			Sequence:     w.sequences.next(getMeasurementKey(DeviceTypeTemperature, roomID)),
+		})
+	}
+
+	if err := w.forwardMeasurement(DeviceTypeTemperature, roomID, MeasurementFloat{measurement, defaultValue}, measurement, w.getTemperatureTopic(roomID), newMsg); err != nil {
+		return err
+	}
+
+	w.resetStaleTemperatureTimer(roomID, func(takenAt time.Time) any {
+		return mqttapi.TemperatureMeasurementFloat{
+			Measurement:  defaultValue,
+			DefaultValue: defaultValue,
+			Unit:         w.temperatureUnit,
+			Precision:    floatMeasurementPrecision,
+			TakenAt:      takenAt,
+			Sequence:     w.sequences.next(getMeasurementKey(DeviceTypeTemperature, roomID)),
+		}
+	})
+
+	w.emitMeasurementEvent(DeviceTypeTemperature, roomID, measurement, defaultValue, takenAt)
+
+	// The cache only holds integer measurements, so we round to keep `LastTemperature` up to date
+	if isRegistered(&w.fansLock, w.fans, roomID) {
+		w.lastTemperatures.set(roomID, Measurement{int(math.Round(measurement)), int(math.Round(defaultValue))}, w.clock.Now())
+	}
+
+	return nil
+}
+
+func (w *Gateway) ForwardMoistureMeasurement(ctx context.Context, plantID string, measurement, defaultValue int) error {
+	return w.ForwardMoistureMeasurementAt(ctx, plantID, measurement, defaultValue, time.Time{})
+}
+
+// ForwardMoistureMeasurementAt forwards a measurement that was taken at `takenAt`; see `ForwardTemperatureMeasurementAt`.
+func (w *Gateway) ForwardMoistureMeasurementAt(ctx context.Context, plantID string, measurement, defaultValue int, takenAt time.Time) error {
+	w.log.Debug("ForwardMoistureMeasurement", "plantID", plantID, "measurement", measurement, "defaultValue", defaultValue, "takenAt", takenAt)
+
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
+
+	if err := w.validateID(plantID); err != nil {
+		return err
+	}
+
+	if err := w.checkRegistered(&w.sprinklersLock, w.sprinklers, plantID, ErrNoSuchPlant, "plantID"); err != nil {
+		return err
+	}
+
+	measurement += int(math.Round(w.getSprinklerCalibrationOffset(plantID)))
+
+	if err := w.ranges.check(DeviceTypeMoisture, plantID, float64(measurement)); err != nil {
+		return err
+	}
+
+	if takenAt.IsZero() {
+		takenAt = w.clock.Now()
+	}
+
+	newMsg := func(value float64) ([]byte, error) {
+		return w.codec.Marshal(mqttapi.MoistureMeasurement{
+			Measurement:  int(math.Round(value)),
+			DefaultValue: defaultValue,
+			TakenAt:      takenAt,
+			Sequence:     w.sequences.next(getMeasurementKey(DeviceTypeMoisture, plantID)),
+		})
+	}
+
+	if err := w.forwardMeasurement(DeviceTypeMoisture, plantID, Measurement{measurement, defaultValue}, float64(measurement), w.getMoistureTopic(plantID), newMsg); err != nil {
+		return err
+	}
+
+	w.emitMeasurementEvent(DeviceTypeMoisture, plantID, float64(measurement), float64(defaultValue), takenAt)
+
+	if isRegistered(&w.sprinklersLock, w.sprinklers, plantID) {
+		w.lastMoistures.set(plantID, Measurement{measurement, defaultValue}, w.clock.Now())
+	}
+
+	return nil
+}
+
+func (w *Gateway) ForwardHumidityMeasurement(ctx context.Context, roomID string, measurement, defaultValue int) error {
+	w.log.Debug("ForwardHumidityMeasurement", "roomID", roomID, "measurement", measurement, "defaultValue", defaultValue)
+
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
+
+	if err := w.validateID(roomID); err != nil {
+		return err
+	}
+
+	if err := w.checkRegistered(&w.dehumidifiersLock, w.dehumidifiers, roomID, ErrNoSuchRoom, "roomID"); err != nil {
+		return err
+	}
+
+	if err := w.ranges.check(DeviceTypeHumidity, roomID, float64(measurement)); err != nil {
+		return err
+	}
+
+	takenAt := w.clock.Now()
+
+	newMsg := func(value float64) ([]byte, error) {
+		return w.codec.Marshal(mqttapi.HumidityMeasurement{
+			Measurement:  int(math.Round(value)),
+			DefaultValue: defaultValue,
+			TakenAt:      takenAt,
+			Sequence:     w.sequences.next(getMeasurementKey(DeviceTypeHumidity, roomID)),
+		})
+	}
+
+	if err := w.forwardMeasurement(DeviceTypeHumidity, roomID, Measurement{measurement, defaultValue}, float64(measurement), w.getHumidityTopic(roomID), newMsg); err != nil {
+		return err
+	}
+
+	w.emitMeasurementEvent(DeviceTypeHumidity, roomID, float64(measurement), float64(defaultValue), takenAt)
+
+	if isRegistered(&w.dehumidifiersLock, w.dehumidifiers, roomID) {
+		w.lastHumidities.set(roomID, Measurement{measurement, defaultValue}, w.clock.Now())
+	}
+
+	return nil
+}
+
+func (w *Gateway) ForwardLightMeasurement(ctx context.Context, roomID string, measurement, defaultValue int) error {
+	w.log.Debug("ForwardLightMeasurement", "roomID", roomID, "measurement", measurement, "defaultValue", defaultValue)
+
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
+
+	if err := w.validateID(roomID); err != nil {
+		return err
+	}
+
+	if err := w.checkRegistered(&w.lampsLock, w.lamps, roomID, ErrNoSuchRoom, "roomID"); err != nil {
+		return err
+	}
+
+	if err := w.ranges.check(DeviceTypeLight, roomID, float64(measurement)); err != nil {
+		return err
+	}
+
+	takenAt := w.clock.Now()
+
+	newMsg := func(value float64) ([]byte, error) {
+		return w.codec.Marshal(mqttapi.LightMeasurement{
+			Measurement:  int(math.Round(value)),
+			DefaultValue: defaultValue,
+			TakenAt:      takenAt,
+			Sequence:     w.sequences.next(getMeasurementKey(DeviceTypeLight, roomID)),
+		})
+	}
+
+	if err := w.forwardMeasurement(DeviceTypeLight, roomID, Measurement{measurement, defaultValue}, float64(measurement), w.getLightTopic(roomID), newMsg); err != nil {
+		return err
+	}
+
+	w.emitMeasurementEvent(DeviceTypeLight, roomID, float64(measurement), float64(defaultValue), takenAt)
+
+	if isRegistered(&w.lampsLock, w.lamps, roomID) {
+		w.lastLights.set(roomID, Measurement{measurement, defaultValue}, w.clock.Now())
+	}
+
+	return nil
+}
+
+func (w *Gateway) ForwardPHMeasurement(ctx context.Context, plantID string, measurement, defaultValue int) error {
+	w.log.Debug("ForwardPHMeasurement", "plantID", plantID, "measurement", measurement, "defaultValue", defaultValue)
+
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
+
+	if err := w.validateID(plantID); err != nil {
+		return err
+	}
+
+	if err := w.checkRegistered(&w.dosersLock, w.dosers, plantID, ErrNoSuchPlant, "plantID"); err != nil {
+		return err
+	}
+
+	if err := w.ranges.check(DeviceTypePH, plantID, float64(measurement)); err != nil {
+		return err
+	}
+
+	takenAt := w.clock.Now()
+
+	newMsg := func(value float64) ([]byte, error) {
+		return w.codec.Marshal(mqttapi.PHMeasurement{
+			Measurement:  int(math.Round(value)),
+			DefaultValue: defaultValue,
+			TakenAt:      takenAt,
+			Sequence:     w.sequences.next(getMeasurementKey(DeviceTypePH, plantID)),
+		})
+	}
+
+	if err := w.forwardMeasurement(DeviceTypePH, plantID, Measurement{measurement, defaultValue}, float64(measurement), w.getPHTopic(plantID), newMsg); err != nil {
+		return err
+	}
+
+	w.emitMeasurementEvent(DeviceTypePH, plantID, float64(measurement), float64(defaultValue), takenAt)
+
+	if isRegistered(&w.dosersLock, w.dosers, plantID) {
+		w.lastPHs.set(plantID, Measurement{measurement, defaultValue}, w.clock.Now())
+	}
+
+	return nil
+}
+
+func (w *Gateway) LastTemperature(roomID string) (Measurement, time.Time, bool) {
+	return w.lastTemperatures.get(roomID)
+}
+
+func (w *Gateway) LastMoisture(plantID string) (Measurement, time.Time, bool) {
+	return w.lastMoistures.get(plantID)
+}
+
+func (w *Gateway) LastHumidity(roomID string) (Measurement, time.Time, bool) {
+	return w.lastHumidities.get(roomID)
+}
+
+func (w *Gateway) LastLight(roomID string) (Measurement, time.Time, bool) {
+	return w.lastLights.get(roomID)
+}
+
+func (w *Gateway) LastPH(plantID string) (Measurement, time.Time, bool) {
+	return w.lastPHs.get(plantID)
+}
+
+func forwardMeasurements(ctx context.Context, measurements map[string]Measurement, forward func(ctx context.Context, id string, measurement, defaultValue int) error) error {
+	errs := []error{}
+	for id, measurement := range measurements {
+		if err := forward(ctx, id, measurement.Measurement, measurement.DefaultValue); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (w *Gateway) ForwardTemperatureMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return forwardMeasurements(ctx, measurements, w.ForwardTemperatureMeasurement)
+}
+
+func (w *Gateway) ForwardMoistureMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return forwardMeasurements(ctx, measurements, w.ForwardMoistureMeasurement)
+}
+
+func (w *Gateway) ForwardHumidityMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return forwardMeasurements(ctx, measurements, w.ForwardHumidityMeasurement)
+}
+
+func (w *Gateway) ForwardLightMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return forwardMeasurements(ctx, measurements, w.ForwardLightMeasurement)
+}
+
+func (w *Gateway) ForwardPHMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return forwardMeasurements(ctx, measurements, w.ForwardPHMeasurement)
+}
+
+// SetLogLevel changes the level of the gateway's logger while it is running; use `LogLevelOff` to disable logging
+func (w *Gateway) SetLogLevel(level slog.Level) {
+	w.logLevel.Set(level)
+}
+
+func (w *Gateway) LogLevel() slog.Level {
+	return w.logLevel.Level()
+}
+
+func (w *Gateway) SetForwardingEnabled(deviceType string, enabled bool) {
+	w.log.Debug("SetForwardingEnabled", "deviceType", deviceType, "enabled", enabled)
+
+	w.disabledDeviceTypesLock.Lock()
+	defer w.disabledDeviceTypesLock.Unlock()
+
+	if enabled {
+		delete(w.disabledDeviceTypes, deviceType)
+	} else {
+		w.disabledDeviceTypes[deviceType] = struct{}{}
+	}
+}
+
+func (w *Gateway) ForwardingEnabled(deviceType string) bool {
+	w.disabledDeviceTypesLock.Lock()
+	defer w.disabledDeviceTypesLock.Unlock()
+
+	_, disabled := w.disabledDeviceTypes[deviceType]
+
+	return !disabled
+}
+
+// Pause stops applying commands to the hubs until `Resume` is called, without touching any registrations.
+// If `PauseMeasurements` is set, measurements are dropped while paused too.
+func (w *Gateway) Pause() {
+	w.log.Info("Pausing gateway")
+
+	w.pausedLock.Lock()
+	defer w.pausedLock.Unlock()
+
+	w.paused = true
+}
+
+func (w *Gateway) Resume() {
+	w.log.Info("Resuming gateway")
+
+	w.pausedLock.Lock()
+	defer w.pausedLock.Unlock()
+
+	w.paused = false
+}
+
+func (w *Gateway) Paused() bool {
+	w.pausedLock.Lock()
+	defer w.pausedLock.Unlock()
+
+	return w.paused
+}
+
+func (w *Gateway) measurementsEnabled(deviceType string) bool {
+	if w.pauseMeasurements && w.Paused() {
+		return false
+	}
+
+	return w.ForwardingEnabled(deviceType)
+}
+
+func (w *Gateway) ExpiredMeasurements() int {
+	w.expiredLock.Lock()
+	defer w.expiredLock.Unlock()
+
+	return w.expiredMeasurements
+}
+
+func (w *Gateway) newBufferedMeasurement(deviceType, topic string, msg []byte) bufferedMeasurement {
+	measurement := bufferedMeasurement{
+		topic:   topic,
+		payload: msg,
+		qos:     w.getPublishQoS(deviceType),
+	}
+
+	if ttl := w.measurementBufferTTLs[deviceType]; ttl > 0 {
+		measurement.expiresAt = w.clock.Now().Add(ttl)
+	}
+
+	return measurement
+}
+
+func (w *Gateway) PendingMeasurements() int {
+	if w.buffer == nil {
+		return 0
+	}
+
+	return w.buffer.len()
+}
+
+func (w *Gateway) DroppedMeasurements() int {
+	if w.limiter == nil {
+		return 0
+	}
+
+	return w.limiter.droppedCount()
+}
+
+func getMeasurementKey(deviceType, id string) string {
+	return deviceType + "/" + id
+}
+
+func (w *Gateway) RejectedMeasurements() int {
+	return w.ranges.rejectedCount()
+}
+
+func (w *Gateway) SuppressedRedeliveries() int {
+	if w.redeliveries == nil {
+		return 0
+	}
+
+	return w.redeliveries.suppressedCount()
+}
+
+func (w *Gateway) SuppressedMeasurements() int {
+	if w.dedup == nil {
+		return 0
+	}
+
+	return w.dedup.suppressedCount()
+}
+
+// forwardMeasurement publishes the message that `newMsg` creates for `value`. If batching is enabled, the message
+// is instead created for the aggregate of all values within the window once it ends.
+func (w *Gateway) forwardMeasurement(deviceType, id string, measurement any, value float64, topic string, newMsg func(value float64) ([]byte, error)) error {
+	if !w.measurementsEnabled(deviceType) {
+		w.log.Debug("Forwarding is disabled or paused, ignoring measurement", "deviceType", deviceType, "id", id, "measurement", measurement)
+
+		return nil
+	}
+
+	key := getMeasurementKey(deviceType, id)
+
+	if w.batcher != nil {
+		w.batcher.add(key, value, func(aggregate float64) error {
+			if !w.measurementsEnabled(deviceType) {
+				return nil
+			}
+
+			msg, err := newMsg(aggregate)
+			if err != nil {
+				return err
+			}
+
+			return w.submitMeasurement(key, deviceType, topic, msg)
+		})
+
+		return nil
+	}
+
+	now := w.clock.Now()
+
+	if w.dedup != nil && w.dedup.skip(key, measurement, now) {
+		w.log.Debug("Suppressing duplicate measurement", "deviceType", deviceType, "id", id, "measurement", measurement)
+
+		return nil
+	}
+
+	msg, err := newMsg(value)
+	if err != nil {
+		return err
+	}
+
+	if err := w.submitMeasurement(key, deviceType, topic, msg); err != nil {
+		return err
+	}
+
+	if w.dedup != nil {
+		w.dedup.record(key, measurement, now)
+	}
+
+	return nil
+}
+
+func (w *Gateway) submitMeasurement(key, deviceType, topic string, msg []byte) error {
+	publish := func() error {
+		return w.publishMeasurement(deviceType, topic, msg)
+	}
+
+	if w.limiter == nil {
+		return publish()
+	}
+
+	return w.limiter.submit(key, publish)
+}
+
+// encodePayload applies the publish hook and compresses the result if it exceeds the compression threshold
+func (w *Gateway) encodePayload(topic string, msg []byte) ([]byte, error) {
+	if w.publishHook != nil {
+		var err error
+		msg, err = w.publishHook(topic, msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Dry runs log the payloads, so we keep them readable
+	if w.dryRun {
+		return msg, nil
+	}
+
+	return compressPayload(msg, w.compressionThreshold)
+}
+
+func (w *Gateway) waitForPublish(token mqtt.Token, topic string) error {
+	if !token.WaitTimeout(w.publishTimeout) {
+		return fmt.Errorf("%w: topic=%v timeout=%v", ErrPublishTimeout, topic, w.publishTimeout)
+	}
+
+	return token.Error()
+}
+
+func (w *Gateway) publishMeasurement(deviceType, topic string, msg []byte) error {
+	msg, err := w.encodePayload(topic, msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Info("Dry run, not publishing measurement", "deviceType", deviceType, "topic", topic, "payload", string(msg))
+
+		w.metrics.MeasurementForwarded(deviceType)
+
+		return nil
+	}
+
+	if w.buffer != nil && !w.broker.IsConnected() {
+		w.buffer.push(w.newBufferedMeasurement(deviceType, topic, msg))
+
+		w.metrics.MeasurementForwarded(deviceType)
+
+		return nil
+	}
+
+	if err := w.waitForPublish(w.broker.Publish(
+		topic,
+		w.getPublishQoS(deviceType),
+		false,
+		msg,
+	), topic); err != nil {
+		// The client may still deliver a measurement that has timed out, so we don't buffer it to prevent duplicates
+		if w.buffer != nil && !errors.Is(err, ErrPublishTimeout) {
+			w.log.Warn("Could not publish measurement, buffering", "topic", topic, "err", err)
+
+			w.buffer.push(w.newBufferedMeasurement(deviceType, topic, msg))
+
+			w.metrics.MeasurementForwarded(deviceType)
+
+			return nil
+		}
+
+		w.metrics.ForwardError(deviceType)
+
+		return err
+	}
+
+	w.metrics.MeasurementForwarded(deviceType)
+
+	return nil
+}
+
+// publishMeasurementConfirmed bypasses the buffer, rate limiter and deduplication so that the caller
+// learns whether this exact measurement has reached the broker
+func (w *Gateway) publishMeasurementConfirmed(ctx context.Context, deviceType, topic string, msg []byte) error {
+	msg, err := w.encodePayload(topic, msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Info("Dry run, not publishing measurement", "deviceType", deviceType, "topic", topic, "payload", string(msg))
+
+		w.metrics.MeasurementForwarded(deviceType)
+
+		return nil
+	}
+
+	qos := w.getPublishQoS(deviceType)
+	if qos < 1 {
+		qos = 1
+	}
+
+	token := w.broker.Publish(
+		topic,
+		qos,
+		false,
+		msg,
+	)
+
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			w.metrics.ForwardError(deviceType)
+
+			return err
+		}
+
+	case <-ctx.Done():
+		w.metrics.ForwardError(deviceType)
+
+		return fmt.Errorf("%w: topic=%v: %v", ErrDeliveryTimedOut, topic, ctx.Err())
+	}
+
+	w.metrics.MeasurementForwarded(deviceType)
+
+	return nil
+}
+
+func (w *Gateway) getFlushDelay() time.Duration {
+	delay := w.flushDelay
+	if w.flushJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(w.flushJitter) + 1))
+	}
+
+	return delay
+}
+
+func (w *Gateway) flushMeasurements() {
+	published := false
+	for w.broker.IsConnected() {
+		// We stagger republishing so that reconnecting gateways don't overwhelm the broker all at once
+		if delay := w.getFlushDelay(); published && delay > 0 && w.buffer.len() > 0 {
+			select {
+			case <-w.ctx.Done():
+				return
+
+			case <-w.clock.After(delay):
+			}
+
+			published = false
+		}
+
+		select {
+		case <-w.ctx.Done():
+			return
+		default:
+		}
+
+		measurement, ok := w.buffer.pop()
+		if !ok {
+			return
+		}
+
+		if measurement.expired(w.clock.Now()) {
+			w.log.Debug("Dropping expired measurement", "topic", measurement.topic, "expiresAt", measurement.expiresAt)
+
+			w.expiredLock.Lock()
+			w.expiredMeasurements++
+			w.expiredLock.Unlock()
+
+			continue
+		}
+
+		if err := w.waitForPublish(w.broker.Publish(
+			measurement.topic,
+			measurement.qos,
+			false,
+			measurement.payload,
+		), measurement.topic); err != nil {
+			if errors.Is(err, ErrPublishTimeout) {
+				w.log.Warn("Timed out flushing measurement, not retrying", "topic", measurement.topic, "err", err)
+
+				return
+			}
+
+			w.log.Warn("Could not flush measurement, retrying later", "topic", measurement.topic, "err", err)
+
+			w.buffer.pushFront(measurement)
+
+			return
+		}
+
+		published = true
+	}
+}
+
+func (w *Gateway) publishState(deviceType, topic string, on bool) error {
+	msg, err := w.codec.Marshal(mqttapi.FanState{
+		On: on,
+	})
+	if err != nil {
+		return err
+	}
+
+	msg, err = w.encodePayload(topic, msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Info("Dry run, not publishing actuator state", "topic", topic, "payload", string(msg), "retained", w.retained)
+
+		return nil
+	}
+
+	if err := w.waitForPublish(w.broker.Publish(
+		topic,
+		w.getPublishQoS(deviceType),
+		w.retained,
+		msg,
+	), topic); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Gateway) clearStates(deviceType string, ids []string, getStateTopic func(id string) string) error {
+	if !w.retained {
+		return nil
+	}
+
+	for _, id := range ids {
+		if w.dryRun {
+			w.log.Info("Dry run, not clearing actuator state", "topic", getStateTopic(id))
+
+			continue
+		}
+
+		// An empty retained payload removes the retained message from the broker
+		if err := w.waitForPublish(w.broker.Publish(
+			getStateTopic(id),
+			w.getPublishQoS(deviceType),
+			true,
+			[]byte{},
+		), getStateTopic(id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Gateway) PublishFanState(ctx context.Context, roomID string, on bool) error {
+	w.log.Debug("PublishFanState", "roomID", roomID, "on", on)
+
+	if err := w.validateID(roomID); err != nil {
+		return err
+	}
+
+	return w.publishState(DeviceTypeFan, w.getFanStateTopic(roomID), on)
+}
+
+func (w *Gateway) PublishSprinklerState(ctx context.Context, plantID string, on bool) error {
+	w.log.Debug("PublishSprinklerState", "plantID", plantID, "on", on)
+
+	if err := w.validateID(plantID); err != nil {
+		return err
+	}
+
+	return w.publishState(DeviceTypeSprinkler, w.getSprinklerStateTopic(plantID), on)
+}
+
+func (w *Gateway) PublishDehumidifierState(ctx context.Context, roomID string, on bool) error {
+	w.log.Debug("PublishDehumidifierState", "roomID", roomID, "on", on)
+
+	if err := w.validateID(roomID); err != nil {
+		return err
+	}
+
+	return w.publishState(DeviceTypeDehumidifier, w.getDehumidifierStateTopic(roomID), on)
+}
+
+func (w *Gateway) PublishLampState(ctx context.Context, roomID string, on bool) error {
+	w.log.Debug("PublishLampState", "roomID", roomID, "on", on)
+
+	if err := w.validateID(roomID); err != nil {
+		return err
+	}
+
+	return w.publishState(DeviceTypeLamp, w.getLampStateTopic(roomID), on)
+}
+
+func (w *Gateway) PublishDoserState(ctx context.Context, plantID string, on bool) error {
+	w.log.Debug("PublishDoserState", "plantID", plantID, "on", on)
+
+	if err := w.validateID(plantID); err != nil {
+		return err
+	}
+
+	return w.publishState(DeviceTypeDoser, w.getDoserStateTopic(plantID), on)
+}
+
+// QueryFanState asks the hubs that registered `roomID` for the fan's actual state, returning the first answer
+func (w *Gateway) QueryFanState(ctx context.Context, roomID string) (bool, error) {
+	w.log.Debug("QueryFanState", "roomID", roomID)
+
+	if err := w.validateID(roomID); err != nil {
+		return false, err
+	}
+
+	w.fansLock.Lock()
+	candidates := []string{}
+	for peerID := range w.fans[roomID] {
+		candidates = append(candidates, peerID)
+	}
+	w.fansLock.Unlock()
+
+	if len(candidates) == 0 {
+		return false, fmt.Errorf("%w: roomID=%v", ErrNoSuchRoom, roomID)
+	}
+
+	if !w.hasPeers() {
+		return false, fmt.Errorf("%w: roomID=%v", ErrNoPeers, roomID)
+	}
+
+	// We ask the peers in a stable order so that repeated queries are answered by the same hub
+	sort.Strings(candidates)
+
+	peers := w.getPeers()
+	errs := []error{}
+	for _, peerID := range candidates {
+		hub, ok := peers[peerID]
+		if !ok {
+			continue
+		}
+
+		on := false
+		if err := w.callHub(ctx, peerID, func(ctx context.Context) error {
+			var err error
+			on, err = hub.GetFanState(ctx, roomID)
+
+			return err
+		}); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("%w: roomID=%v peerID=%v timeout=%v", ErrHubCallTimedOut, roomID, peerID, w.hubCallTimeout)
+			} else if errors.Is(err, ErrHubCallQueueFull) || errors.Is(err, ErrCircuitOpen) {
+				err = fmt.Errorf("%w: roomID=%v peerID=%v", err, roomID, peerID)
+			}
+
+			errs = append(errs, err)
+
+			continue
+		}
+
+		return on, nil
+	}
+
+	if len(errs) == 0 {
+		return false, fmt.Errorf("%w: roomID=%v", ErrNoSuchRoom, roomID)
+	}
+
+	return false, errors.Join(errs...)
+}
+
+func (w *Gateway) publishAck(deviceType, topic string, on bool, success bool, err error) error {
+	if !w.commandAcks {
+		return nil
+	}
+
+	ack := mqttapi.CommandAck{
+		On:        on,
+		Success:   success,
+		Timestamp: w.clock.Now(),
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+
+	msg, err := w.codec.Marshal(ack)
+	if err != nil {
+		return err
+	}
+
+	msg, err = w.encodePayload(topic, msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Info("Dry run, not publishing command acknowledgement", "topic", topic, "payload", string(msg))
+
+		return nil
+	}
+
+	if err := w.waitForPublish(w.broker.Publish(
+		topic,
+		w.getPublishQoS(deviceType),
+		false,
+		msg,
+	), topic); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Gateway) publishRegistrationEvent(action, deviceType string, ids []string, peerID string) error {
+	if !w.registrationEvents || len(ids) == 0 {
+		return nil
+	}
+
+	msg, err := w.codec.Marshal(mqttapi.RegistrationEvent{
+		Action:     action,
+		DeviceType: deviceType,
+		IDs:        ids,
+		PeerID:     peerID,
+		Timestamp:  w.clock.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	msg, err = w.encodePayload(w.getRegistrationEventsTopic(), msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Info("Dry run, not publishing registration event", "topic", w.getRegistrationEventsTopic(), "payload", string(msg))
+
+		return nil
+	}
+
+	if err := w.waitForPublish(w.broker.Publish(
+		w.getRegistrationEventsTopic(),
+		w.publishQoS,
+		false,
+		msg,
+	), w.getRegistrationEventsTopic()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Gateway) PublishRegistrationSnapshot(ctx context.Context) error {
+	w.log.Debug("PublishRegistrationSnapshot")
+
+	// We hold all locks at once so that the snapshot is consistent across device types
+	w.fansLock.Lock()
+	w.sprinklersLock.Lock()
+	w.dehumidifiersLock.Lock()
+	w.lampsLock.Lock()
+	w.dosersLock.Lock()
+
+	snapshot := mqttapi.RegistrationSnapshot{
+		Fans:          copyDevicesLocked(w.fans),
+		Sprinklers:    copyDevicesLocked(w.sprinklers),
+		Dehumidifiers: copyDevicesLocked(w.dehumidifiers),
+		Lamps:         copyDevicesLocked(w.lamps),
+		Dosers:        copyDevicesLocked(w.dosers),
+		Timestamp:     w.clock.Now(),
+	}
+
+	w.dosersLock.Unlock()
+	w.lampsLock.Unlock()
+	w.dehumidifiersLock.Unlock()
+	w.sprinklersLock.Unlock()
+	w.fansLock.Unlock()
+
+	msg, err := w.codec.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	msg, err = w.encodePayload(w.getRegistrationsTopic(), msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Info("Dry run, not publishing registration snapshot", "topic", w.getRegistrationsTopic(), "payload", string(msg))
+
+		return nil
+	}
+
+	if err := w.waitForPublish(w.broker.Publish(
+		w.getRegistrationsTopic(),
+		w.publishQoS,
+		true,
+		msg,
+	), w.getRegistrationsTopic()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Gateway) publishGatewayStatus(status string) error {
+	if !w.publishStatus {
+		return nil
+	}
+
+	msg, err := w.codec.Marshal(mqttapi.GatewayStatus{
+		Status:    status,
+		Timestamp: w.clock.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	msg, err = w.encodePayload(w.getStatusTopic(), msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Info("Dry run, not publishing gateway status", "topic", w.getStatusTopic(), "payload", string(msg))
+
+		return nil
+	}
+
+	if err := w.waitForPublish(w.broker.Publish(
+		w.getStatusTopic(),
+		w.publishQoS,
+		true,
+		msg,
+	), w.getStatusTopic()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Gateway) decodeActuatorState(payload []byte) (bool, error) {
+	// We decode into a pointer so that we can distinguish a missing `on` field from `false`
+	var state struct {
+		On *bool `json:"on"`
+	}
+
+	payload, err := decompressPayload(payload)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidActuatorState, err)
+	}
+
+	if err := w.codec.Unmarshal(payload, &state); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidActuatorState, err)
+	}
+
+	if state.On == nil {
+		return false, fmt.Errorf("%w: missing \"on\" field", ErrInvalidActuatorState)
+	}
+
+	return *state.On, nil
+}
+
+func (w *Gateway) reportError(err error) {
+	if w.onError != nil {
+		w.onError(err)
+
+		return
+	}
+
+	w.errsLock.Lock()
+	defer w.errsLock.Unlock()
+
+	// Late callbacks, e.g. of timers that fired while closing, may still report errors after the channel has been closed
+	if w.errsClosed {
+		w.log.Debug("Gateway is closed, dropping error", "err", err)
+
+		return
+	}
+
+	// Device locks are released before hub calls and error reporting, but the command workers report errors themselves,
+	// so a stalled consumer must not be able to block them and with them all commands queued behind them
+	select {
+	case w.errs <- err:
+	default:
+		w.droppedErrorsLock.Lock()
+		w.droppedErrors++
+		w.droppedErrorsLock.Unlock()
+
+		w.log.Warn("Error buffer is full, dropping error", "err", err)
+	}
+}
+
+// Errors returns the channel on which the gateway reports errors; it is created with the gateway and closed by `CloseGateway`.
+// Errors that are received here won't be returned by `WaitGateway`.
+func (w *Gateway) Errors() <-chan error {
+	return w.errs
+}
+
+func (w *Gateway) closeErrors() {
+	w.errsLock.Lock()
+	defer w.errsLock.Unlock()
+
+	if w.errsClosed {
+		return
+	}
+
+	w.errsClosed = true
+
+	close(w.errs)
+}
+
+func (w *Gateway) DroppedErrors() int {
+	w.droppedErrorsLock.Lock()
+	defer w.droppedErrorsLock.Unlock()
+
+	return w.droppedErrors
+}
+
+func (w *Gateway) emitMessageEvent(msg mqtt.Message, deviceType, id string) {
+	if w.debugMessages == nil {
+		return
+	}
+
+	// Tracing must never slow down command handling, so we drop events if nobody is reading them
+	select {
+	case w.debugMessages <- MessageEvent{
+		Topic:      msg.Topic(),
+		Payload:    msg.Payload(),
+		DeviceType: deviceType,
+		ID:         id,
+	}:
+	default:
+	}
+}
+
+func (w *Gateway) emitMeasurementEvent(deviceType, id string, measurement, defaultValue float64, takenAt time.Time) {
+	if w.onForward != nil {
+		w.onForward(deviceType, id, int(math.Round(measurement)), int(math.Round(defaultValue)))
+	}
+
+	if w.measurementEvents == nil {
+		return
+	}
+
+	// Like with debug messages, a slow consumer must not be able to hold up forwarding
+	select {
+	case w.measurementEvents <- MeasurementEvent{
+		DeviceType:   deviceType,
+		ID:           id,
+		Measurement:  measurement,
+		DefaultValue: defaultValue,
+		TakenAt:      takenAt,
+	}:
+	default:
+	}
+}
+
+func (w *Gateway) beginCallback() bool {
+	w.callbacksLock.Lock()
+	defer w.callbacksLock.Unlock()
+
+	if w.closing {
+		return false
+	}
+
+	w.callbacksWg.Add(1)
+
+	return true
+}
+
+func callWithTimeout(ctx context.Context, timeout time.Duration, call func(ctx context.Context) error) error {
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The RPC layer doesn't honor context cancellation, so we can't rely on `call` to return once the deadline is exceeded
+	res := make(chan error, 1)
+	go func() {
+		res <- call(callCtx)
+	}()
+
+	select {
+	case err := <-res:
+		return err
+
+	case <-callCtx.Done():
+		return callCtx.Err()
+	}
+}
+
+// isUnsupportedActuator reports whether a hub has rejected a call because it can't control the actuator
+func isUnsupportedActuator(err error) bool {
+	// Errors that hubs return over RPC only keep their message
+	return errors.Is(err, ErrUnsupportedActuator) || strings.Contains(err.Error(), ErrUnsupportedActuator.Error())
+}
+
+// pruneUnsupportedActuator unregisters all devices of `deviceType` that `peerID` has registered, since the hub
+// has reported that it can't control them
+func (w *Gateway) pruneUnsupportedActuator(deviceType, peerID string, lock *sync.Mutex, devices map[string]map[string]struct{}) error {
+	getStateTopic := w.getFanStateTopic
+	switch deviceType {
+	case DeviceTypeSprinkler:
+		getStateTopic = w.getSprinklerStateTopic
+
+	case DeviceTypeDehumidifier:
+		getStateTopic = w.getDehumidifierStateTopic
+
+	case DeviceTypeLamp:
+		getStateTopic = w.getLampStateTopic
+
+	case DeviceTypeDoser:
+		getStateTopic = w.getDoserStateTopic
+	}
+
+	lock.Lock()
+	unregistered, removed := removePeerDevices(devices, peerID)
+	w.metrics.RegisteredDevices(deviceType, len(devices))
+	lock.Unlock()
+
+	if len(unregistered) == 0 {
+		return nil
+	}
+
+	w.log.Warn("Hub doesn't support actuator, unregistering its devices", "deviceType", deviceType, "peerID", peerID, "ids", unregistered)
+
+	return w.finishUnregistration(deviceType, unregistered, removed, peerID, getStateTopic)
+}
+
+// callHub waits for a free hub call slot before calling the hub. The slot is released once the call
+// has returned or timed out, so that a hung hub can't exhaust all slots.
+func (w *Gateway) callHub(ctx context.Context, peerID string, call func(ctx context.Context) error) error {
+	if w.breaker != nil {
+		if err := w.breaker.allow(peerID); err != nil {
+			return err
+		}
+	}
+
+	if err := w.hubCalls.acquire(ctx); err != nil {
+		if w.breaker != nil {
+			w.breaker.abort(peerID)
+		}
+
+		return err
+	}
+	defer w.hubCalls.release()
+
+	err := callWithTimeout(ctx, w.hubCallTimeout, call)
 
-	RegisterSprinklers         func(ctx context.Context, plantIDs []string) error
-	UnregisterSprinklers       func(ctx context.Context, plantIDs []string) error
-	ForwardMoistureMeasurement func(ctx context.Context, plantID string, measurement, defaultValue int) error
+	if w.breaker != nil {
+		if ctx.Err() != nil {
+			// The gateway is closing, which says nothing about the hub
+			w.breaker.abort(peerID)
+		} else {
+			w.breaker.record(peerID, err != nil)
+		}
+	}
+
+	return err
 }
 
-type Gateway struct {
-	verbose bool
+func (w *Gateway) DroppedHubCalls() int {
+	return w.hubCalls.droppedCount()
+}
 
-	errs chan error
+// parseActuatorTopic extracts the ID from `topic`, which must match `filter` exactly, with the ID
+// taking the place of the single-level wildcard. With multi-segment IDs, the ID is everything between
+// the parts of `filter` before and after the wildcard.
+func (w *Gateway) parseActuatorTopic(topic, filter string) (string, error) {
+	if w.multiSegmentIDs {
+		prefix, suffix, _ := strings.Cut(filter, topics.Wildcard)
+		if !matchesMultiSegmentTopic(topic, prefix, suffix) {
+			return "", fmt.Errorf("%w: topic=%v expected=%v", ErrMalformedTopic, topic, filter)
+		}
 
-	broker    mqtt.Client
-	thingName string
+		id := topic[len(prefix) : len(topic)-len(suffix)]
+		if err := w.validateID(id); err != nil {
+			return "", fmt.Errorf("%w: topic=%v expected=%v: %v", ErrMalformedTopic, topic, filter, err)
+		}
 
-	fans     map[string]string
-	fansLock sync.Mutex
+		return id, nil
+	}
 
-	sprinklers     map[string]string
-	sprinklersLock sync.Mutex
+	topicParts := strings.Split(topic, "/")
+	filterParts := strings.Split(filter, "/")
 
-	Peers func() map[string]HubRemote
+	if len(topicParts) != len(filterParts) {
+		return "", fmt.Errorf("%w: topic=%v expected=%v", ErrMalformedTopic, topic, filter)
+	}
+
+	id := ""
+	for i, filterPart := range filterParts {
+		if filterPart == topics.Wildcard {
+			id = topicParts[i]
+
+			continue
+		}
+
+		if topicParts[i] != filterPart {
+			return "", fmt.Errorf("%w: topic=%v expected=%v", ErrMalformedTopic, topic, filter)
+		}
+	}
+
+	if err := w.validateID(id); err != nil {
+		return "", fmt.Errorf("%w: topic=%v expected=%v: %v", ErrMalformedTopic, topic, filter, err)
+	}
+
+	return id, nil
 }
 
-func NewGateway(
-	verbose bool,
+type commandRoute struct {
+	deviceType string
+	filter     string
+	handle     mqtt.MessageHandler
+}
+
+// getSubscriptionFilter replaces everything from the single-level wildcard in `filter` onwards with the
+// multi-level wildcard if `multiSegmentIDs` is set
+func getSubscriptionFilter(filter string, multiSegmentIDs bool) string {
+	if !multiSegmentIDs {
+		return filter
+	}
+
+	prefix, _, _ := strings.Cut(filter, topics.Wildcard)
+
+	return prefix + topics.MultiLevelWildcard
+}
+
+func matchesMultiSegmentTopic(topic, prefix, suffix string) bool {
+	return len(topic) >= len(prefix)+len(suffix) && strings.HasPrefix(topic, prefix) && strings.HasSuffix(topic, suffix)
+}
+
+func (w *Gateway) handleActuatorCommand(
 	ctx context.Context,
-	broker mqtt.Client,
-	thingName string,
-) *Gateway {
-	return &Gateway{
-		verbose: verbose,
+	msg mqtt.Message,
+	deviceType string,
+	filter string,
+	lock *sync.Mutex,
+	devices map[string]map[string]struct{},
+	errNoSuchDevice error,
+	idName string,
+	setOn func(hub HubRemote) func(ctx context.Context, id string, on bool) error,
+	publishState func(ctx context.Context, id string, on bool) error,
+	getAckTopic func(id string) string,
+) {
+	w.metrics.CommandReceived(deviceType)
+
+	if !w.ForwardingEnabled(deviceType) {
+		w.log.Debug("Forwarding is disabled, ignoring command", "deviceType", deviceType, "topic", msg.Topic())
+
+		return
+	}
 
-		errs: make(chan error),
+	id, err := w.parseActuatorTopic(msg.Topic(), filter)
 
-		fans: map[string]string{},
+	w.emitMessageEvent(msg, deviceType, id)
 
-		sprinklers: map[string]string{},
+	if err != nil {
+		w.reportError(err)
 
-		broker:    broker,
-		thingName: thingName,
+		return
 	}
+
+	w.applyActuatorCommand(ctx, msg, deviceType, id, lock, devices, errNoSuchDevice, idName, setOn, publishState, getAckTopic)
 }
 
-func (w *Gateway) RegisterFans(ctx context.Context, roomIDs []string) error {
-	if w.verbose {
-		log.Printf("RegisterFans(roomIDs=%v)", roomIDs)
+func (w *Gateway) applyActuatorCommand(
+	ctx context.Context,
+	msg mqtt.Message,
+	deviceType string,
+	id string,
+	lock *sync.Mutex,
+	devices map[string]map[string]struct{},
+	errNoSuchDevice error,
+	idName string,
+	setOn func(hub HubRemote) func(ctx context.Context, id string, on bool) error,
+	publishState func(ctx context.Context, id string, on bool) error,
+	getAckTopic func(id string) string,
+) {
+	// We only hold the lock while looking up the peers so that slow hubs don't block other commands
+	lock.Lock()
+	candidates := []string{}
+	for peerID := range devices[id] {
+		candidates = append(candidates, peerID)
 	}
+	lock.Unlock()
 
-	peerID := rpc.GetRemoteID(ctx)
+	if len(candidates) == 0 {
+		err := fmt.Errorf("%w: %v=%v topic=%v", errNoSuchDevice, idName, id, msg.Topic())
 
-	w.fansLock.Lock()
-	defer w.fansLock.Unlock()
+		switch w.unknownCommandStrategy {
+		case UnknownCommandStrategyIgnore:
+			w.log.Debug("Ignoring command for unknown device", "deviceType", deviceType, idName, id, "topic", msg.Topic())
 
-	for _, roomID := range roomIDs {
-		w.fans[roomID] = peerID
+		case UnknownCommandStrategyBuffer:
+			if addErr := w.pendingCommands.add(deviceType, id, func() {
+				w.dispatchCommand(deviceType, msg.Topic(), func() {
+					w.applyActuatorCommand(ctx, msg, deviceType, id, lock, devices, errNoSuchDevice, idName, setOn, publishState, getAckTopic)
+				})
+			}, func() {
+				w.reportError(err)
+			}); addErr != nil {
+				w.reportError(fmt.Errorf("%w: %v=%v topic=%v", addErr, idName, id, msg.Topic()))
+
+				return
+			}
+
+			w.log.Debug("Holding command until the device is registered", "deviceType", deviceType, idName, id, "topic", msg.Topic())
+
+		default:
+			w.reportError(err)
+		}
+
+		return
 	}
 
-	return nil
-}
+	if !w.hasPeers() {
+		w.reportError(fmt.Errorf("%w: %v=%v topic=%v", ErrNoPeers, idName, id, msg.Topic()))
 
-func (w *Gateway) UnregisterFans(ctx context.Context, roomIDs []string) error {
-	if w.verbose {
-		log.Printf("UnregisterFans(roomIDs=%v)", roomIDs)
+		return
 	}
 
-	w.fansLock.Lock()
-	defer w.fansLock.Unlock()
+	peers := w.getPeers()
+	hubs := map[string]HubRemote{}
+	for _, peerID := range candidates {
+		if hub, ok := peers[peerID]; ok {
+			hubs[peerID] = hub
+		}
+	}
 
-	for _, roomID := range roomIDs {
-		delete(w.fans, roomID)
+	if len(hubs) == 0 {
+		w.reportError(fmt.Errorf("%w: %v=%v topic=%v", errNoSuchDevice, idName, id, msg.Topic()))
+
+		return
 	}
 
-	return nil
-}
+	on, err := w.decodeActuatorState(msg.Payload())
+	if err != nil {
+		w.reportError(fmt.Errorf("%w: %v=%v topic=%v", err, idName, id, msg.Topic()))
 
-func (w *Gateway) RegisterSprinklers(ctx context.Context, plantIDs []string) error {
-	if w.verbose {
-		log.Printf("RegisterSprinklers(plantIDs=%v)", plantIDs)
+		return
 	}
 
-	peerID := rpc.GetRemoteID(ctx)
+	if w.Paused() {
+		w.log.Info("Gateway is paused, not calling hub", "deviceType", deviceType, idName, id, "on", on)
 
-	w.sprinklersLock.Lock()
-	defer w.sprinklersLock.Unlock()
+		if err := w.publishAck(deviceType, getAckTopic(id), on, false, ErrPaused); err != nil {
+			w.reportError(err)
+		}
 
-	for _, plantID := range plantIDs {
-		w.sprinklers[plantID] = peerID
+		return
 	}
 
-	return nil
-}
+	if w.dryRun {
+		for peerID := range hubs {
+			w.log.Info("Dry run, not calling hub", "deviceType", deviceType, idName, id, "peerID", peerID, "on", on)
+		}
 
-func (w *Gateway) UnregisterSprinklers(ctx context.Context, plantIDs []string) error {
-	if w.verbose {
-		log.Printf("UnregisterSpriklers(plantIDs=%v)", plantIDs)
+		return
 	}
 
-	w.sprinklersLock.Lock()
-	defer w.sprinklersLock.Unlock()
+	if !w.dwell.admit(deviceType, id, on, func() {
+		w.dispatchCommand(deviceType, msg.Topic(), func() {
+			w.applyActuatorCommand(ctx, msg, deviceType, id, lock, devices, errNoSuchDevice, idName, setOn, publishState, getAckTopic)
+		})
+	}) {
+		w.log.Debug("Deferring command until the minimum dwell time has elapsed", "deviceType", deviceType, idName, id, "on", on)
 
-	for _, plantID := range plantIDs {
-		delete(w.sprinklers, plantID)
+		return
 	}
 
-	return nil
-}
+	var (
+		errs     = []error{}
+		errsLock sync.Mutex
+		wg       sync.WaitGroup
+	)
+	for peerID, hub := range hubs {
+		wg.Add(1)
 
-func (w *Gateway) ForwardTemperatureMeasurement(ctx context.Context, roomID string, measurement, defaultValue int) error {
-	if w.verbose {
-		log.Printf("ForwardTemperatureMeasurement(roomIDs=%v, measurement=%v, defaultValue=%v)", roomID, measurement, defaultValue)
+		go func(peerID string, hub HubRemote) {
+			defer wg.Done()
+
+			if err := w.callHub(ctx, peerID, func(ctx context.Context) error {
+				return setOn(hub)(ctx, id, on)
+			}); err != nil {
+				if w.pruneUnsupported && isUnsupportedActuator(err) {
+					if err := w.pruneUnsupportedActuator(deviceType, peerID, lock, devices); err != nil {
+						w.reportError(err)
+					}
+				}
+
+				if errors.Is(err, ErrHubCallQueueFull) {
+					w.metrics.CommandDropped(deviceType)
+				}
+
+				if errors.Is(err, context.DeadlineExceeded) {
+					err = fmt.Errorf("%w: %v=%v peerID=%v timeout=%v", ErrHubCallTimedOut, idName, id, peerID, w.hubCallTimeout)
+				} else if errors.Is(err, ErrHubCallQueueFull) || errors.Is(err, ErrCircuitOpen) {
+					err = fmt.Errorf("%w: %v=%v peerID=%v", err, idName, id, peerID)
+				}
+
+				errsLock.Lock()
+				errs = append(errs, err)
+				errsLock.Unlock()
+			}
+		}(peerID, hub)
 	}
+	wg.Wait()
 
-	msg, err := json.Marshal(mqttapi.TemperatureMeasurement{
-		Measurement:  measurement,
-		DefaultValue: defaultValue,
-	})
-	if err != nil {
-		return err
+	if len(errs) > 0 {
+		w.reportError(errors.Join(errs...))
 	}
 
-	if token := w.broker.Publish(
-		path.Join("/gateways", w.thingName, "rooms", roomID, "temperature"),
-		0,
-		false,
-		msg,
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+	if err := w.publishAck(deviceType, getAckTopic(id), on, len(errs) < len(hubs), errors.Join(errs...)); err != nil {
+		w.reportError(err)
 	}
 
-	return nil
+	// We still publish the state if at least one of the peers has applied it
+	if len(errs) == len(hubs) {
+		return
+	}
+
+	w.dwell.applied(deviceType, id, on)
+
+	if err := w.setShadowState(deviceType, id, on); err != nil {
+		w.reportError(err)
+	}
+
+	if w.retained {
+		if err := publishState(ctx, id, on); err != nil {
+			w.reportError(err)
+
+			return
+		}
+	}
 }
 
-func (w *Gateway) ForwardMoistureMeasurement(ctx context.Context, plantID string, measurement, defaultValue int) error {
-	if w.verbose {
-		log.Printf("ForwardMoistureMeasurement(plantIDs=%v, measurement=%v, defaultValue=%v)", plantID, measurement, defaultValue)
+// handleZoneFanCommand applies a fan command to all rooms in the zone as if it had been sent to each of them
+func (w *Gateway) handleZoneFanCommand(ctx context.Context, msg mqtt.Message) {
+	w.metrics.CommandReceived(DeviceTypeFan)
+
+	if !w.ForwardingEnabled(DeviceTypeFan) {
+		w.log.Debug("Forwarding is disabled, ignoring command", "deviceType", DeviceTypeFan, "topic", msg.Topic())
+
+		return
 	}
 
-	msg, err := json.Marshal(mqttapi.MoistureMeasurement{
-		Measurement:  measurement,
-		DefaultValue: defaultValue,
-	})
+	zoneID, err := w.parseActuatorTopic(msg.Topic(), w.getZoneFansTopic())
+
+	w.emitMessageEvent(msg, DeviceTypeFan, zoneID)
+
 	if err != nil {
-		return err
+		w.reportError(err)
+
+		return
 	}
 
-	if token := w.broker.Publish(
-		path.Join("/gateways", w.thingName, "plants", plantID, "moisture"),
-		0,
-		false,
-		msg,
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+	roomIDs := w.getZoneRoomIDs(zoneID)
+	if len(roomIDs) == 0 {
+		w.reportError(fmt.Errorf("%w: zoneID=%v topic=%v", ErrNoSuchZone, zoneID, msg.Topic()))
+
+		return
 	}
 
-	return nil
+	var wg sync.WaitGroup
+	for _, roomID := range roomIDs {
+		wg.Add(1)
+
+		go func(roomID string) {
+			defer wg.Done()
+
+			w.applyActuatorCommand(
+				ctx,
+				msg,
+				DeviceTypeFan,
+				roomID,
+				&w.fansLock,
+				w.fans,
+				ErrNoSuchRoom,
+				"roomID",
+				func(hub HubRemote) func(ctx context.Context, id string, on bool) error {
+					return hub.SetFanOn
+				},
+				w.PublishFanState,
+				w.getFanAckTopic,
+			)
+		}(roomID)
+	}
+	wg.Wait()
 }
 
-func OpenGateway(gateway *Gateway, ctx context.Context) error {
-	if token := gateway.broker.Subscribe(
-		path.Join("/gateways", gateway.thingName, "rooms", "+", "fan"),
-		0,
-		func(client mqtt.Client, msg mqtt.Message) {
-			gateway.fansLock.Lock()
-			defer gateway.fansLock.Unlock()
+func (w *Gateway) subscribe(ctx context.Context) error {
+	return w.subscribeCommands([]commandRoute{
+		{
+			deviceType: DeviceTypeFan,
+			filter:     w.getFansTopic(),
+			handle: func(client mqtt.Client, msg mqtt.Message) {
+				w.dispatchCommand(DeviceTypeFan, msg.Topic(), func() {
+					w.handleActuatorCommand(
+						ctx,
+						msg,
+						DeviceTypeFan,
+						w.getFansTopic(),
+						&w.fansLock,
+						w.fans,
+						ErrNoSuchRoom,
+						"roomID",
+						func(hub HubRemote) func(ctx context.Context, id string, on bool) error {
+							return hub.SetFanOn
+						},
+						w.PublishFanState,
+						w.getFanAckTopic,
+					)
+				})
+			},
+		},
+		{
+			deviceType: DeviceTypeFan,
+			filter:     w.getZoneFansTopic(),
+			handle: func(client mqtt.Client, msg mqtt.Message) {
+				w.dispatchCommand(DeviceTypeFan, msg.Topic(), func() {
+					w.handleZoneFanCommand(ctx, msg)
+				})
+			},
+		},
+		{
+			deviceType: DeviceTypeSprinkler,
+			filter:     w.getSprinklersTopic(),
+			handle: func(client mqtt.Client, msg mqtt.Message) {
+				apply := func() {
+					w.dispatchCommand(DeviceTypeSprinkler, msg.Topic(), func() {
+						w.handleActuatorCommand(
+							ctx,
+							msg,
+							DeviceTypeSprinkler,
+							w.getSprinklersTopic(),
+							&w.sprinklersLock,
+							w.sprinklers,
+							ErrNoSuchPlant,
+							"plantID",
+							func(hub HubRemote) func(ctx context.Context, id string, on bool) error {
+								return hub.SetSprinklerOn
+							},
+							w.PublishSprinklerState,
+							w.getSprinklerAckTopic,
+						)
+					})
+				}
 
-			basePath, _ := path.Split(msg.Topic())
+				if w.sprinklerDebouncer == nil {
+					apply()
 
-			roomID := path.Base(basePath)
+					return
+				}
 
-			peerID, ok := gateway.fans[roomID]
-			if !ok {
-				gateway.errs <- ErrNoSuchRoom
+				// Malformed topics are applied right away so that the error is reported without delay
+				plantID, err := w.parseActuatorTopic(msg.Topic(), w.getSprinklersTopic())
+				if err != nil {
+					apply()
 
-				return
-			}
+					return
+				}
 
-			hub, ok := gateway.Peers()[peerID]
-			if !ok {
-				gateway.errs <- ErrNoSuchRoom
+				w.sprinklerDebouncer.submit(plantID, apply)
+			},
+		},
+		{
+			deviceType: DeviceTypeDehumidifier,
+			filter:     w.getDehumidifiersTopic(),
+			handle: func(client mqtt.Client, msg mqtt.Message) {
+				w.dispatchCommand(DeviceTypeDehumidifier, msg.Topic(), func() {
+					w.handleActuatorCommand(
+						ctx,
+						msg,
+						DeviceTypeDehumidifier,
+						w.getDehumidifiersTopic(),
+						&w.dehumidifiersLock,
+						w.dehumidifiers,
+						ErrNoSuchRoom,
+						"roomID",
+						func(hub HubRemote) func(ctx context.Context, id string, on bool) error {
+							return hub.SetDehumidifierOn
+						},
+						w.PublishDehumidifierState,
+						w.getDehumidifierAckTopic,
+					)
+				})
+			},
+		},
+		{
+			deviceType: DeviceTypeLamp,
+			filter:     w.getLampsTopic(),
+			handle: func(client mqtt.Client, msg mqtt.Message) {
+				w.dispatchCommand(DeviceTypeLamp, msg.Topic(), func() {
+					w.handleActuatorCommand(
+						ctx,
+						msg,
+						DeviceTypeLamp,
+						w.getLampsTopic(),
+						&w.lampsLock,
+						w.lamps,
+						ErrNoSuchRoom,
+						"roomID",
+						func(hub HubRemote) func(ctx context.Context, id string, on bool) error {
+							return hub.SetLampOn
+						},
+						w.PublishLampState,
+						w.getLampAckTopic,
+					)
+				})
+			},
+		},
+		{
+			deviceType: DeviceTypeDoser,
+			filter:     w.getDosersTopic(),
+			handle: func(client mqtt.Client, msg mqtt.Message) {
+				w.dispatchCommand(DeviceTypeDoser, msg.Topic(), func() {
+					w.handleActuatorCommand(
+						ctx,
+						msg,
+						DeviceTypeDoser,
+						w.getDosersTopic(),
+						&w.dosersLock,
+						w.dosers,
+						ErrNoSuchPlant,
+						"plantID",
+						func(hub HubRemote) func(ctx context.Context, id string, on bool) error {
+							return hub.SetDoserOn
+						},
+						w.PublishDoserState,
+						w.getDoserAckTopic,
+					)
+				})
+			},
+		},
+	})
+}
 
-				return
-			}
+// subscribeCommands subscribes to the filter of each route. The multi-level wildcard that multi-segment IDs require
+// must be the last topic level, so routes below the same root share a subscription and are dispatched by their suffix.
+func (w *Gateway) subscribeCommands(routes []commandRoute) error {
+	if w.redeliveries != nil {
+		for i, route := range routes {
+			handle := route.handle
 
-			fanState := &mqttapi.FanState{}
-			if err := json.Unmarshal(msg.Payload(), &fanState); err != nil {
-				gateway.errs <- err
+			routes[i].handle = func(client mqtt.Client, msg mqtt.Message) {
+				if w.redeliveries.redelivered(msg) {
+					w.log.Debug("Suppressing redelivered command", "topic", msg.Topic(), "messageID", msg.MessageID())
 
-				return
+					return
+				}
+
+				handle(client, msg)
+			}
+		}
+	}
+
+	if !w.multiSegmentIDs {
+		for _, route := range routes {
+			if token := w.broker.Subscribe(
+				w.getSharedFilter(route.filter),
+				w.getSubscribeQoS(route.deviceType),
+				route.handle,
+			); token.Wait() && token.Error() != nil {
+				return token.Error()
 			}
+		}
+
+		return nil
+	}
 
-			if err := hub.SetFanOn(ctx, roomID, fanState.On); err != nil {
-				gateway.errs <- err
+	roots := []string{}
+	routesByRoot := map[string][]commandRoute{}
+	for _, route := range routes {
+		root := getSubscriptionFilter(route.filter, true)
+		if _, ok := routesByRoot[root]; !ok {
+			roots = append(roots, root)
+		}
 
-				return
+		routesByRoot[root] = append(routesByRoot[root], route)
+	}
+
+	for _, root := range roots {
+		routes := routesByRoot[root]
+
+		// Routes that share a subscription get the highest QoS that any of them needs
+		qos := byte(0)
+		for _, route := range routes {
+			if routeQoS := w.getSubscribeQoS(route.deviceType); routeQoS > qos {
+				qos = routeQoS
 			}
-		},
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+		}
+
+		if token := w.broker.Subscribe(
+			w.getSharedFilter(root),
+			qos,
+			func(client mqtt.Client, msg mqtt.Message) {
+				for _, route := range routes {
+					prefix, suffix, _ := strings.Cut(route.filter, topics.Wildcard)
+					if matchesMultiSegmentTopic(msg.Topic(), prefix, suffix) {
+						route.handle(client, msg)
+
+						return
+					}
+				}
+
+				// The root also matches measurements, states and acknowledgements, which aren't commands
+			},
+		); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
 	}
 
-	if token := gateway.broker.Subscribe(
-		path.Join("/gateways", gateway.thingName, "plants", "+", "sprinkler"),
-		0,
-		func(client mqtt.Client, msg mqtt.Message) {
-			gateway.sprinklersLock.Lock()
-			defer gateway.sprinklersLock.Unlock()
+	return nil
+}
 
-			basePath, _ := path.Split(msg.Topic())
+func (w *Gateway) getSharedFilter(filter string) string {
+	if w.sharedSubscriptionGroup == "" {
+		return filter
+	}
 
-			plantID := path.Base(basePath)
+	return topics.Shared(w.sharedSubscriptionGroup, filter)
+}
 
-			peerID, ok := gateway.sprinklers[plantID]
-			if !ok {
-				gateway.errs <- ErrNoSuchPlant
+// getSubscriptionTopics returns the topics that `subscribe` subscribes to, without duplicates
+func (w *Gateway) getSubscriptionTopics() []string {
+	subscriptionTopics := []string{}
+	for _, filter := range []string{
+		w.getFansTopic(),
+		w.getZoneFansTopic(),
+		w.getSprinklersTopic(),
+		w.getDehumidifiersTopic(),
+		w.getLampsTopic(),
+		w.getDosersTopic(),
+	} {
+		topic := w.getSharedFilter(getSubscriptionFilter(filter, w.multiSegmentIDs))
+		if !slices.Contains(subscriptionTopics, topic) {
+			subscriptionTopics = append(subscriptionTopics, topic)
+		}
+	}
 
-				return
-			}
+	return subscriptionTopics
+}
 
-			hub, ok := gateway.Peers()[peerID]
-			if !ok {
-				gateway.errs <- ErrNoSuchPlant
+// OnConnect restores the subscriptions of an open gateway after the broker connection has been (re)established. Brokers
+// created by `NewGatewayWithBroker` call it on their own; brokers passed to `NewGateway` must call it from their `OnConnect` handler.
+func (w *Gateway) OnConnect(client mqtt.Client) {
+	w.resubscribe()
+}
 
-				return
-			}
+func (w *Gateway) resubscribe() {
+	w.lifecycleLock.Lock()
+	defer w.lifecycleLock.Unlock()
+
+	if !w.opened || w.closed {
+		return
+	}
 
-			sprinklerState := &mqttapi.SprinklerState{}
-			if err := json.Unmarshal(msg.Payload(), &sprinklerState); err != nil {
-				gateway.errs <- err
+	w.log.Debug("Reconnected to broker, resubscribing")
 
-				return
-			}
+	// Subscribing to the same topic again replaces the existing handler, so this doesn't duplicate callbacks
+	if err := w.subscribe(w.openCtx); err != nil {
+		w.reportError(err)
+
+		return
+	}
 
-			if err := hub.SetSprinklerOn(ctx, plantID, sprinklerState.On); err != nil {
-				gateway.errs <- err
+	if err := w.publishGatewayStatus(mqttapi.GatewayStatusOnline); err != nil {
+		w.reportError(err)
+	}
+}
 
-				return
+func OpenGateway(gateway *Gateway, ctx context.Context) error {
+	gateway.lifecycleLock.Lock()
+	defer gateway.lifecycleLock.Unlock()
+
+	if gateway.opened {
+		return ErrAlreadyOpen
+	}
+
+	if !gateway.hasPeers() {
+		return ErrNoPeers
+	}
+
+	if err := gateway.subscribe(ctx); err != nil {
+		// `CloseGateway` can't clean up a gateway that hasn't been opened, so we drop the subscriptions that succeeded here
+		if token := gateway.broker.Unsubscribe(
+			gateway.getSubscriptionTopics()...,
+		); token.Wait() && token.Error() != nil {
+			err = errors.Join(err, token.Error())
+		}
+
+		return err
+	}
+
+	// Commands that arrived while subscribing are queued until the workers have started
+	gateway.startCommandWorkers()
+
+	gateway.openCtx = ctx
+
+	if gateway.buffer != nil {
+		gateway.workerWg.Add(1)
+
+		go func() {
+			defer gateway.workerWg.Done()
+
+			for {
+				select {
+				case <-gateway.ctx.Done():
+					return
+
+				case <-gateway.clock.After(gateway.flushInterval):
+					gateway.flushMeasurements()
+				}
 			}
-		},
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+		}()
 	}
 
-	return nil
+	if gateway.heartbeatInterval > 0 {
+		gateway.workerWg.Add(1)
+
+		go func() {
+			defer gateway.workerWg.Done()
+
+			gateway.sendHeartbeats()
+		}()
+	}
+
+	gateway.opened = true
+
+	return gateway.publishGatewayStatus(mqttapi.GatewayStatusOnline)
 }
 
 func WaitGateway(gateway *Gateway) error {
@@ -271,20 +4061,148 @@ func WaitGateway(gateway *Gateway) error {
 	return nil
 }
 
+func WaitGatewayContext(ctx context.Context, gateway *Gateway) error {
+	for {
+		select {
+		case <-ctx.Done():
+			// We don't close `gateway.errs` here so that `CloseGateway` can still close it safely
+			return ctx.Err()
+
+		case err, ok := <-gateway.errs:
+			if !ok {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// RunGateway opens the gateway, handles its errors according to its `ErrorPolicy` until `ctx` is cancelled and closes it again.
+// Cancelling `ctx` is a graceful shutdown, so only errors that occurred while running or closing are returned.
+func RunGateway(ctx context.Context, gateway *Gateway) error {
+	if err := OpenGateway(gateway, ctx); err != nil {
+		return err
+	}
+
+	var runErr error
+	for {
+		err := WaitGatewayContext(ctx, gateway)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+
+		if gateway.errorPolicy == ErrorPolicyFailFast {
+			runErr = err
+
+			break
+		}
+
+		gateway.log.Warn("Gateway error, continuing", "err", err)
+	}
+
+	closeErr := CloseGateway(gateway)
+	if errors.Is(closeErr, ErrNotOpen) {
+		// The gateway has already been closed elsewhere, which is why `gateway.errs` was closed
+		closeErr = nil
+	}
+
+	// Keep draining so that callbacks that are still in flight never have their errors dropped silently
+	go func() {
+		for err := range gateway.errs {
+			gateway.log.Debug("Gateway error after close", "err", err)
+		}
+	}()
+
+	return errors.Join(runErr, closeErr)
+}
+
 func CloseGateway(gateway *Gateway) error {
-	if token := gateway.broker.Unsubscribe(
-		path.Join("/gateways", gateway.thingName, "rooms", "+", "fan"),
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+	gateway.lifecycleLock.Lock()
+	defer gateway.lifecycleLock.Unlock()
+
+	if !gateway.opened || gateway.closed {
+		return ErrNotOpen
+	}
+
+	// The broker may already be unreachable, so we tear down regardless and return these errors afterwards;
+	// otherwise the gateway could never be closed and `WaitGateway` would never return
+	var closeErr error
+	if err := gateway.publishGatewayStatus(mqttapi.GatewayStatusOffline); err != nil {
+		closeErr = err
 	}
 
 	if token := gateway.broker.Unsubscribe(
-		path.Join("/gateways", gateway.thingName, "rooms", "+", "sprinkler"),
+		gateway.getSubscriptionTopics()...,
 	); token.Wait() && token.Error() != nil {
-		return token.Error()
+		closeErr = errors.Join(closeErr, token.Error())
 	}
 
-	close(gateway.errs)
+	gateway.closed = true
 
-	return nil
+	gateway.callbacksLock.Lock()
+	gateway.closing = true
+	gateway.callbacksLock.Unlock()
+
+	gateway.cancel()
+
+	gateway.stopStaleTemperatureTimers()
+
+	if gateway.sprinklerDebouncer != nil {
+		gateway.sprinklerDebouncer.close()
+	}
+
+	gateway.dwell.close()
+
+	if gateway.pendingCommands != nil {
+		gateway.pendingCommands.close()
+	}
+
+	if gateway.batcher != nil {
+		gateway.batcher.close()
+	}
+
+	if gateway.limiter != nil {
+		gateway.limiter.close()
+	}
+
+	gateway.workerWg.Wait()
+
+	drained := make(chan struct{})
+	go func() {
+		gateway.callbacksWg.Wait()
+
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		close(gateway.commandsStop)
+		gateway.closeErrors()
+
+	case <-gateway.clock.After(gateway.drainTimeout):
+		gateway.log.Warn("Timed out waiting for in-flight commands, closing in the background", "timeout", gateway.drainTimeout)
+
+		// The hung callbacks may still report errors, so we only close `gateway.errs` once they have returned
+		go func() {
+			<-drained
+
+			close(gateway.commandsStop)
+			gateway.closeErrors()
+		}()
+
+		if gateway.ownedBroker != nil {
+			gateway.ownedBroker.Disconnect(1000)
+		}
+
+		return errors.Join(closeErr, ErrDrainTimedOut)
+	}
+
+	if gateway.ownedBroker != nil {
+		gateway.ownedBroker.Disconnect(1000)
+	}
+
+	return closeErr
 }
@@ -0,0 +1,482 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchGateway         = errors.New("no such gateway")
+	ErrGatewayAlreadyGrouped = errors.New("gateway with this thing name is already part of the group")
+)
+
+type GatewayGroupRemote struct {
+	RegisterFans                   func(ctx context.Context, thingName string, roomIDs []string) error
+	UnregisterFans                 func(ctx context.Context, thingName string, roomIDs []string) error
+	ForwardTemperatureMeasurement  func(ctx context.Context, thingName string, roomID string, measurement, defaultValue int) error
+	ForwardTemperatureMeasurements func(ctx context.Context, thingName string, measurements map[string]Measurement) error
+
+	RegisterFansPattern    func(ctx context.Context, thingName string, prefix string, from, to int) error
+	RegisterFansInZone     func(ctx context.Context, thingName string, zoneID string, roomIDs []string) error
+	RegisterFansWithMeta   func(ctx context.Context, thingName string, meta map[string]FanMeta) error
+	UnregisterFansMatching func(ctx context.Context, thingName string, pattern string) (int, error)
+
+	ForwardTemperatureMeasurementFloat     func(ctx context.Context, thingName string, roomID string, measurement, defaultValue float64) error
+	ForwardTemperatureMeasurementWithUnit  func(ctx context.Context, thingName string, roomID string, measurement, defaultValue int, unit string) error
+	ForwardTemperatureMeasurementConfirmed func(ctx context.Context, thingName string, roomID string, measurement, defaultValue int) error
+	ForwardTemperatureMeasurementAt        func(ctx context.Context, thingName string, roomID string, measurement, defaultValue int, takenAt time.Time) error
+	ForwardTemperatureMeasurementTo        func(ctx context.Context, thingName string, roomID string, targetTopic string, measurement, defaultValue int) error
+
+	RegisterSprinklers          func(ctx context.Context, thingName string, plantIDs []string) error
+	UnregisterSprinklers        func(ctx context.Context, thingName string, plantIDs []string) error
+	ForwardMoistureMeasurement  func(ctx context.Context, thingName string, plantID string, measurement, defaultValue int) error
+	ForwardMoistureMeasurements func(ctx context.Context, thingName string, measurements map[string]Measurement) error
+
+	RegisterSprinklersWithMeta func(ctx context.Context, thingName string, meta map[string]SprinklerMeta) error
+
+	ForwardMoistureMeasurementAt func(ctx context.Context, thingName string, plantID string, measurement, defaultValue int, takenAt time.Time) error
+
+	RegisterDehumidifiers       func(ctx context.Context, thingName string, roomIDs []string) error
+	UnregisterDehumidifiers     func(ctx context.Context, thingName string, roomIDs []string) error
+	ForwardHumidityMeasurement  func(ctx context.Context, thingName string, roomID string, measurement, defaultValue int) error
+	ForwardHumidityMeasurements func(ctx context.Context, thingName string, measurements map[string]Measurement) error
+
+	RegisterLamps            func(ctx context.Context, thingName string, roomIDs []string) error
+	UnregisterLamps          func(ctx context.Context, thingName string, roomIDs []string) error
+	ForwardLightMeasurement  func(ctx context.Context, thingName string, roomID string, measurement, defaultValue int) error
+	ForwardLightMeasurements func(ctx context.Context, thingName string, measurements map[string]Measurement) error
+
+	RegisterDosers        func(ctx context.Context, thingName string, plantIDs []string) error
+	UnregisterDosers      func(ctx context.Context, thingName string, plantIDs []string) error
+	ForwardPHMeasurement  func(ctx context.Context, thingName string, plantID string, measurement, defaultValue int) error
+	ForwardPHMeasurements func(ctx context.Context, thingName string, measurements map[string]Measurement) error
+
+	RegisterRoom   func(ctx context.Context, thingName string, roomID string, capabilities []string) error
+	UnregisterRoom func(ctx context.Context, thingName string, roomID string) error
+
+	UnregisterAllForPeer func(ctx context.Context) error
+}
+
+type GatewayGroup struct {
+	gateways    map[string]*Gateway
+	sharesPeers bool
+
+	Peers func() map[string]HubRemote
+}
+
+// NewGatewayGroup groups `gateways` by their thing names. Gateways that neither have their own `Peers` nor track
+// their peers share the group's `Peers`, which must then be set before the group is opened.
+func NewGatewayGroup(gateways ...*Gateway) (*GatewayGroup, error) {
+	group := &GatewayGroup{
+		gateways: map[string]*Gateway{},
+	}
+
+	for _, gateway := range gateways {
+		if _, ok := group.gateways[gateway.thingName]; ok {
+			return nil, fmt.Errorf("%w: thingName=%v", ErrGatewayAlreadyGrouped, gateway.thingName)
+		}
+
+		group.gateways[gateway.thingName] = gateway
+
+		if gateway.hasPeers() {
+			continue
+		}
+
+		group.sharesPeers = true
+
+		gateway.Peers = func() map[string]HubRemote {
+			if group.Peers == nil {
+				return map[string]HubRemote{}
+			}
+
+			return group.Peers()
+		}
+	}
+
+	return group, nil
+}
+
+func (g *GatewayGroup) getGateway(thingName string) (*Gateway, error) {
+	gateway, ok := g.gateways[thingName]
+	if !ok {
+		return nil, fmt.Errorf("%w: thingName=%v", ErrNoSuchGateway, thingName)
+	}
+
+	return gateway, nil
+}
+
+func (g *GatewayGroup) RegisterFans(ctx context.Context, thingName string, roomIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterFans(ctx, roomIDs)
+}
+
+func (g *GatewayGroup) UnregisterFans(ctx context.Context, thingName string, roomIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.UnregisterFans(ctx, roomIDs)
+}
+
+func (g *GatewayGroup) ForwardTemperatureMeasurement(ctx context.Context, thingName string, roomID string, measurement, defaultValue int) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardTemperatureMeasurement(ctx, roomID, measurement, defaultValue)
+}
+
+func (g *GatewayGroup) ForwardTemperatureMeasurements(ctx context.Context, thingName string, measurements map[string]Measurement) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardTemperatureMeasurements(ctx, measurements)
+}
+
+func (g *GatewayGroup) RegisterFansPattern(ctx context.Context, thingName string, prefix string, from, to int) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterFansPattern(ctx, prefix, from, to)
+}
+
+func (g *GatewayGroup) RegisterFansInZone(ctx context.Context, thingName string, zoneID string, roomIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterFansInZone(ctx, zoneID, roomIDs)
+}
+
+func (g *GatewayGroup) RegisterFansWithMeta(ctx context.Context, thingName string, meta map[string]FanMeta) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterFansWithMeta(ctx, meta)
+}
+
+func (g *GatewayGroup) UnregisterFansMatching(ctx context.Context, thingName string, pattern string) (int, error) {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return 0, err
+	}
+
+	return gateway.UnregisterFansMatching(ctx, pattern)
+}
+
+func (g *GatewayGroup) ForwardTemperatureMeasurementFloat(ctx context.Context, thingName string, roomID string, measurement, defaultValue float64) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardTemperatureMeasurementFloat(ctx, roomID, measurement, defaultValue)
+}
+
+func (g *GatewayGroup) ForwardTemperatureMeasurementWithUnit(ctx context.Context, thingName string, roomID string, measurement, defaultValue int, unit string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardTemperatureMeasurementWithUnit(ctx, roomID, measurement, defaultValue, unit)
+}
+
+func (g *GatewayGroup) ForwardTemperatureMeasurementConfirmed(ctx context.Context, thingName string, roomID string, measurement, defaultValue int) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardTemperatureMeasurementConfirmed(ctx, roomID, measurement, defaultValue)
+}
+
+func (g *GatewayGroup) ForwardTemperatureMeasurementAt(ctx context.Context, thingName string, roomID string, measurement, defaultValue int, takenAt time.Time) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardTemperatureMeasurementAt(ctx, roomID, measurement, defaultValue, takenAt)
+}
+
+func (g *GatewayGroup) ForwardTemperatureMeasurementTo(ctx context.Context, thingName string, roomID string, targetTopic string, measurement, defaultValue int) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardTemperatureMeasurementTo(ctx, roomID, targetTopic, measurement, defaultValue)
+}
+
+func (g *GatewayGroup) RegisterSprinklers(ctx context.Context, thingName string, plantIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterSprinklers(ctx, plantIDs)
+}
+
+func (g *GatewayGroup) UnregisterSprinklers(ctx context.Context, thingName string, plantIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.UnregisterSprinklers(ctx, plantIDs)
+}
+
+func (g *GatewayGroup) ForwardMoistureMeasurement(ctx context.Context, thingName string, plantID string, measurement, defaultValue int) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardMoistureMeasurement(ctx, plantID, measurement, defaultValue)
+}
+
+func (g *GatewayGroup) ForwardMoistureMeasurements(ctx context.Context, thingName string, measurements map[string]Measurement) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardMoistureMeasurements(ctx, measurements)
+}
+
+func (g *GatewayGroup) ForwardMoistureMeasurementAt(ctx context.Context, thingName string, plantID string, measurement, defaultValue int, takenAt time.Time) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardMoistureMeasurementAt(ctx, plantID, measurement, defaultValue, takenAt)
+}
+
+func (g *GatewayGroup) RegisterSprinklersWithMeta(ctx context.Context, thingName string, meta map[string]SprinklerMeta) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterSprinklersWithMeta(ctx, meta)
+}
+
+func (g *GatewayGroup) RegisterDehumidifiers(ctx context.Context, thingName string, roomIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterDehumidifiers(ctx, roomIDs)
+}
+
+func (g *GatewayGroup) UnregisterDehumidifiers(ctx context.Context, thingName string, roomIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.UnregisterDehumidifiers(ctx, roomIDs)
+}
+
+func (g *GatewayGroup) ForwardHumidityMeasurement(ctx context.Context, thingName string, roomID string, measurement, defaultValue int) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardHumidityMeasurement(ctx, roomID, measurement, defaultValue)
+}
+
+func (g *GatewayGroup) ForwardHumidityMeasurements(ctx context.Context, thingName string, measurements map[string]Measurement) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardHumidityMeasurements(ctx, measurements)
+}
+
+func (g *GatewayGroup) RegisterLamps(ctx context.Context, thingName string, roomIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterLamps(ctx, roomIDs)
+}
+
+func (g *GatewayGroup) UnregisterLamps(ctx context.Context, thingName string, roomIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.UnregisterLamps(ctx, roomIDs)
+}
+
+func (g *GatewayGroup) ForwardLightMeasurement(ctx context.Context, thingName string, roomID string, measurement, defaultValue int) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardLightMeasurement(ctx, roomID, measurement, defaultValue)
+}
+
+func (g *GatewayGroup) ForwardLightMeasurements(ctx context.Context, thingName string, measurements map[string]Measurement) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardLightMeasurements(ctx, measurements)
+}
+
+func (g *GatewayGroup) RegisterDosers(ctx context.Context, thingName string, plantIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterDosers(ctx, plantIDs)
+}
+
+func (g *GatewayGroup) UnregisterDosers(ctx context.Context, thingName string, plantIDs []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.UnregisterDosers(ctx, plantIDs)
+}
+
+func (g *GatewayGroup) ForwardPHMeasurement(ctx context.Context, thingName string, plantID string, measurement, defaultValue int) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardPHMeasurement(ctx, plantID, measurement, defaultValue)
+}
+
+func (g *GatewayGroup) ForwardPHMeasurements(ctx context.Context, thingName string, measurements map[string]Measurement) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.ForwardPHMeasurements(ctx, measurements)
+}
+
+func (g *GatewayGroup) RegisterRoom(ctx context.Context, thingName string, roomID string, capabilities []string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.RegisterRoom(ctx, roomID, capabilities)
+}
+
+func (g *GatewayGroup) UnregisterRoom(ctx context.Context, thingName string, roomID string) error {
+	gateway, err := g.getGateway(thingName)
+	if err != nil {
+		return err
+	}
+
+	return gateway.UnregisterRoom(ctx, roomID)
+}
+
+func (g *GatewayGroup) UnregisterAllForPeer(ctx context.Context) error {
+	errs := []error{}
+	for _, gateway := range g.gateways {
+		if err := gateway.UnregisterAllForPeer(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// OpenGatewayGroup opens all gateways of the group; if one of them can't be opened, the ones that have already been opened are closed again
+func OpenGatewayGroup(group *GatewayGroup, ctx context.Context) error {
+	if group.sharesPeers && group.Peers == nil {
+		return ErrNoPeers
+	}
+
+	opened := []*Gateway{}
+	for _, gateway := range group.gateways {
+		if err := OpenGateway(gateway, ctx); err != nil {
+			errs := []error{err}
+			for _, gateway := range opened {
+				if err := CloseGateway(gateway); err != nil {
+					errs = append(errs, err)
+				}
+			}
+
+			return errors.Join(errs...)
+		}
+
+		opened = append(opened, gateway)
+	}
+
+	return nil
+}
+
+func WaitGatewayGroup(group *GatewayGroup) error {
+	errs := make(chan error, len(group.gateways))
+
+	var wg sync.WaitGroup
+	for _, gateway := range group.gateways {
+		wg.Add(1)
+
+		go func(gateway *Gateway) {
+			defer wg.Done()
+
+			errs <- WaitGateway(gateway)
+		}(gateway)
+	}
+
+	go func() {
+		wg.Wait()
+
+		close(errs)
+	}()
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func CloseGatewayGroup(group *GatewayGroup) error {
+	errs := []error{}
+	for _, gateway := range group.gateways {
+		if err := CloseGateway(gateway); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
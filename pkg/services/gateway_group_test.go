@@ -0,0 +1,124 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+	"github.com/pojntfx/green-guardian-gateway/pkg/testutil"
+)
+
+func newGroupedGateway(t *testing.T, broker *testutil.FakeBroker, thingName string) *services.Gateway {
+	t.Helper()
+
+	gateway, err := services.NewGateway(false, context.Background(), broker, thingName, &services.GatewayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gateway
+}
+
+func TestNewGatewayGroupRejectsDuplicateThingNames(t *testing.T) {
+	if _, err := services.NewGatewayGroup(
+		newGroupedGateway(t, testutil.NewFakeBroker(), "a"),
+		newGroupedGateway(t, testutil.NewFakeBroker(), "a"),
+	); !errors.Is(err, services.ErrGatewayAlreadyGrouped) {
+		t.Fatalf("expected %v, got %v", services.ErrGatewayAlreadyGrouped, err)
+	}
+}
+
+func TestOpenGatewayGroupRequiresPeers(t *testing.T) {
+	group, err := services.NewGatewayGroup(newGroupedGateway(t, testutil.NewFakeBroker(), "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := services.OpenGatewayGroup(group, context.Background()); !errors.Is(err, services.ErrNoPeers) {
+		t.Fatalf("expected %v, got %v", services.ErrNoPeers, err)
+	}
+}
+
+func TestGatewayGroupKeepsOwnPeers(t *testing.T) {
+	ownBroker := testutil.NewFakeBroker()
+	ownHub := testutil.NewFakeHub()
+
+	own := newGroupedGateway(t, ownBroker, "own")
+	own.Peers = func() map[string]services.HubRemote {
+		return map[string]services.HubRemote{testPeerID: ownHub.Remote()}
+	}
+
+	sharedBroker := testutil.NewFakeBroker()
+	sharedHub := testutil.NewFakeHub()
+
+	group, err := services.NewGatewayGroup(own, newGroupedGateway(t, sharedBroker, "shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group.Peers = func() map[string]services.HubRemote {
+		return map[string]services.HubRemote{testPeerID: sharedHub.Remote()}
+	}
+
+	if err := services.OpenGatewayGroup(group, getPeerContext()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, thingName := range []string{"own", "shared"} {
+		if err := group.RegisterFans(getPeerContext(), thingName, []string{"1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publishCommand(ownBroker, "/gateways/own/rooms/1/fan", true)
+	publishCommand(sharedBroker, "/gateways/shared/rooms/1/fan", true)
+
+	if err := services.CloseGatewayGroup(group); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := ownHub.Calls(); len(calls) != 1 {
+		t.Fatalf("expected the command for the gateway with its own peers to reach its hub, got %v", calls)
+	}
+
+	if calls := sharedHub.Calls(); len(calls) != 1 {
+		t.Fatalf("expected the command for the gateway with the group's peers to reach the group's hub, got %v", calls)
+	}
+}
+
+func TestOpenGatewayGroupClosesOpenedGatewaysOnFailure(t *testing.T) {
+	brokers := []*testutil.FakeBroker{testutil.NewFakeBroker(), testutil.NewFakeBroker(), testutil.NewFakeBroker()}
+
+	errBrokerGone := errors.New("broker is gone")
+	brokers[1].SubscribeErr = errBrokerGone
+
+	gateways := []*services.Gateway{
+		newGroupedGateway(t, brokers[0], "a"),
+		newGroupedGateway(t, brokers[1], "b"),
+		newGroupedGateway(t, brokers[2], "c"),
+	}
+
+	group, err := services.NewGatewayGroup(gateways...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group.Peers = func() map[string]services.HubRemote {
+		return map[string]services.HubRemote{testPeerID: testutil.NewFakeHub().Remote()}
+	}
+
+	if err := services.OpenGatewayGroup(group, getPeerContext()); !errors.Is(err, errBrokerGone) {
+		t.Fatalf("expected %v, got %v", errBrokerGone, err)
+	}
+
+	for i, gateway := range gateways {
+		if got := brokers[i].Subscriptions(); len(got) != 0 {
+			t.Fatalf("expected no subscriptions to be left on broker %v, got %v", i, got)
+		}
+
+		if err := services.CloseGateway(gateway); !errors.Is(err, services.ErrNotOpen) {
+			t.Fatalf("expected gateway %v to be closed or never opened, got %v", i, err)
+		}
+	}
+}
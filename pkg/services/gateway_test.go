@@ -0,0 +1,493 @@
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+	"github.com/pojntfx/green-guardian-gateway/pkg/testutil"
+)
+
+const (
+	testThingName = "test"
+	testPeerID    = "hub"
+)
+
+func newTestGateway(t *testing.T, broker *testutil.FakeBroker, hub services.HubRemote, options *services.GatewayOptions) *services.Gateway {
+	t.Helper()
+
+	if options == nil {
+		options = &services.GatewayOptions{}
+	}
+
+	gateway, err := services.NewGateway(false, context.Background(), broker, testThingName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway.Peers = func() map[string]services.HubRemote {
+		return map[string]services.HubRemote{
+			testPeerID: hub,
+		}
+	}
+
+	return gateway
+}
+
+// openTestGateway opens a gateway on `broker` whose only peer is `hub` and closes it when the test is done
+func openTestGateway(t *testing.T, broker *testutil.FakeBroker, hub services.HubRemote, options *services.GatewayOptions) *services.Gateway {
+	t.Helper()
+
+	gateway := newTestGateway(t, broker, hub, options)
+	if err := services.OpenGateway(gateway, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := services.CloseGateway(gateway); err != nil && !errors.Is(err, services.ErrNotOpen) {
+			t.Error(err)
+		}
+	})
+
+	return gateway
+}
+
+func getPeerContext() context.Context {
+	return services.WithPeerID(context.Background(), testPeerID)
+}
+
+// waitFor fails the test if `condition` isn't met within a second, since commands are applied in the background
+func waitFor(t *testing.T, condition func() bool, description string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", description)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func publishCommand(broker *testutil.FakeBroker, topic string, on bool) {
+	broker.Publish(topic, 0, false, []byte(fmt.Sprintf(`{"on":%v}`, on)))
+}
+
+type errorRecorder struct {
+	errs []error
+
+	lock sync.Mutex
+}
+
+func (r *errorRecorder) record(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.errs = append(r.errs, err)
+}
+
+func (r *errorRecorder) get() []error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]error{}, r.errs...)
+}
+
+func TestForwardTemperatureMeasurementToRejectsForeignTopics(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	gateway := openTestGateway(t, broker, testutil.NewFakeHub().Remote(), nil)
+
+	for _, topic := range []string{
+		"",
+		"/gateways/other/rooms/1/temperature",
+		"/gateways/test",
+		"/gateways/test/",
+		"/gateways/test/../other/status",
+		"/gateways/test//temperature",
+		"/gateways/test/rooms/+/temperature",
+		"/gateways/test/#",
+		"$SYS/broker",
+		"/gateways/test/status",
+		"/gateways/test/shadow",
+		"/gateways/test/heartbeat",
+		"/gateways/test/registrations",
+		"/gateways/test/events/registration",
+		"/gateways/test/rooms/1/fan",
+		"/gateways/test/rooms/1/fan/state",
+		"/gateways/test/zones/1/fan",
+		"/gateways/test/plants/1/sprinkler",
+		"/gateways/test/plants/1/sprinkler/ack",
+	} {
+		t.Run(topic, func(t *testing.T) {
+			if err := gateway.ForwardTemperatureMeasurementTo(getPeerContext(), "1", topic, 24, 20); !errors.Is(err, services.ErrInvalidTopic) {
+				t.Fatalf("expected %v, got %v", services.ErrInvalidTopic, err)
+			}
+		})
+	}
+
+	for _, message := range broker.Published() {
+		if message.Topic != "/gateways/test/status" {
+			t.Fatalf("expected no measurements to be published, got one on %v", message.Topic)
+		}
+	}
+
+	if err := gateway.ForwardTemperatureMeasurementTo(getPeerContext(), "1", "/gateways/test/debug/temperature", 24, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	published := broker.Published()
+	if got := published[len(published)-1].Topic; got != "/gateways/test/debug/temperature" {
+		t.Fatalf("expected the measurement to be published to the target topic, got %v", got)
+	}
+}
+
+func TestInvalidIDsAreRejected(t *testing.T) {
+	for _, multiSegmentIDs := range []bool{false, true} {
+		for _, id := range []string{
+			"",
+			".",
+			"..",
+			"../other",
+			"room/+",
+			"room/#",
+			"room/../other",
+			"room//other",
+			"room/",
+		} {
+			t.Run(fmt.Sprintf("multiSegmentIDs=%v/id=%q", multiSegmentIDs, id), func(t *testing.T) {
+				broker := testutil.NewFakeBroker()
+				gateway := openTestGateway(t, broker, testutil.NewFakeHub().Remote(), &services.GatewayOptions{
+					MultiSegmentIDs: multiSegmentIDs,
+				})
+
+				// Valid IDs in the same batch must not be registered either
+				if err := gateway.RegisterFans(getPeerContext(), []string{"1", id}); !errors.Is(err, services.ErrInvalidID) {
+					t.Fatalf("expected %v from RegisterFans, got %v", services.ErrInvalidID, err)
+				}
+
+				if err := gateway.RegisterSprinklers(getPeerContext(), []string{"1", id}); !errors.Is(err, services.ErrInvalidID) {
+					t.Fatalf("expected %v from RegisterSprinklers, got %v", services.ErrInvalidID, err)
+				}
+
+				if fans, sprinklers := gateway.ListFans(), gateway.ListSprinklers(); len(fans) != 0 || len(sprinklers) != 0 {
+					t.Fatalf("expected nothing to be registered, got fans=%v sprinklers=%v", fans, sprinklers)
+				}
+
+				if err := gateway.ForwardTemperatureMeasurement(getPeerContext(), id, 24, 20); !errors.Is(err, services.ErrInvalidID) {
+					t.Fatalf("expected %v from ForwardTemperatureMeasurement, got %v", services.ErrInvalidID, err)
+				}
+
+				if err := gateway.ForwardMoistureMeasurement(getPeerContext(), id, 65, 50); !errors.Is(err, services.ErrInvalidID) {
+					t.Fatalf("expected %v from ForwardMoistureMeasurement, got %v", services.ErrInvalidID, err)
+				}
+
+				for _, message := range broker.Published() {
+					if message.Topic != "/gateways/test/status" {
+						t.Fatalf("expected no measurements to be published, got one on %v", message.Topic)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCustomTopicPrefix(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+
+	gateway := openTestGateway(t, broker, hub.Remote(), &services.GatewayOptions{
+		TopicPrefix: "/tenants/acme/gateways",
+	})
+
+	subscriptions := broker.Subscriptions()
+	if len(subscriptions) == 0 {
+		t.Fatal("expected the gateway to subscribe to its command topics")
+	}
+
+	for _, topic := range subscriptions {
+		if !strings.HasPrefix(topic, "/tenants/acme/gateways/test/") {
+			t.Fatalf("expected all subscriptions to be below the custom prefix, got %v", topic)
+		}
+	}
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commands for the default prefix are meant for another gateway
+	publishCommand(broker, "/gateways/test/rooms/1/fan", false)
+	publishCommand(broker, "/tenants/acme/gateways/test/rooms/1/fan", true)
+
+	waitFor(t, func() bool { return len(hub.Calls()) > 0 }, "the fan command to reach the hub")
+
+	if calls := hub.Calls(); len(calls) != 1 || calls[0] != (testutil.Call{Method: "SetFanOn", ID: "1", On: true}) {
+		t.Fatalf("expected only the command below the custom prefix to reach the hub, got %v", calls)
+	}
+
+	if err := gateway.ForwardTemperatureMeasurement(getPeerContext(), "1", 24, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range broker.Published() {
+		if !strings.HasPrefix(message.Topic, "/tenants/acme/gateways/test/") && message.Topic != "/gateways/test/rooms/1/fan" {
+			t.Fatalf("expected all messages to be published below the custom prefix, got one on %v", message.Topic)
+		}
+	}
+
+	published := broker.Published()
+	if got := published[len(published)-1].Topic; got != "/tenants/acme/gateways/test/rooms/1/temperature" {
+		t.Fatalf("expected the measurement to be published below the custom prefix, got %v", got)
+	}
+}
+
+func TestEmptyIDsInCommandTopicsAreRejected(t *testing.T) {
+	for _, multiSegmentIDs := range []bool{false, true} {
+		for _, topic := range []string{
+			"/gateways/test/rooms//fan",
+			"/gateways/test/plants//sprinkler",
+		} {
+			t.Run(fmt.Sprintf("multiSegmentIDs=%v/topic=%v", multiSegmentIDs, topic), func(t *testing.T) {
+				broker := testutil.NewFakeBroker()
+				hub := testutil.NewFakeHub()
+				errs := &errorRecorder{}
+
+				gateway := openTestGateway(t, broker, hub.Remote(), &services.GatewayOptions{
+					MultiSegmentIDs: multiSegmentIDs,
+					OnError:         errs.record,
+				})
+
+				if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := gateway.RegisterSprinklers(getPeerContext(), []string{"1"}); err != nil {
+					t.Fatal(err)
+				}
+
+				publishCommand(broker, topic, true)
+				waitFor(t, func() bool { return len(errs.get()) > 0 }, "the command to be rejected")
+
+				if err := errs.get()[0]; !errors.Is(err, services.ErrMalformedTopic) || errors.Is(err, services.ErrNoSuchRoom) || errors.Is(err, services.ErrNoSuchPlant) {
+					t.Fatalf("expected %v, got %v", services.ErrMalformedTopic, err)
+				}
+
+				if calls := hub.Calls(); len(calls) != 0 {
+					t.Fatalf("expected the command not to reach the hub, got %v", calls)
+				}
+			})
+		}
+	}
+}
+
+func TestOnlyDuplicateCommandsAreSuppressed(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+
+	gateway := openTestGateway(t, broker, hub.Remote(), &services.GatewayOptions{
+		CommandRedeliveryTTL: time.Minute,
+	})
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	command := testutil.Message{
+		Topic:     "/gateways/test/rooms/1/fan",
+		QoS:       1,
+		Payload:   []byte(`{"on":true}`),
+		MessageID: 1,
+	}
+	redelivery := command
+	redelivery.Duplicate = true
+
+	broker.Deliver(command)
+	broker.Deliver(redelivery)
+
+	// The broker reuses the ID once the first command has been acknowledged
+	broker.Deliver(command)
+	broker.Deliver(redelivery)
+
+	if err := services.CloseGateway(gateway); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := hub.Calls(); len(calls) != 2 {
+		t.Fatalf("expected both commands to reach the hub once, got %v", calls)
+	}
+
+	if suppressed := gateway.SuppressedRedeliveries(); suppressed != 2 {
+		t.Fatalf("expected both redeliveries to be suppressed, got %v", suppressed)
+	}
+}
+
+func countPublished(broker *testutil.FakeBroker, topic string) int {
+	count := 0
+	for _, message := range broker.Published() {
+		if message.Topic == topic {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestStaleTemperatureTimersStopWhenRoomsAreUnregistered(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	gateway := openTestGateway(t, broker, testutil.NewFakeHub().Remote(), &services.GatewayOptions{
+		StaleTemperatureTimeout: 10 * time.Millisecond,
+	})
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gateway.ForwardTemperatureMeasurement(getPeerContext(), "1", 24, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rooms that were never registered must not get default values
+	if err := gateway.ForwardTemperatureMeasurement(getPeerContext(), "2", 24, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		return countPublished(broker, "/gateways/test/rooms/1/temperature") > 2
+	}, "default temperatures to be forwarded")
+
+	if err := gateway.UnregisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A timer that fired while unregistering may still publish once
+	time.Sleep(5 * time.Millisecond)
+
+	unregistered := countPublished(broker, "/gateways/test/rooms/1/temperature")
+
+	time.Sleep(50 * time.Millisecond)
+
+	if got := countPublished(broker, "/gateways/test/rooms/1/temperature"); got != unregistered {
+		t.Fatalf("expected no default temperatures after unregistering, got %v more", got-unregistered)
+	}
+
+	if got := countPublished(broker, "/gateways/test/rooms/2/temperature"); got != 1 {
+		t.Fatalf("expected no default temperatures for an unregistered room, got %v measurements", got)
+	}
+}
+
+func TestStalledPublishesTimeOut(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+	errs := &errorRecorder{}
+
+	gateway := openTestGateway(t, broker, hub.Remote(), &services.GatewayOptions{
+		PublishTimeout:            10 * time.Millisecond,
+		RetainActuatorState:       true,
+		PublishRegistrationEvents: true,
+		PublishCommandAcks:        true,
+		OnError:                   errs.record,
+	})
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commands are delivered before the broker stalls, but the acknowledgement and state can't be published anymore
+	command := testutil.Message{
+		Topic:   "/gateways/test/rooms/1/fan",
+		Payload: []byte(`{"on":true}`),
+	}
+	broker.StallPublishes = true
+
+	registered := make(chan error, 1)
+	go func() {
+		registered <- gateway.RegisterFans(getPeerContext(), []string{"2"})
+	}()
+
+	select {
+	case err := <-registered:
+		if !errors.Is(err, services.ErrPublishTimeout) {
+			t.Fatalf("expected %v, got %v", services.ErrPublishTimeout, err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("expected registering to time out while the broker is stalled")
+	}
+
+	broker.Deliver(command)
+	waitFor(t, func() bool { return len(errs.get()) >= 2 }, "the acknowledgement and state publishes to time out")
+
+	for _, err := range errs.get() {
+		if !errors.Is(err, services.ErrPublishTimeout) {
+			t.Fatalf("expected %v, got %v", services.ErrPublishTimeout, err)
+		}
+	}
+
+	if calls := hub.Calls(); len(calls) != 1 {
+		t.Fatalf("expected the command to reach the hub, got %v", calls)
+	}
+}
+
+func TestUnregisteringResetsRateLimitsAndSequences(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	gateway := openTestGateway(t, broker, testutil.NewFakeHub().Remote(), &services.GatewayOptions{
+		RateLimit:      0.001,
+		RateLimitBurst: 1,
+	})
+
+	const topic = "/gateways/test/rooms/1/temperature"
+
+	getSequences := func() []uint64 {
+		sequences := []uint64{}
+		for _, message := range broker.Published() {
+			if message.Topic != topic {
+				continue
+			}
+
+			var measurement mqttapi.TemperatureMeasurement
+			if err := json.Unmarshal(message.Payload, &measurement); err != nil {
+				t.Fatal(err)
+			}
+
+			sequences = append(sequences, measurement.Sequence)
+		}
+
+		return sequences
+	}
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second measurement is held back by the rate limit
+	for i := 0; i < 2; i++ {
+		if err := gateway.ForwardTemperatureMeasurement(getPeerContext(), "1", 24, 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := gateway.UnregisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A room that has been registered again starts with a full bucket and a new sequence
+	if err := gateway.ForwardTemperatureMeasurement(getPeerContext(), "1", 24, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	if sequences := getSequences(); !slices.Equal(sequences, []uint64{1, 1}) {
+		t.Fatalf("expected sequences [1 1], got %v", sequences)
+	}
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+)
+
+func (w *Gateway) publishHeartbeat(sequence uint64) error {
+	msg, err := w.codec.Marshal(mqttapi.Heartbeat{
+		Sequence:  sequence,
+		Timestamp: w.clock.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	msg, err = w.encodePayload(w.getHeartbeatTopic(), msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Debug("Dry run, not publishing heartbeat", "topic", w.getHeartbeatTopic(), "payload", string(msg))
+
+		return nil
+	}
+
+	return w.waitForPublish(w.broker.Publish(
+		w.getHeartbeatTopic(),
+		w.publishQoS,
+		false,
+		msg,
+	), w.getHeartbeatTopic())
+}
+
+// sendHeartbeats publishes a heartbeat in every interval until the gateway is closed
+func (w *Gateway) sendHeartbeats() {
+	var sequence uint64
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+
+		case <-w.clock.After(w.heartbeatInterval):
+			// The sequence also increases for heartbeats that couldn't be published, so consumers can count the missed ones
+			sequence++
+
+			if err := w.publishHeartbeat(sequence); err != nil {
+				w.log.Warn("Could not publish heartbeat", "sequence", sequence, "err", err)
+			}
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gitlab.mi.hdm-stuttgart.de/iotee/go-iotee"
@@ -15,6 +16,9 @@ var (
 	ErrNoSuchRoom  = errors.New("no such room")
 	ErrNoSuchPlant = errors.New("no such plant")
 
+	// ErrUnsupportedActuator can be returned by hubs for actuators that they have registered but can't control
+	ErrUnsupportedActuator = errors.New("actuator not supported by hub")
+
 	ErrTemperatureReadTimedOut = errors.New("temperature read timed out")
 	ErrMoistureReadTimedOut    = errors.New("moisture read timed out")
 )
@@ -22,10 +26,16 @@ var (
 type HubRemote struct {
 	SetFanOn       func(ctx context.Context, roomID string, on bool) error
 	SetSprinklerOn func(ctx context.Context, plantID string, on bool) error
+
+	GetFanState func(ctx context.Context, roomID string) (bool, error)
+
+	SetDehumidifierOn func(ctx context.Context, roomID string, on bool) error
+	SetLampOn         func(ctx context.Context, roomID string, on bool) error
+	SetDoserOn        func(ctx context.Context, plantID string, on bool) error
 }
 
 type Hub struct {
-	verbose bool
+	verbose atomic.Bool
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -35,6 +45,9 @@ type Hub struct {
 	fans               map[string]*iotee.IoTee
 	temperatureSensors map[string]*iotee.IoTee
 
+	fanStates     map[string]bool
+	fanStatesLock sync.Mutex
+
 	defaultTemperature int
 
 	sprinklers      map[string]*iotee.IoTee
@@ -42,6 +55,10 @@ type Hub struct {
 
 	defaultMoisture int
 
+	dehumidifiers map[string]*iotee.IoTee
+	lamps         map[string]*iotee.IoTee
+	dosers        map[string]*iotee.IoTee
+
 	measureInterval,
 	measureTimeout time.Duration
 
@@ -64,6 +81,10 @@ func NewHub(
 	moistureSensors map[string]*iotee.IoTee,
 	defaultMoisture int,
 
+	dehumidifiers map[string]*iotee.IoTee,
+	lamps map[string]*iotee.IoTee,
+	dosers map[string]*iotee.IoTee,
+
 	measureInterval,
 	measureTimeout time.Duration,
 
@@ -71,9 +92,7 @@ func NewHub(
 ) *Hub {
 	cancellableCtx, cancel := context.WithCancel(ctx)
 
-	return &Hub{
-		verbose: verbose,
-
+	hub := &Hub{
 		ctx:    cancellableCtx,
 		cancel: cancel,
 
@@ -82,6 +101,8 @@ func NewHub(
 		fans:               fans,
 		temperatureSensors: temperatureSensors,
 
+		fanStates: map[string]bool{},
+
 		defaultTemperature: defaultTemperature,
 
 		sprinklers:      sprinklers,
@@ -89,15 +110,28 @@ func NewHub(
 
 		defaultMoisture: defaultMoisture,
 
+		dehumidifiers: dehumidifiers,
+		lamps:         lamps,
+		dosers:        dosers,
+
 		measureInterval: measureInterval,
 		measureTimeout:  measureTimeout,
 
 		mock: mock,
 	}
+
+	hub.verbose.Store(verbose)
+
+	return hub
+}
+
+// SetVerbose enables or disables verbose logging while the hub is running
+func (w *Hub) SetVerbose(verbose bool) {
+	w.verbose.Store(verbose)
 }
 
 func (w *Hub) SetFanOn(ctx context.Context, roomID string, on bool) error {
-	if w.verbose {
+	if w.verbose.Load() {
 		log.Printf("SetFanOn(roomID=%v, on=%v)", roomID, on)
 	}
 
@@ -115,11 +149,35 @@ func (w *Hub) SetFanOn(ctx context.Context, roomID string, on bool) error {
 
 	req.Data = []byte{intensity, 255, 0, 0}
 
-	return fan.Transmit(&req)
+	if err := fan.Transmit(&req); err != nil {
+		return err
+	}
+
+	w.fanStatesLock.Lock()
+	w.fanStates[roomID] = on
+	w.fanStatesLock.Unlock()
+
+	return nil
+}
+
+// GetFanState returns the state that was last applied to the fan successfully, since the fan can't be read back
+func (w *Hub) GetFanState(ctx context.Context, roomID string) (bool, error) {
+	if w.verbose.Load() {
+		log.Printf("GetFanState(roomID=%v)", roomID)
+	}
+
+	if _, ok := w.fans[roomID]; !ok {
+		return false, ErrNoSuchRoom
+	}
+
+	w.fanStatesLock.Lock()
+	defer w.fanStatesLock.Unlock()
+
+	return w.fanStates[roomID], nil
 }
 
 func (w *Hub) SetSprinklerOn(ctx context.Context, roomID string, on bool) error {
-	if w.verbose {
+	if w.verbose.Load() {
 		log.Printf("SetSprinklerOn(roomID=%v, on=%v)", roomID, on)
 	}
 
@@ -140,6 +198,72 @@ func (w *Hub) SetSprinklerOn(ctx context.Context, roomID string, on bool) error
 	return sprinkler.Transmit(&req)
 }
 
+func (w *Hub) SetDehumidifierOn(ctx context.Context, roomID string, on bool) error {
+	if w.verbose.Load() {
+		log.Printf("SetDehumidifierOn(roomID=%v, on=%v)", roomID, on)
+	}
+
+	dehumidifier, ok := w.dehumidifiers[roomID]
+	if !ok {
+		return ErrNoSuchRoom
+	}
+
+	req := iotee.NewMessage(iotee.MessageTypeRGBLED, 4)
+
+	intensity := byte(0)
+	if on {
+		intensity = 255
+	}
+
+	req.Data = []byte{intensity, 0, 0, 255}
+
+	return dehumidifier.Transmit(&req)
+}
+
+func (w *Hub) SetLampOn(ctx context.Context, roomID string, on bool) error {
+	if w.verbose.Load() {
+		log.Printf("SetLampOn(roomID=%v, on=%v)", roomID, on)
+	}
+
+	lamp, ok := w.lamps[roomID]
+	if !ok {
+		return ErrNoSuchRoom
+	}
+
+	req := iotee.NewMessage(iotee.MessageTypeRGBLED, 4)
+
+	intensity := byte(0)
+	if on {
+		intensity = 255
+	}
+
+	req.Data = []byte{intensity, 255, 255, 0}
+
+	return lamp.Transmit(&req)
+}
+
+func (w *Hub) SetDoserOn(ctx context.Context, plantID string, on bool) error {
+	if w.verbose.Load() {
+		log.Printf("SetDoserOn(plantID=%v, on=%v)", plantID, on)
+	}
+
+	doser, ok := w.dosers[plantID]
+	if !ok {
+		return ErrNoSuchPlant
+	}
+
+	req := iotee.NewMessage(iotee.MessageTypeRGBLED, 4)
+
+	intensity := byte(0)
+	if on {
+		intensity = 255
+	}
+
+	req.Data = []byte{intensity, 0, 255, 0}
+
+	return doser.Transmit(&req)
+}
+
 func OpenHub(hub *Hub, ctx context.Context, gateway *GatewayRemote) error {
 	roomIDs := []string{}
 	for roomID := range hub.fans {
@@ -158,6 +282,39 @@ func OpenHub(hub *Hub, ctx context.Context, gateway *GatewayRemote) error {
 		}
 	}
 
+	if len(hub.dehumidifiers) > 0 {
+		dehumidifierRoomIDs := []string{}
+		for roomID := range hub.dehumidifiers {
+			dehumidifierRoomIDs = append(dehumidifierRoomIDs, roomID)
+		}
+
+		if err := gateway.RegisterDehumidifiers(ctx, dehumidifierRoomIDs); err != nil {
+			return err
+		}
+	}
+
+	if len(hub.lamps) > 0 {
+		lampRoomIDs := []string{}
+		for roomID := range hub.lamps {
+			lampRoomIDs = append(lampRoomIDs, roomID)
+		}
+
+		if err := gateway.RegisterLamps(ctx, lampRoomIDs); err != nil {
+			return err
+		}
+	}
+
+	if len(hub.dosers) > 0 {
+		doserPlantIDs := []string{}
+		for plantID := range hub.dosers {
+			doserPlantIDs = append(doserPlantIDs, plantID)
+		}
+
+		if err := gateway.RegisterDosers(ctx, doserPlantIDs); err != nil {
+			return err
+		}
+	}
+
 	if hub.mock > 0 {
 		// When mocking, we treat all temperatures as the same
 		for roomID, temperatureSensor := range hub.temperatureSensors {
@@ -334,7 +491,39 @@ func CloseHub(hub *Hub, ctx context.Context, gateway *GatewayRemote) error {
 		return err
 	}
 
-	if err := gateway.UnregisterSprinklers(ctx, roomIDs); err != nil {
+	plantIDs := []string{}
+	for plantID := range hub.sprinklers {
+		plantIDs = append(plantIDs, plantID)
+	}
+
+	if err := gateway.UnregisterSprinklers(ctx, plantIDs); err != nil {
+		return err
+	}
+
+	dehumidifierRoomIDs := []string{}
+	for roomID := range hub.dehumidifiers {
+		dehumidifierRoomIDs = append(dehumidifierRoomIDs, roomID)
+	}
+
+	if err := gateway.UnregisterDehumidifiers(ctx, dehumidifierRoomIDs); err != nil {
+		return err
+	}
+
+	lampRoomIDs := []string{}
+	for roomID := range hub.lamps {
+		lampRoomIDs = append(lampRoomIDs, roomID)
+	}
+
+	if err := gateway.UnregisterLamps(ctx, lampRoomIDs); err != nil {
+		return err
+	}
+
+	doserPlantIDs := []string{}
+	for plantID := range hub.dosers {
+		doserPlantIDs = append(doserPlantIDs, plantID)
+	}
+
+	if err := gateway.UnregisterDosers(ctx, doserPlantIDs); err != nil {
 		return err
 	}
 
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrHubCallQueueFull = errors.New("too many hub calls waiting for a free slot")
+)
+
+// hubCallLimiter bounds the amount of concurrent hub calls across all hubs and commands
+type hubCallLimiter struct {
+	slots chan struct{}
+
+	maxWaiting int
+	waiting    int
+	dropped    int
+
+	lock sync.Mutex
+}
+
+func newHubCallLimiter(maxConcurrent, maxWaiting int) *hubCallLimiter {
+	l := &hubCallLimiter{
+		maxWaiting: maxWaiting,
+	}
+
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+
+	return l
+}
+
+// acquire waits for a free slot, which must be released once the call is done. If the limit is
+// reached and too many calls are already waiting, it fails so that commands can't pile up indefinitely.
+func (l *hubCallLimiter) acquire(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.lock.Lock()
+	if l.maxWaiting > 0 && l.waiting >= l.maxWaiting {
+		l.dropped++
+		l.lock.Unlock()
+
+		return ErrHubCallQueueFull
+	}
+	l.waiting++
+	l.lock.Unlock()
+
+	defer func() {
+		l.lock.Lock()
+		l.waiting--
+		l.lock.Unlock()
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *hubCallLimiter) release() {
+	if l.slots == nil {
+		return
+	}
+
+	<-l.slots
+}
+
+func (l *hubCallLimiter) droppedCount() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.dropped
+}
@@ -0,0 +1,482 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+	"github.com/pojntfx/green-guardian-gateway/pkg/testutil"
+)
+
+func TestCloseGatewayUnsubscribesSprinklers(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+	errs := &errorRecorder{}
+
+	gateway := newTestGateway(t, broker, hub.Remote(), &services.GatewayOptions{
+		OnError: errs.record,
+	})
+
+	if err := services.OpenGateway(gateway, getPeerContext()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gateway.RegisterSprinklers(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure that the command would have reached the hub while the gateway was open
+	publishCommand(broker, "/gateways/test/plants/1/sprinkler", true)
+	waitFor(t, func() bool { return len(hub.Calls()) == 1 }, "the sprinkler command to reach the hub")
+
+	if err := services.CloseGateway(gateway); err != nil {
+		t.Fatal(err)
+	}
+
+	if subscriptions := broker.Subscriptions(); len(subscriptions) != 0 {
+		t.Fatalf("expected no subscriptions after closing, got %v", subscriptions)
+	}
+
+	publishCommand(broker, "/gateways/test/plants/1/sprinkler", false)
+
+	// Commands are applied in the background, so give a callback that shouldn't exist time to run
+	time.Sleep(50 * time.Millisecond)
+
+	if calls := hub.Calls(); len(calls) != 1 {
+		t.Fatalf("expected no hub calls after closing, got %v", calls[1:])
+	}
+
+	if errs := errs.get(); len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+}
+
+func TestCloseGatewayDoesntWaitForHungHubs(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+
+	calls := make(chan string, 16)
+
+	hub := testutil.NewFakeHub().Remote()
+	hub.SetSprinklerOn = func(ctx context.Context, plantID string, on bool) error {
+		calls <- plantID
+
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+
+		// Like the RPC layer, ignore cancellation of `ctx`
+		<-release
+
+		return nil
+	}
+
+	gateway := newTestGateway(t, broker, hub, &services.GatewayOptions{
+		DrainTimeout:   50 * time.Millisecond,
+		HubCallTimeout: 200 * time.Millisecond,
+	})
+
+	if err := services.OpenGateway(gateway, getPeerContext()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gateway.RegisterSprinklers(getPeerContext(), []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	publishCommand(broker, "/gateways/test/plants/1/sprinkler", true)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the sprinkler command to reach the hub")
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- services.CloseGateway(gateway)
+	}()
+
+	select {
+	case err := <-closed:
+		if !errors.Is(err, services.ErrDrainTimedOut) {
+			t.Fatalf("expected %v, got %v", services.ErrDrainTimedOut, err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("expected CloseGateway to return while the hub call is hung")
+	}
+
+	publishCommand(broker, "/gateways/test/plants/2/sprinkler", true)
+
+	// `Errors` is only closed once the hung callback has timed out, so it can't send on a closed channel
+	deadline := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case err, ok := <-gateway.Errors():
+			if ok && !errors.Is(err, services.ErrHubCallTimedOut) {
+				t.Fatalf("expected %v, got %v", services.ErrHubCallTimedOut, err)
+			}
+
+			done = !ok
+
+		case <-deadline:
+			t.Fatal("timed out waiting for the errors channel to be closed")
+		}
+	}
+
+	if len(calls) != 1 {
+		t.Fatalf("expected only the command sent before closing to reach the hub, got %v calls", len(calls))
+	}
+
+	if plantID := <-calls; plantID != "1" {
+		t.Fatalf("expected the hub call for plant 1, got one for plant %v", plantID)
+	}
+}
+
+func TestOpenAndCloseGatewayTwice(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+
+	gateway := newTestGateway(t, broker, hub.Remote(), nil)
+
+	if err := services.CloseGateway(gateway); !errors.Is(err, services.ErrNotOpen) {
+		t.Fatalf("expected %v when closing a gateway that was never opened, got %v", services.ErrNotOpen, err)
+	}
+
+	if err := services.OpenGateway(gateway, getPeerContext()); err != nil {
+		t.Fatal(err)
+	}
+
+	subscribed := broker.Subscribed()
+
+	if err := services.OpenGateway(gateway, getPeerContext()); !errors.Is(err, services.ErrAlreadyOpen) {
+		t.Fatalf("expected %v when opening twice, got %v", services.ErrAlreadyOpen, err)
+	}
+
+	if got := broker.Subscribed(); len(got) != len(subscribed) {
+		t.Fatalf("expected opening twice not to subscribe again, got %v after the first and %v after the second open", subscribed, got)
+	}
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	publishCommand(broker, "/gateways/test/rooms/1/fan", true)
+	waitFor(t, func() bool { return len(hub.Calls()) > 0 }, "the fan command to reach the hub")
+
+	if err := services.CloseGateway(gateway); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := hub.Calls(); len(calls) != 1 {
+		t.Fatalf("expected the fan command to reach the hub once, got %v", calls)
+	}
+
+	if err := services.CloseGateway(gateway); !errors.Is(err, services.ErrNotOpen) {
+		t.Fatalf("expected %v when closing twice, got %v", services.ErrNotOpen, err)
+	}
+
+	// A closed gateway can't be reopened, since its errors channel has been closed
+	if err := services.OpenGateway(gateway, getPeerContext()); !errors.Is(err, services.ErrAlreadyOpen) {
+		t.Fatalf("expected %v when opening after closing, got %v", services.ErrAlreadyOpen, err)
+	}
+
+	if got := broker.Subscribed(); len(got) != len(subscribed) {
+		t.Fatalf("expected reopening not to subscribe again, got %v", got)
+	}
+}
+
+func TestReconnectRestoresSubscriptions(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+
+	gateway := openTestGateway(t, broker, hub.Remote(), nil)
+	broker.SetOnConnectHandler(gateway.OnConnect)
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions := broker.Subscriptions()
+	slices.Sort(subscriptions)
+
+	broker.Disconnect(0)
+
+	if got := broker.Subscriptions(); len(got) != 0 {
+		t.Fatalf("expected the disconnect to drop all subscriptions, got %v", got)
+	}
+
+	// Reconnecting more than once must not duplicate callbacks
+	broker.Connect()
+	broker.Connect()
+
+	got := broker.Subscriptions()
+	slices.Sort(got)
+
+	if !slices.Equal(got, subscriptions) {
+		t.Fatalf("expected subscriptions %v to be restored, got %v", subscriptions, got)
+	}
+
+	publishCommand(broker, "/gateways/test/rooms/1/fan", true)
+	waitFor(t, func() bool { return len(hub.Calls()) > 0 }, "the fan command to reach the hub")
+
+	if err := services.CloseGateway(gateway); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := hub.Calls(); len(calls) != 1 {
+		t.Fatalf("expected the fan command to reach the hub once, got %v", calls)
+	}
+
+	// Closed gateways stay unsubscribed
+	broker.Connect()
+
+	if got := broker.Subscriptions(); len(got) != 0 {
+		t.Fatalf("expected a closed gateway not to resubscribe, got %v", got)
+	}
+}
+
+func TestCloseGatewayWhileReportingErrors(t *testing.T) {
+	rooms := []string{"1", "2", "3", "4"}
+
+	for i := 0; i < 50; i++ {
+		broker := testutil.NewFakeBroker()
+
+		hub := testutil.NewFakeHub().Remote()
+		hub.SetFanOn = func(ctx context.Context, roomID string, on bool) error {
+			time.Sleep(time.Millisecond)
+
+			return errors.New("fan is broken")
+		}
+
+		gateway := newTestGateway(t, broker, hub, &services.GatewayOptions{
+			DrainTimeout:    time.Millisecond,
+			HubCallTimeout:  10 * time.Millisecond,
+			ErrorBufferSize: 1,
+		})
+
+		if err := services.OpenGateway(gateway, getPeerContext()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := gateway.RegisterFans(getPeerContext(), rooms); err != nil {
+			t.Fatal(err)
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+
+			for range gateway.Errors() {
+				// Reading slowly makes the buffer overflow now and then
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		var wg sync.WaitGroup
+		for _, roomID := range rooms {
+			wg.Add(1)
+
+			go func(roomID string) {
+				defer wg.Done()
+
+				for j := 0; j < 20; j++ {
+					publishCommand(broker, "/gateways/test/rooms/"+roomID+"/fan", j%2 == 0)
+				}
+			}(roomID)
+		}
+
+		time.Sleep(time.Duration(i%5) * time.Millisecond)
+
+		if err := services.CloseGateway(gateway); err != nil && !errors.Is(err, services.ErrDrainTimedOut) {
+			t.Fatal(err)
+		}
+
+		wg.Wait()
+
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the errors channel to be closed")
+		}
+	}
+}
+
+func TestCloseGatewayTearsDownIfUnsubscribingFails(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+
+	gateway := newTestGateway(t, broker, hub.Remote(), nil)
+
+	if err := services.OpenGateway(gateway, getPeerContext()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- services.WaitGateway(gateway)
+	}()
+
+	errBrokerGone := errors.New("broker is gone")
+	broker.UnsubscribeErr = errBrokerGone
+
+	if err := services.CloseGateway(gateway); !errors.Is(err, errBrokerGone) {
+		t.Fatalf("expected %v, got %v", errBrokerGone, err)
+	}
+
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("expected WaitGateway to return once the gateway has been closed")
+	}
+
+	// The subscriptions are still there, but the gateway must ignore them
+	publishCommand(broker, "/gateways/test/rooms/1/fan", true)
+
+	if calls := hub.Calls(); len(calls) != 0 {
+		t.Fatalf("expected no hub calls after closing, got %v", calls)
+	}
+
+	if err := services.CloseGateway(gateway); !errors.Is(err, services.ErrNotOpen) {
+		t.Fatalf("expected %v when closing again, got %v", services.ErrNotOpen, err)
+	}
+}
+
+func TestOpenGatewayRollsBackIfSubscribingFails(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+
+	errBrokerGone := errors.New("broker is gone")
+	broker.SubscribeErr = errBrokerGone
+	broker.SubscribeErrAfter = 1
+
+	gateway := newTestGateway(t, broker, hub.Remote(), nil)
+
+	if err := services.OpenGateway(gateway, getPeerContext()); !errors.Is(err, errBrokerGone) {
+		t.Fatalf("expected %v, got %v", errBrokerGone, err)
+	}
+
+	if got := broker.Subscriptions(); len(got) != 0 {
+		t.Fatalf("expected the subscriptions that succeeded to be rolled back, got %v", got)
+	}
+
+	if err := services.CloseGateway(gateway); !errors.Is(err, services.ErrNotOpen) {
+		t.Fatalf("expected %v, got %v", services.ErrNotOpen, err)
+	}
+
+	// Opening again once the broker is back must work as if the first attempt never happened
+	broker.SubscribeErr = nil
+
+	if err := services.OpenGateway(gateway, getPeerContext()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	publishCommand(broker, "/gateways/test/rooms/1/fan", true)
+	waitFor(t, func() bool { return len(hub.Calls()) > 0 }, "the fan command to reach the hub")
+
+	if err := services.CloseGateway(gateway); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFullCommandQueuesDontBlockTheBroker(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	hub := testutil.NewFakeHub().Remote()
+	hub.SetFanOn = func(ctx context.Context, roomID string, on bool) error {
+		<-release
+
+		return nil
+	}
+
+	errs := &errorRecorder{}
+	metrics := &droppedCommandsRecorder{}
+	gateway := openTestGateway(t, broker, hub, &services.GatewayOptions{
+		CommandWorkers:   1,
+		CommandQueueSize: 1,
+		DrainTimeout:     time.Millisecond,
+		OnError:          errs.record,
+		Metrics:          metrics,
+	})
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first command blocks the worker, the second one fills the queue and the rest must be dropped
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+
+		for i := 0; i < 10; i++ {
+			publishCommand(broker, "/gateways/test/rooms/1/fan", i%2 == 0)
+		}
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("expected publishing not to block while the command queue is full")
+	}
+
+	if dropped := gateway.DroppedCommands(); dropped == 0 {
+		t.Fatal("expected commands to be dropped")
+	}
+
+	if errs := errs.get(); len(errs) == 0 || !errors.Is(errs[0], services.ErrCommandQueueFull) || !errors.Is(errs[0], services.ErrHubCallQueueFull) {
+		t.Fatalf("expected %v, got %v", services.ErrCommandQueueFull, errs)
+	}
+
+	if dropped := metrics.get(); dropped != gateway.DroppedCommands() {
+		t.Fatalf("expected all %v dropped commands to be counted by the metrics, got %v", gateway.DroppedCommands(), dropped)
+	}
+}
+
+type droppedCommandsRecorder struct {
+	dropped int
+
+	lock sync.Mutex
+}
+
+func (r *droppedCommandsRecorder) MeasurementForwarded(deviceType string)         {}
+func (r *droppedCommandsRecorder) ForwardError(deviceType string)                 {}
+func (r *droppedCommandsRecorder) CommandReceived(deviceType string)              {}
+func (r *droppedCommandsRecorder) RegisteredDevices(deviceType string, count int) {}
+
+func (r *droppedCommandsRecorder) CommandDropped(deviceType string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.dropped++
+}
+
+func (r *droppedCommandsRecorder) get() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.dropped
+}
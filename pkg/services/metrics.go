@@ -0,0 +1,32 @@
+package services
+
+const (
+	DeviceTypeTemperature = "temperature"
+	DeviceTypeMoisture    = "moisture"
+	DeviceTypeHumidity    = "humidity"
+	DeviceTypeLight       = "light"
+	DeviceTypePH          = "ph"
+
+	DeviceTypeFan          = "fan"
+	DeviceTypeSprinkler    = "sprinkler"
+	DeviceTypeDehumidifier = "dehumidifier"
+	DeviceTypeLamp         = "lamp"
+	DeviceTypeDoser        = "doser"
+)
+
+type Metrics interface {
+	MeasurementForwarded(deviceType string)
+	ForwardError(deviceType string)
+	CommandReceived(deviceType string)
+	// CommandDropped is called for every command that is dropped with `ErrHubCallQueueFull` because the gateway is overloaded
+	CommandDropped(deviceType string)
+	RegisteredDevices(deviceType string, count int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) MeasurementForwarded(deviceType string)         {}
+func (noopMetrics) ForwardError(deviceType string)                 {}
+func (noopMetrics) CommandReceived(deviceType string)              {}
+func (noopMetrics) CommandDropped(deviceType string)               {}
+func (noopMetrics) RegisteredDevices(deviceType string, count int) {}
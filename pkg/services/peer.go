@@ -0,0 +1,22 @@
+package services
+
+import (
+	"context"
+
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+)
+
+type peerIDContextKey struct{}
+
+// WithPeerID attaches a peer ID to `ctx`, which allows calling the gateway's RPCs without an RPC connection
+func WithPeerID(ctx context.Context, peerID string) context.Context {
+	return context.WithValue(ctx, peerIDContextKey{}, peerID)
+}
+
+func getPeerID(ctx context.Context) string {
+	if peerID, ok := ctx.Value(peerIDContextKey{}).(string); ok {
+		return peerID
+	}
+
+	return rpc.GetRemoteID(ctx)
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrPeerTrackingDisabled = errors.New("peer tracking is disabled")
+	ErrPeerAlreadyTracked   = errors.New("peer is already tracked")
+)
+
+func (w *Gateway) hasPeers() bool {
+	return w.Peers != nil || w.trackPeers
+}
+
+// getPeers returns a snapshot of the connected hubs, so that callbacks can't race with the owner of the peers
+func (w *Gateway) getPeers() map[string]HubRemote {
+	peers := map[string]HubRemote{}
+
+	if w.Peers != nil {
+		for peerID, peer := range w.Peers() {
+			peers[peerID] = peer
+		}
+
+		return peers
+	}
+
+	w.trackedPeersLock.Lock()
+	defer w.trackedPeersLock.Unlock()
+
+	for peerID, peer := range w.trackedPeers {
+		peers[peerID] = peer
+	}
+
+	return peers
+}
+
+// PeerCount returns the number of connected hubs
+func (w *Gateway) PeerCount() int {
+	if !w.hasPeers() {
+		return 0
+	}
+
+	return len(w.getPeers())
+}
+
+// RegisterPeer tracks the connected hub `peer` as `peerID`; it requires `TrackPeers` to be enabled
+func (w *Gateway) RegisterPeer(peerID string, peer HubRemote) error {
+	w.log.Debug("RegisterPeer", "peerID", peerID)
+
+	if !w.trackPeers {
+		return ErrPeerTrackingDisabled
+	}
+
+	w.trackedPeersLock.Lock()
+	defer w.trackedPeersLock.Unlock()
+
+	if _, ok := w.trackedPeers[peerID]; ok {
+		return fmt.Errorf("%w: peerID=%v", ErrPeerAlreadyTracked, peerID)
+	}
+
+	w.trackedPeers[peerID] = peer
+
+	return nil
+}
+
+// UnregisterPeer stops tracking the hub `peerID` and drops its per-peer state. The devices it has registered are kept
+// until they are unregistered or `Reconcile` is called.
+func (w *Gateway) UnregisterPeer(peerID string) error {
+	w.log.Debug("UnregisterPeer", "peerID", peerID)
+
+	if !w.trackPeers {
+		return ErrPeerTrackingDisabled
+	}
+
+	w.trackedPeersLock.Lock()
+	delete(w.trackedPeers, peerID)
+	w.trackedPeersLock.Unlock()
+
+	w.forgetPeer(peerID)
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidUnknownCommandStrategy = errors.New("invalid unknown command strategy")
+	ErrTooManyPendingCommands        = errors.New("too many pending commands")
+)
+
+type UnknownCommandStrategy int
+
+const (
+	// UnknownCommandStrategyError reports commands for rooms or plants that no hub has registered as errors
+	UnknownCommandStrategyError UnknownCommandStrategy = iota
+	// UnknownCommandStrategyIgnore drops commands for rooms or plants that no hub has registered
+	UnknownCommandStrategyIgnore
+	// UnknownCommandStrategyBuffer holds commands for rooms or plants that no hub has registered
+	// and applies them once the room or plant has been registered, unless they have expired before
+	UnknownCommandStrategyBuffer
+)
+
+type pendingCommand struct {
+	retry func()
+	timer Timer
+}
+
+// pendingCommands holds the latest command for each actuator that hasn't been registered yet,
+// which covers commands that arrive shortly before the hub that owns the actuator registers it
+type pendingCommands struct {
+	ttl   time.Duration
+	limit int
+	clock Clock
+
+	commands map[string]*pendingCommand
+	closed   bool
+
+	lock sync.Mutex
+}
+
+func newPendingCommands(ttl time.Duration, limit int, clock Clock) *pendingCommands {
+	return &pendingCommands{
+		ttl:   ttl,
+		limit: limit,
+		clock: clock,
+
+		commands: map[string]*pendingCommand{},
+	}
+}
+
+// add holds `retry` until the actuator is registered; later commands replace it so that the latest state wins.
+// `expire` is called if the actuator hasn't been registered within the TTL.
+func (p *pendingCommands) add(deviceType, id string, retry func(), expire func()) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	key := getMeasurementKey(deviceType, id)
+
+	if command, ok := p.commands[key]; ok {
+		command.retry = retry
+
+		return nil
+	}
+
+	if len(p.commands) >= p.limit {
+		return ErrTooManyPendingCommands
+	}
+
+	command := &pendingCommand{
+		retry: retry,
+	}
+
+	command.timer = p.clock.AfterFunc(p.ttl, func() {
+		p.lock.Lock()
+		if p.commands[key] != command {
+			p.lock.Unlock()
+
+			return
+		}
+
+		delete(p.commands, key)
+		p.lock.Unlock()
+
+		expire()
+	})
+
+	p.commands[key] = command
+
+	return nil
+}
+
+// take removes the pending commands of the actuators `ids` and returns them
+func (p *pendingCommands) take(deviceType string, ids []string) []func() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	retries := []func(){}
+	for _, id := range ids {
+		key := getMeasurementKey(deviceType, id)
+
+		if command, ok := p.commands[key]; ok {
+			command.timer.Stop()
+
+			delete(p.commands, key)
+
+			retries = append(retries, command.retry)
+		}
+	}
+
+	return retries
+}
+
+func (p *pendingCommands) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+
+	for key, command := range p.commands {
+		command.timer.Stop()
+
+		delete(p.commands, key)
+	}
+}
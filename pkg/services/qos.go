@@ -0,0 +1,52 @@
+package services
+
+import (
+	"fmt"
+)
+
+// QoSConfig overrides the QoS levels of a device type; levels that aren't set use the gateway's PublishQoS and SubscribeQoS
+type QoSConfig struct {
+	Publish   *byte
+	Subscribe *byte
+}
+
+func getQoSConfigs(configs map[string]QoSConfig) (map[string]QoSConfig, error) {
+	rv := map[string]QoSConfig{}
+	for deviceType, config := range configs {
+		if (config.Publish != nil && *config.Publish > 2) || (config.Subscribe != nil && *config.Subscribe > 2) {
+			return nil, fmt.Errorf("%w: deviceType=%v", ErrInvalidQoS, deviceType)
+		}
+
+		// We copy the levels so that later changes by the caller don't apply
+		override := QoSConfig{}
+		if config.Publish != nil {
+			publish := *config.Publish
+			override.Publish = &publish
+		}
+
+		if config.Subscribe != nil {
+			subscribe := *config.Subscribe
+			override.Subscribe = &subscribe
+		}
+
+		rv[deviceType] = override
+	}
+
+	return rv, nil
+}
+
+func (w *Gateway) getPublishQoS(deviceType string) byte {
+	if qos := w.qos[deviceType].Publish; qos != nil {
+		return *qos
+	}
+
+	return w.publishQoS
+}
+
+func (w *Gateway) getSubscribeQoS(deviceType string) byte {
+	if qos := w.qos[deviceType].Subscribe; qos != nil {
+		return *qos
+	}
+
+	return w.subscribeQoS
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+
+	pending func() error
+	timer   Timer
+}
+
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	log   *slog.Logger
+	clock Clock
+
+	buckets map[string]*tokenBucket
+	dropped int
+	closed  bool
+
+	lock sync.Mutex
+}
+
+func newRateLimiter(rate float64, burst int, log *slog.Logger, clock Clock) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:  rate,
+		burst: float64(burst),
+
+		log:   log,
+		clock: clock,
+
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+func (r *rateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * r.rate
+	if bucket.tokens > r.burst {
+		bucket.tokens = r.burst
+	}
+
+	bucket.lastRefill = now
+}
+
+// pruneLocked drops the buckets that have refilled completely and have nothing pending, since they behave
+// like new ones; this keeps IDs that are never unregistered, e.g. of rooms that were never registered, from piling up
+func (r *rateLimiter) pruneLocked(now time.Time) {
+	for key, bucket := range r.buckets {
+		if bucket.pending == nil && bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// submit publishes immediately if the bucket for `key` has a token left. If it doesn't, the publish
+// is deferred until a token becomes available; if another publish is already pending for `key`,
+// it is replaced so that only the latest measurement is forwarded.
+func (r *rateLimiter) submit(key string, publish func() error) error {
+	r.lock.Lock()
+
+	now := r.clock.Now()
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		r.pruneLocked(now)
+
+		bucket = &tokenBucket{
+			tokens:     r.burst,
+			lastRefill: now,
+		}
+
+		r.buckets[key] = bucket
+	}
+
+	r.refill(bucket, now)
+
+	if bucket.pending == nil && bucket.tokens >= 1 {
+		bucket.tokens--
+
+		r.lock.Unlock()
+
+		return publish()
+	}
+
+	if bucket.pending != nil {
+		r.dropped++
+	}
+
+	bucket.pending = publish
+
+	if bucket.timer == nil && !r.closed {
+		wait := time.Duration((1 - bucket.tokens) / r.rate * float64(time.Second))
+
+		bucket.timer = r.clock.AfterFunc(wait, func() {
+			r.flush(key)
+		})
+	}
+
+	r.lock.Unlock()
+
+	return nil
+}
+
+func (r *rateLimiter) flush(key string) {
+	r.lock.Lock()
+
+	bucket, ok := r.buckets[key]
+	if !ok || bucket.pending == nil || r.closed {
+		r.lock.Unlock()
+
+		return
+	}
+
+	r.refill(bucket, r.clock.Now())
+
+	bucket.tokens--
+
+	publish := bucket.pending
+
+	bucket.pending = nil
+	bucket.timer = nil
+
+	r.lock.Unlock()
+
+	if err := publish(); err != nil {
+		r.log.Warn("Could not forward rate-limited measurement", "key", key, "err", err)
+	}
+}
+
+func (r *rateLimiter) remove(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if bucket, ok := r.buckets[key]; ok {
+		if bucket.timer != nil {
+			bucket.timer.Stop()
+		}
+
+		delete(r.buckets, key)
+	}
+}
+
+func (r *rateLimiter) droppedCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.dropped
+}
+
+func (r *rateLimiter) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = true
+
+	for _, bucket := range r.buckets {
+		if bucket.timer != nil {
+			bucket.timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type redeliveryFilter struct {
+	ttl        time.Duration
+	maxEntries int
+
+	clock Clock
+
+	seenAt     map[string]time.Time
+	order      []string
+	suppressed int
+
+	lock sync.Mutex
+}
+
+func newRedeliveryFilter(ttl time.Duration, maxEntries int, clock Clock) *redeliveryFilter {
+	if maxEntries <= 0 {
+		maxEntries = 1024
+	}
+
+	return &redeliveryFilter{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+
+		clock: clock,
+
+		seenAt: map[string]time.Time{},
+	}
+}
+
+func (r *redeliveryFilter) prune(now time.Time) {
+	for len(r.order) > 0 {
+		key := r.order[0]
+		if len(r.order) <= r.maxEntries && now.Sub(r.seenAt[key]) < r.ttl {
+			break
+		}
+
+		delete(r.seenAt, key)
+		r.order = r.order[1:]
+	}
+}
+
+// redelivered reports whether `msg` is a redelivery of a message that has already been seen within the TTL.
+// Message IDs are reused once a message has been acknowledged, so only messages that the broker has flagged as
+// duplicates are suppressed, and the topic and payload are part of the key as well.
+func (r *redeliveryFilter) redelivered(msg mqtt.Message) bool {
+	// QoS 0 messages are never redelivered and always carry the message ID 0
+	if msg.Qos() == 0 {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.clock.Now()
+
+	r.prune(now)
+
+	key := msg.Topic() + "\x00" + strconv.Itoa(int(msg.MessageID())) + "\x00" + string(msg.Payload())
+	if _, ok := r.seenAt[key]; ok {
+		if msg.Duplicate() {
+			r.suppressed++
+
+			return true
+		}
+
+		// This is a new message that reuses the ID of an acknowledged one, so its redeliveries are what we need to match from now on
+		r.order = slices.DeleteFunc(r.order, func(candidate string) bool {
+			return candidate == key
+		})
+	}
+
+	r.seenAt[key] = now
+	r.order = append(r.order, key)
+
+	r.prune(now)
+
+	return false
+}
+
+func (r *redeliveryFilter) suppressedCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.suppressed
+}
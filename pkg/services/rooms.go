@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrUnknownCapability = errors.New("unknown capability, must be fan, dehumidifier or lamp")
+)
+
+type roomCapability struct {
+	deviceType    string
+	lock          *sync.Mutex
+	devices       map[string]map[string]struct{}
+	getStateTopic func(id string) string
+}
+
+// getRoomCapabilities returns the actuator types that a room can have
+func (w *Gateway) getRoomCapabilities() []roomCapability {
+	return []roomCapability{
+		{DeviceTypeFan, &w.fansLock, w.fans, w.getFanStateTopic},
+		{DeviceTypeDehumidifier, &w.dehumidifiersLock, w.dehumidifiers, w.getDehumidifierStateTopic},
+		{DeviceTypeLamp, &w.lampsLock, w.lamps, w.getLampStateTopic},
+	}
+}
+
+func isRegisteredByPeer(lock *sync.Mutex, devices map[string]map[string]struct{}, id, peerID string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, ok := devices[id][peerID]
+
+	return ok
+}
+
+// RegisterRoom registers the room's actuators of all `capabilities` (`fan`, `dehumidifier` or `lamp`) at once.
+// If one of them can't be registered, the ones that have been registered by this call are unregistered again.
+func (w *Gateway) RegisterRoom(ctx context.Context, roomID string, capabilities []string) error {
+	peerID := getPeerID(ctx)
+
+	w.log.Debug("RegisterRoom", "roomID", roomID, "capabilities", capabilities, "peerID", peerID)
+
+	requested := map[string]struct{}{}
+	for _, capability := range capabilities {
+		switch capability {
+		case DeviceTypeFan, DeviceTypeDehumidifier, DeviceTypeLamp:
+			requested[capability] = struct{}{}
+
+		default:
+			return fmt.Errorf("%w: capability=%v", ErrUnknownCapability, capability)
+		}
+	}
+
+	registered := []roomCapability{}
+	for _, capability := range w.getRoomCapabilities() {
+		if _, ok := requested[capability.deviceType]; !ok {
+			continue
+		}
+
+		// Registrations that the peer has made before must survive a rollback
+		existed := isRegisteredByPeer(capability.lock, capability.devices, roomID, peerID)
+
+		if err := w.registerDevices(capability.deviceType, capability.lock, capability.devices, []string{roomID}, peerID, ErrRoomAlreadyRegistered, "roomID"); err != nil {
+			for _, r := range registered {
+				if err := w.unregisterDevices(r.deviceType, r.lock, r.devices, []string{roomID}, peerID, "roomID", r.getStateTopic); err != nil {
+					w.log.Warn("Could not roll back room registration", "roomID", roomID, "deviceType", r.deviceType, "peerID", peerID, "err", err)
+				}
+			}
+
+			return err
+		}
+
+		if !existed {
+			registered = append(registered, capability)
+		}
+	}
+
+	return nil
+}
+
+// UnregisterRoom unregisters all of the room's actuators that the calling peer has registered
+func (w *Gateway) UnregisterRoom(ctx context.Context, roomID string) error {
+	peerID := getPeerID(ctx)
+
+	w.log.Debug("UnregisterRoom", "roomID", roomID, "peerID", peerID)
+
+	unregistered := false
+	for _, capability := range w.getRoomCapabilities() {
+		if !isRegisteredByPeer(capability.lock, capability.devices, roomID, peerID) {
+			continue
+		}
+
+		if err := w.unregisterDevices(capability.deviceType, capability.lock, capability.devices, []string{roomID}, peerID, "roomID", capability.getStateTopic); err != nil {
+			return err
+		}
+
+		unregistered = true
+	}
+
+	if !unregistered {
+		return &UnregisterError{
+			Skipped: []string{roomID},
+
+			idName: "roomID",
+		}
+	}
+
+	return nil
+}
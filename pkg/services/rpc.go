@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+// GatewayRPC exposes only the gateway's `GatewayRemote` functions to hubs. Every exported method of the value that is passed
+// to `rpc.NewRegistry` can be called by every hub, which must not include the gateway's local API, e.g. `SetLogLevel` or `LoadState`.
+type GatewayRPC struct {
+	gateway *Gateway
+}
+
+func NewGatewayRPC(gateway *Gateway) *GatewayRPC {
+	return &GatewayRPC{
+		gateway: gateway,
+	}
+}
+
+func (r *GatewayRPC) RegisterFans(ctx context.Context, roomIDs []string) error {
+	return r.gateway.RegisterFans(ctx, roomIDs)
+}
+
+func (r *GatewayRPC) UnregisterFans(ctx context.Context, roomIDs []string) error {
+	return r.gateway.UnregisterFans(ctx, roomIDs)
+}
+
+func (r *GatewayRPC) ForwardTemperatureMeasurement(ctx context.Context, roomID string, measurement, defaultValue int) error {
+	return r.gateway.ForwardTemperatureMeasurement(ctx, roomID, measurement, defaultValue)
+}
+
+func (r *GatewayRPC) ForwardTemperatureMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return r.gateway.ForwardTemperatureMeasurements(ctx, measurements)
+}
+
+func (r *GatewayRPC) RegisterFansPattern(ctx context.Context, prefix string, from, to int) error {
+	return r.gateway.RegisterFansPattern(ctx, prefix, from, to)
+}
+
+func (r *GatewayRPC) RegisterFansInZone(ctx context.Context, zoneID string, roomIDs []string) error {
+	return r.gateway.RegisterFansInZone(ctx, zoneID, roomIDs)
+}
+
+func (r *GatewayRPC) RegisterFansWithMeta(ctx context.Context, meta map[string]FanMeta) error {
+	return r.gateway.RegisterFansWithMeta(ctx, meta)
+}
+
+func (r *GatewayRPC) UnregisterFansMatching(ctx context.Context, pattern string) (int, error) {
+	return r.gateway.UnregisterFansMatching(ctx, pattern)
+}
+
+func (r *GatewayRPC) ForwardTemperatureMeasurementFloat(ctx context.Context, roomID string, measurement, defaultValue float64) error {
+	return r.gateway.ForwardTemperatureMeasurementFloat(ctx, roomID, measurement, defaultValue)
+}
+
+func (r *GatewayRPC) ForwardTemperatureMeasurementWithUnit(ctx context.Context, roomID string, measurement, defaultValue int, unit string) error {
+	return r.gateway.ForwardTemperatureMeasurementWithUnit(ctx, roomID, measurement, defaultValue, unit)
+}
+
+func (r *GatewayRPC) ForwardTemperatureMeasurementConfirmed(ctx context.Context, roomID string, measurement, defaultValue int) error {
+	return r.gateway.ForwardTemperatureMeasurementConfirmed(ctx, roomID, measurement, defaultValue)
+}
+
+func (r *GatewayRPC) ForwardTemperatureMeasurementAt(ctx context.Context, roomID string, measurement, defaultValue int, takenAt time.Time) error {
+	return r.gateway.ForwardTemperatureMeasurementAt(ctx, roomID, measurement, defaultValue, takenAt)
+}
+
+func (r *GatewayRPC) ForwardTemperatureMeasurementTo(ctx context.Context, roomID string, targetTopic string, measurement, defaultValue int) error {
+	return r.gateway.ForwardTemperatureMeasurementTo(ctx, roomID, targetTopic, measurement, defaultValue)
+}
+
+func (r *GatewayRPC) RegisterSprinklers(ctx context.Context, plantIDs []string) error {
+	return r.gateway.RegisterSprinklers(ctx, plantIDs)
+}
+
+func (r *GatewayRPC) UnregisterSprinklers(ctx context.Context, plantIDs []string) error {
+	return r.gateway.UnregisterSprinklers(ctx, plantIDs)
+}
+
+func (r *GatewayRPC) ForwardMoistureMeasurement(ctx context.Context, plantID string, measurement, defaultValue int) error {
+	return r.gateway.ForwardMoistureMeasurement(ctx, plantID, measurement, defaultValue)
+}
+
+func (r *GatewayRPC) ForwardMoistureMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return r.gateway.ForwardMoistureMeasurements(ctx, measurements)
+}
+
+func (r *GatewayRPC) RegisterSprinklersWithMeta(ctx context.Context, meta map[string]SprinklerMeta) error {
+	return r.gateway.RegisterSprinklersWithMeta(ctx, meta)
+}
+
+func (r *GatewayRPC) ForwardMoistureMeasurementAt(ctx context.Context, plantID string, measurement, defaultValue int, takenAt time.Time) error {
+	return r.gateway.ForwardMoistureMeasurementAt(ctx, plantID, measurement, defaultValue, takenAt)
+}
+
+func (r *GatewayRPC) RegisterDehumidifiers(ctx context.Context, roomIDs []string) error {
+	return r.gateway.RegisterDehumidifiers(ctx, roomIDs)
+}
+
+func (r *GatewayRPC) UnregisterDehumidifiers(ctx context.Context, roomIDs []string) error {
+	return r.gateway.UnregisterDehumidifiers(ctx, roomIDs)
+}
+
+func (r *GatewayRPC) ForwardHumidityMeasurement(ctx context.Context, roomID string, measurement, defaultValue int) error {
+	return r.gateway.ForwardHumidityMeasurement(ctx, roomID, measurement, defaultValue)
+}
+
+func (r *GatewayRPC) ForwardHumidityMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return r.gateway.ForwardHumidityMeasurements(ctx, measurements)
+}
+
+func (r *GatewayRPC) RegisterLamps(ctx context.Context, roomIDs []string) error {
+	return r.gateway.RegisterLamps(ctx, roomIDs)
+}
+
+func (r *GatewayRPC) UnregisterLamps(ctx context.Context, roomIDs []string) error {
+	return r.gateway.UnregisterLamps(ctx, roomIDs)
+}
+
+func (r *GatewayRPC) ForwardLightMeasurement(ctx context.Context, roomID string, measurement, defaultValue int) error {
+	return r.gateway.ForwardLightMeasurement(ctx, roomID, measurement, defaultValue)
+}
+
+func (r *GatewayRPC) ForwardLightMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return r.gateway.ForwardLightMeasurements(ctx, measurements)
+}
+
+func (r *GatewayRPC) RegisterDosers(ctx context.Context, plantIDs []string) error {
+	return r.gateway.RegisterDosers(ctx, plantIDs)
+}
+
+func (r *GatewayRPC) UnregisterDosers(ctx context.Context, plantIDs []string) error {
+	return r.gateway.UnregisterDosers(ctx, plantIDs)
+}
+
+func (r *GatewayRPC) ForwardPHMeasurement(ctx context.Context, plantID string, measurement, defaultValue int) error {
+	return r.gateway.ForwardPHMeasurement(ctx, plantID, measurement, defaultValue)
+}
+
+func (r *GatewayRPC) ForwardPHMeasurements(ctx context.Context, measurements map[string]Measurement) error {
+	return r.gateway.ForwardPHMeasurements(ctx, measurements)
+}
+
+func (r *GatewayRPC) RegisterRoom(ctx context.Context, roomID string, capabilities []string) error {
+	return r.gateway.RegisterRoom(ctx, roomID, capabilities)
+}
+
+func (r *GatewayRPC) UnregisterRoom(ctx context.Context, roomID string) error {
+	return r.gateway.UnregisterRoom(ctx, roomID)
+}
+
+func (r *GatewayRPC) UnregisterAllForPeer(ctx context.Context) error {
+	return r.gateway.UnregisterAllForPeer(ctx)
+}
+
+// HubRPC exposes only the hub's `HubRemote` functions to gateways, so that they can't call its local API, e.g. `SetVerbose`
+type HubRPC struct {
+	hub *Hub
+}
+
+func NewHubRPC(hub *Hub) *HubRPC {
+	return &HubRPC{
+		hub: hub,
+	}
+}
+
+func (r *HubRPC) SetFanOn(ctx context.Context, roomID string, on bool) error {
+	return r.hub.SetFanOn(ctx, roomID, on)
+}
+
+func (r *HubRPC) SetSprinklerOn(ctx context.Context, plantID string, on bool) error {
+	return r.hub.SetSprinklerOn(ctx, plantID, on)
+}
+
+func (r *HubRPC) GetFanState(ctx context.Context, roomID string) (bool, error) {
+	return r.hub.GetFanState(ctx, roomID)
+}
+
+func (r *HubRPC) SetDehumidifierOn(ctx context.Context, roomID string, on bool) error {
+	return r.hub.SetDehumidifierOn(ctx, roomID, on)
+}
+
+func (r *HubRPC) SetLampOn(ctx context.Context, roomID string, on bool) error {
+	return r.hub.SetLampOn(ctx, roomID, on)
+}
+
+func (r *HubRPC) SetDoserOn(ctx context.Context, plantID string, on bool) error {
+	return r.hub.SetDoserOn(ctx, plantID, on)
+}
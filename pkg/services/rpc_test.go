@@ -0,0 +1,57 @@
+package services_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+)
+
+// TestRPCMatchesRemote makes sure that every exported method of the values that are registered for RPCs
+// is part of the matching remote, since the RPC library lets the other side call all of them
+func TestRPCMatchesRemote(t *testing.T) {
+	for _, tt := range []struct {
+		local  any
+		remote any
+	}{
+		{&services.GatewayRPC{}, services.GatewayRemote{}},
+		{&services.HubRPC{}, services.HubRemote{}},
+		{&services.GatewayGroup{}, services.GatewayGroupRemote{}},
+	} {
+		localType, remoteType := reflect.TypeOf(tt.local), reflect.TypeOf(tt.remote)
+
+		t.Run(localType.String(), func(t *testing.T) {
+			for i := 0; i < localType.NumMethod(); i++ {
+				method := localType.Method(i)
+
+				field, ok := remoteType.FieldByName(method.Name)
+				if !ok {
+					t.Errorf("%v is exported but not part of %v", method.Name, remoteType)
+
+					continue
+				}
+
+				// The method's type includes its receiver, which the remote's field doesn't
+				in := []reflect.Type{}
+				for j := 1; j < method.Type.NumIn(); j++ {
+					in = append(in, method.Type.In(j))
+				}
+
+				out := []reflect.Type{}
+				for j := 0; j < method.Type.NumOut(); j++ {
+					out = append(out, method.Type.Out(j))
+				}
+
+				if got := reflect.FuncOf(in, out, false); got != field.Type {
+					t.Errorf("%v has type %v, but %v expects %v", method.Name, got, remoteType, field.Type)
+				}
+			}
+
+			for i := 0; i < remoteType.NumField(); i++ {
+				if _, ok := localType.MethodByName(remoteType.Field(i).Name); !ok {
+					t.Errorf("%v is part of %v but not implemented", remoteType.Field(i).Name, remoteType)
+				}
+			}
+		})
+	}
+}
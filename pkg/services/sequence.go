@@ -0,0 +1,34 @@
+package services
+
+import "sync"
+
+// sequencer hands out sequence numbers per room or plant so that consumers can drop measurements
+// that have been published more than once, e.g. after being buffered during a reconnect
+type sequencer struct {
+	sequences map[string]uint64
+
+	lock sync.Mutex
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{
+		sequences: map[string]uint64{},
+	}
+}
+
+func (s *sequencer) next(key string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sequences[key]++
+
+	return s.sequences[key]
+}
+
+// remove forgets the sequence of `key`, so the next measurement for it starts at 1 again
+func (s *sequencer) remove(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sequences, key)
+}
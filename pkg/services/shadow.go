@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+)
+
+var (
+	ErrShadowDisabled = errors.New("shadow publishing is disabled")
+)
+
+// shadow holds the last applied state of every actuator, keyed by device type and ID
+type shadow struct {
+	states map[string]map[string]bool
+
+	lock sync.Mutex
+}
+
+func newShadow() *shadow {
+	return &shadow{
+		states: map[string]map[string]bool{
+			DeviceTypeFan:          {},
+			DeviceTypeSprinkler:    {},
+			DeviceTypeDehumidifier: {},
+			DeviceTypeLamp:         {},
+			DeviceTypeDoser:        {},
+		},
+	}
+}
+
+func copyStates(states map[string]bool) map[string]bool {
+	rv := map[string]bool{}
+	for id, on := range states {
+		rv[id] = on
+	}
+
+	return rv
+}
+
+func (s *shadow) reportedLocked() mqttapi.ActuatorStates {
+	return mqttapi.ActuatorStates{
+		Fans:          copyStates(s.states[DeviceTypeFan]),
+		Sprinklers:    copyStates(s.states[DeviceTypeSprinkler]),
+		Dehumidifiers: copyStates(s.states[DeviceTypeDehumidifier]),
+		Lamps:         copyStates(s.states[DeviceTypeLamp]),
+		Dosers:        copyStates(s.states[DeviceTypeDoser]),
+	}
+}
+
+// publishShadowLocked must be called with the shadow's lock held, so that documents are published in the order
+// in which the states changed and a consumer never sees an older document last
+func (w *Gateway) publishShadowLocked() error {
+	msg, err := w.codec.Marshal(mqttapi.Shadow{
+		State: mqttapi.ShadowState{
+			Reported: w.shadow.reportedLocked(),
+		},
+		Timestamp: w.clock.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	msg, err = w.encodePayload(w.getShadowTopic(), msg)
+	if err != nil {
+		return err
+	}
+
+	if w.dryRun {
+		w.log.Info("Dry run, not publishing shadow", "topic", w.getShadowTopic(), "payload", string(msg))
+
+		return nil
+	}
+
+	if err := w.waitForPublish(w.broker.Publish(
+		w.getShadowTopic(),
+		w.publishQoS,
+		true,
+		msg,
+	), w.getShadowTopic()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Gateway) setShadowState(deviceType, id string, on bool) error {
+	if w.shadow == nil {
+		return nil
+	}
+
+	w.shadow.lock.Lock()
+	defer w.shadow.lock.Unlock()
+
+	if current, ok := w.shadow.states[deviceType][id]; ok && current == on {
+		return nil
+	}
+
+	w.shadow.states[deviceType][id] = on
+
+	return w.publishShadowLocked()
+}
+
+func (w *Gateway) removeShadowStates(deviceType string, ids []string) error {
+	if w.shadow == nil {
+		return nil
+	}
+
+	w.shadow.lock.Lock()
+	defer w.shadow.lock.Unlock()
+
+	changed := false
+	for _, id := range ids {
+		if _, ok := w.shadow.states[deviceType][id]; ok {
+			delete(w.shadow.states[deviceType], id)
+
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return w.publishShadowLocked()
+}
+
+// PublishShadow publishes the shadow document with the last applied state of every actuator again
+func (w *Gateway) PublishShadow(ctx context.Context) error {
+	w.log.Debug("PublishShadow")
+
+	if w.shadow == nil {
+		return ErrShadowDisabled
+	}
+
+	w.shadow.lock.Lock()
+	defer w.shadow.lock.Unlock()
+
+	return w.publishShadowLocked()
+}
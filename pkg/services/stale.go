@@ -0,0 +1,85 @@
+package services
+
+import "time"
+
+// resetStaleTemperatureTimer (re-)arms the timer that forwards the default value for `roomID` once its measurements have become stale.
+// Timers are only armed for registered rooms and stop once the room has been unregistered, so that rooms of hubs that
+// are gone don't get default values forever.
+func (w *Gateway) resetStaleTemperatureTimer(roomID string, newDefaultMeasurement func(takenAt time.Time) any) {
+	if w.staleTemperatureTimeout <= 0 {
+		return
+	}
+
+	if !isRegistered(&w.fansLock, w.fans, roomID) {
+		w.stopStaleTemperatureTimer(roomID)
+
+		return
+	}
+
+	w.staleTemperatureTimersLock.Lock()
+	defer w.staleTemperatureTimersLock.Unlock()
+
+	// Don't re-arm any timers once the gateway is closing
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	if timer, ok := w.staleTemperatureTimers[roomID]; ok {
+		timer.Stop()
+	}
+
+	w.staleTemperatureTimers[roomID] = w.clock.AfterFunc(w.staleTemperatureTimeout, func() {
+		// The room may have been unregistered without the timer being stopped in time
+		if !isRegistered(&w.fansLock, w.fans, roomID) {
+			w.stopStaleTemperatureTimer(roomID)
+
+			return
+		}
+
+		if !w.measurementsEnabled(DeviceTypeTemperature) {
+			w.resetStaleTemperatureTimer(roomID, newDefaultMeasurement)
+
+			return
+		}
+
+		defaultMeasurement := newDefaultMeasurement(w.clock.Now())
+
+		w.log.Debug("Temperature measurement is stale, forwarding default value", "roomID", roomID, "defaultMeasurement", defaultMeasurement, "timeout", w.staleTemperatureTimeout)
+
+		msg, err := w.codec.Marshal(defaultMeasurement)
+		if err != nil {
+			w.log.Warn("Could not marshal default temperature measurement", "roomID", roomID, "err", err)
+
+			return
+		}
+
+		if err := w.publishMeasurement(DeviceTypeTemperature, w.getTemperatureTopic(roomID), msg); err != nil {
+			w.log.Warn("Could not forward default temperature measurement", "roomID", roomID, "err", err)
+		}
+
+		// Keep forwarding the default value until a new measurement arrives
+		w.resetStaleTemperatureTimer(roomID, newDefaultMeasurement)
+	})
+}
+
+func (w *Gateway) stopStaleTemperatureTimers() {
+	w.staleTemperatureTimersLock.Lock()
+	defer w.staleTemperatureTimersLock.Unlock()
+
+	for roomID, timer := range w.staleTemperatureTimers {
+		timer.Stop()
+
+		delete(w.staleTemperatureTimers, roomID)
+	}
+}
+
+func (w *Gateway) stopStaleTemperatureTimer(roomID string) {
+	w.staleTemperatureTimersLock.Lock()
+	defer w.staleTemperatureTimersLock.Unlock()
+
+	if timer, ok := w.staleTemperatureTimers[roomID]; ok {
+		timer.Stop()
+
+		delete(w.staleTemperatureTimers, roomID)
+	}
+}
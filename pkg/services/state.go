@@ -0,0 +1,139 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+type savedState struct {
+	Fans       map[string][]string `json:"fans"`
+	Sprinklers map[string][]string `json:"sprinklers"`
+}
+
+// SaveState writes the registered fans and sprinklers with the IDs of the peers that registered them to `out` as JSON
+func (w *Gateway) SaveState(out io.Writer) error {
+	w.fansLock.Lock()
+	w.sprinklersLock.Lock()
+
+	state := savedState{
+		Fans:       copyDevicesLocked(w.fans),
+		Sprinklers: copyDevicesLocked(w.sprinklers),
+	}
+
+	w.sprinklersLock.Unlock()
+	w.fansLock.Unlock()
+
+	return json.NewEncoder(out).Encode(state)
+}
+
+// getRestorableDevices returns the IDs of the saved devices that `restoreDevices` would restore by the peer that registered them
+func getRestorableDevices(devices map[string]map[string]struct{}, saved map[string][]string) map[string][]string {
+	restorable := map[string][]string{}
+	for id, peerIDs := range saved {
+		if _, ok := devices[id]; ok {
+			continue
+		}
+
+		for _, peerID := range peerIDs {
+			restorable[peerID] = append(restorable[peerID], id)
+		}
+	}
+
+	return restorable
+}
+
+func restoreDevices(devices map[string]map[string]struct{}, saved map[string][]string) []string {
+	restored := []string{}
+	for id, peerIDs := range saved {
+		// Registrations that were made since the gateway has been started are more recent than the saved ones
+		if _, ok := devices[id]; ok || len(peerIDs) == 0 {
+			continue
+		}
+
+		devices[id] = map[string]struct{}{}
+		for _, peerID := range peerIDs {
+			devices[id][peerID] = struct{}{}
+		}
+
+		restored = append(restored, id)
+	}
+
+	sort.Strings(restored)
+
+	return restored
+}
+
+// LoadState restores the fans and sprinklers that have been written by `SaveState` from `in`, so that
+// measurements can be forwarded and commands can be routed before the hubs have re-registered.
+// The restored peer IDs may be stale, e.g. if a hub has reconnected with a new peer ID, until `Reconcile`
+// is called. Devices that are already registered are kept as-is, and no registration events are published.
+// Restored devices count towards `MaxRegistrationsPerPeer`, and buffered commands for them are applied.
+func (w *Gateway) LoadState(in io.Reader) error {
+	var state savedState
+	if err := json.NewDecoder(in).Decode(&state); err != nil {
+		return err
+	}
+
+	tables := []struct {
+		saved                map[string][]string
+		errAlreadyRegistered error
+		idName               string
+	}{
+		{state.Fans, ErrRoomAlreadyRegistered, "roomID"},
+		{state.Sprinklers, ErrPlantAlreadyRegistered, "plantID"},
+	}
+
+	for _, table := range tables {
+		for id, peerIDs := range table.saved {
+			if err := w.validateID(id); err != nil {
+				return err
+			}
+
+			if len(peerIDs) > 1 && !w.allowMultiplePeers {
+				return fmt.Errorf("%w: %v=%v peerIDs=%v", table.errAlreadyRegistered, table.idName, id, peerIDs)
+			}
+		}
+	}
+
+	w.fansLock.Lock()
+	w.sprinklersLock.Lock()
+
+	// Like registering, restoring is all-or-nothing, so we check the limits of all peers before restoring anything
+	for _, table := range []struct {
+		devices map[string]map[string]struct{}
+		saved   map[string][]string
+	}{
+		{w.fans, state.Fans},
+		{w.sprinklers, state.Sprinklers},
+	} {
+		for peerID, ids := range getRestorableDevices(table.devices, table.saved) {
+			if err := w.checkRegistrationLimitLocked(table.devices, ids, peerID); err != nil {
+				w.sprinklersLock.Unlock()
+				w.fansLock.Unlock()
+
+				return err
+			}
+		}
+	}
+
+	roomIDs := restoreDevices(w.fans, state.Fans)
+	plantIDs := restoreDevices(w.sprinklers, state.Sprinklers)
+
+	w.metrics.RegisteredDevices(DeviceTypeFan, len(w.fans))
+	w.metrics.RegisteredDevices(DeviceTypeSprinkler, len(w.sprinklers))
+
+	w.sprinklersLock.Unlock()
+	w.fansLock.Unlock()
+
+	w.log.Info("Restored registrations", "roomIDs", roomIDs, "plantIDs", plantIDs)
+
+	if w.pendingCommands != nil {
+		for _, retry := range append(w.pendingCommands.take(DeviceTypeFan, roomIDs), w.pendingCommands.take(DeviceTypeSprinkler, plantIDs)...) {
+			retry()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package services_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+	"github.com/pojntfx/green-guardian-gateway/pkg/testutil"
+)
+
+func TestLoadStateEnforcesRegistrationLimit(t *testing.T) {
+	gateway := openTestGateway(t, testutil.NewFakeBroker(), testutil.NewFakeHub().Remote(), &services.GatewayOptions{
+		MaxRegistrationsPerPeer: 2,
+	})
+
+	if err := gateway.RegisterFans(getPeerContext(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	state := `{"fans":{"1":["hub"],"2":["hub"],"3":["hub"]},"sprinklers":{"1":["hub"]}}`
+	if err := gateway.LoadState(strings.NewReader(state)); !errors.Is(err, services.ErrRegistrationLimitExceeded) {
+		t.Fatalf("expected %v, got %v", services.ErrRegistrationLimitExceeded, err)
+	}
+
+	if fans, sprinklers := gateway.ListFans(), gateway.ListSprinklers(); len(fans) != 1 || len(sprinklers) != 0 {
+		t.Fatalf("expected nothing to be restored, got fans=%v sprinklers=%v", fans, sprinklers)
+	}
+
+	state = `{"fans":{"1":["hub"],"2":["hub"]},"sprinklers":{"1":["hub"],"2":["hub"]}}`
+	if err := gateway.LoadState(strings.NewReader(state)); err != nil {
+		t.Fatal(err)
+	}
+
+	if fans, sprinklers := gateway.ListFans(), gateway.ListSprinklers(); len(fans) != 2 || len(sprinklers) != 2 {
+		t.Fatalf("expected the devices to be restored, got fans=%v sprinklers=%v", fans, sprinklers)
+	}
+}
+
+func TestLoadStateAppliesPendingCommands(t *testing.T) {
+	broker := testutil.NewFakeBroker()
+	hub := testutil.NewFakeHub()
+
+	gateway := openTestGateway(t, broker, hub.Remote(), &services.GatewayOptions{
+		UnknownCommandStrategy: services.UnknownCommandStrategyBuffer,
+	})
+
+	publishCommand(broker, "/gateways/test/plants/1/sprinkler", true)
+
+	if calls := hub.Calls(); len(calls) != 0 {
+		t.Fatalf("expected the command to be held until the plant is restored, got %v", calls)
+	}
+
+	if err := gateway.LoadState(strings.NewReader(`{"fans":{},"sprinklers":{"1":["hub"]}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return len(hub.Calls()) > 0 }, "the pending command to reach the hub")
+
+	if calls := hub.Calls(); calls[0] != (testutil.Call{Method: "SetSprinklerOn", ID: "1", On: true}) {
+		t.Fatalf("expected the pending sprinkler command to be applied, got %v", calls)
+	}
+}
@@ -0,0 +1,46 @@
+package services
+
+import "context"
+
+type RoomMeasurement struct {
+	RoomID       string `json:"roomID"`
+	Measurement  int    `json:"measurement"`
+	DefaultValue int    `json:"default"`
+}
+
+// ForwardTemperatureStream forwards the measurements sent on the returned channel as they arrive until `ctx` is cancelled,
+// the channel is closed or the gateway is closed; senders should select on `ctx` too, since nothing is received after that.
+// Errors are reported on the gateway's error channel.
+func (w *Gateway) ForwardTemperatureStream(ctx context.Context) chan<- RoomMeasurement {
+	measurements := make(chan RoomMeasurement)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-w.ctx.Done():
+				return
+
+			case measurement, ok := <-measurements:
+				if !ok {
+					return
+				}
+
+				// The error channel is closed once all callbacks are done, so we can't report errors after that
+				if !w.beginCallback() {
+					return
+				}
+
+				if err := w.ForwardTemperatureMeasurement(ctx, measurement.RoomID, measurement.Measurement, measurement.DefaultValue); err != nil {
+					w.reportError(err)
+				}
+
+				w.callbacksWg.Done()
+			}
+		}
+	}()
+
+	return measurements
+}
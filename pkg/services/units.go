@@ -0,0 +1,61 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+)
+
+var (
+	ErrUnknownUnit = errors.New("unknown unit")
+)
+
+func validateTemperatureUnit(unit string) error {
+	switch unit {
+	case mqttapi.UnitCelsius, mqttapi.UnitFahrenheit, mqttapi.UnitKelvin:
+		return nil
+
+	default:
+		return fmt.Errorf("%w: unit=%v", ErrUnknownUnit, unit)
+	}
+}
+
+func convertTemperature(value float64, from, to string) (float64, error) {
+	if err := validateTemperatureUnit(from); err != nil {
+		return 0, err
+	}
+
+	if err := validateTemperatureUnit(to); err != nil {
+		return 0, err
+	}
+
+	celsius := value
+	switch from {
+	case mqttapi.UnitFahrenheit:
+		celsius = (value - 32) * 5 / 9
+
+	case mqttapi.UnitKelvin:
+		celsius = value - 273.15
+	}
+
+	switch to {
+	case mqttapi.UnitFahrenheit:
+		return celsius*9/5 + 32, nil
+
+	case mqttapi.UnitKelvin:
+		return celsius + 273.15, nil
+	}
+
+	return celsius, nil
+}
+
+func convertTemperatureInt(value int, from, to string) (int, error) {
+	converted, err := convertTemperature(float64(value), from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(math.Round(converted)), nil
+}
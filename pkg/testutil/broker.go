@@ -0,0 +1,341 @@
+// Package testutil provides in-memory stand-ins for the MQTT broker and the hubs, which allows
+// testing code built on top of the gateway without any network connections.
+//
+// FakeBroker implements mqtt.Client and therefore services.Broker. Publish, Subscribe,
+// SubscribeMultiple, Unsubscribe, AddRoute, IsConnected, IsConnectionOpen, Connect and Disconnect
+// are functional; OptionsReader returns an empty reader whose methods must not be called.
+// Disconnect drops all subscriptions like a clean session would, and Connect calls the handler
+// set with SetOnConnectHandler, which allows simulating reconnects.
+//
+// FakeHub records every call made to the services.HubRemote returned by FakeHub.Remote.
+package testutil
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type Message struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  []byte
+
+	// MessageID and Duplicate are only set for messages passed to Deliver
+	MessageID uint16
+	Duplicate bool
+}
+
+type fakeMessage struct {
+	Message
+}
+
+func (m *fakeMessage) Duplicate() bool   { return m.Message.Duplicate }
+func (m *fakeMessage) Qos() byte         { return m.QoS }
+func (m *fakeMessage) Retained() bool    { return m.Message.Retained }
+func (m *fakeMessage) Topic() string     { return m.Message.Topic }
+func (m *fakeMessage) MessageID() uint16 { return m.Message.MessageID }
+func (m *fakeMessage) Payload() []byte   { return m.Message.Payload }
+func (m *fakeMessage) Ack()              {}
+
+type fakeToken struct {
+	err  error
+	done chan struct{}
+}
+
+func newFakeToken(err error) *fakeToken {
+	done := make(chan struct{})
+	close(done)
+
+	return &fakeToken{
+		err:  err,
+		done: done,
+	}
+}
+
+// newStalledToken returns a token that never completes, like that of a broker that doesn't acknowledge anymore
+func newStalledToken() *fakeToken {
+	return &fakeToken{
+		done: make(chan struct{}),
+	}
+}
+
+func (t *fakeToken) Wait() bool {
+	<-t.done
+
+	return true
+}
+
+func (t *fakeToken) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *fakeToken) Done() <-chan struct{} { return t.done }
+func (t *fakeToken) Error() error          { return t.err }
+
+type FakeBroker struct {
+	// PublishErr is returned from Publish if set
+	PublishErr error
+	// StallPublishes makes Publish record messages but return tokens that never complete
+	StallPublishes bool
+	// SubscribeErr is returned from Subscribe and SubscribeMultiple once SubscribeErrAfter calls have succeeded
+	SubscribeErr      error
+	SubscribeErrAfter int
+	// UnsubscribeErr is returned from Unsubscribe if set, in which case the subscriptions are kept
+	UnsubscribeErr error
+
+	connected  bool
+	published  []Message
+	subscribed []string
+	routes     map[string]mqtt.MessageHandler
+	onConnect  mqtt.OnConnectHandler
+
+	lock sync.Mutex
+}
+
+func NewFakeBroker() *FakeBroker {
+	return &FakeBroker{
+		connected: true,
+		routes:    map[string]mqtt.MessageHandler{},
+	}
+}
+
+func matchTopic(filter, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	if filterParts[0] == "$share" && len(filterParts) > 2 {
+		filterParts = filterParts[2:]
+	}
+	topicParts := strings.Split(topic, "/")
+
+	for i, filterPart := range filterParts {
+		if filterPart == "#" {
+			return true
+		}
+
+		if i >= len(topicParts) {
+			return false
+		}
+
+		if filterPart != "+" && filterPart != topicParts[i] {
+			return false
+		}
+	}
+
+	return len(filterParts) == len(topicParts)
+}
+
+func (b *FakeBroker) IsConnected() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.connected
+}
+
+func (b *FakeBroker) IsConnectionOpen() bool {
+	return b.IsConnected()
+}
+
+// SetConnected simulates the broker connection going up or down
+func (b *FakeBroker) SetConnected(connected bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.connected = connected
+}
+
+// SetOnConnectHandler sets the handler that Connect calls once the connection is up
+func (b *FakeBroker) SetOnConnectHandler(handler mqtt.OnConnectHandler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.onConnect = handler
+}
+
+func (b *FakeBroker) Connect() mqtt.Token {
+	b.lock.Lock()
+	b.connected = true
+	onConnect := b.onConnect
+	b.lock.Unlock()
+
+	if onConnect != nil {
+		onConnect(b)
+	}
+
+	return newFakeToken(nil)
+}
+
+func (b *FakeBroker) Disconnect(quiesce uint) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.connected = false
+	b.routes = map[string]mqtt.MessageHandler{}
+}
+
+// Publish records the message and delivers it to all matching subscriptions before returning
+func (b *FakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	}
+
+	b.lock.Lock()
+	if b.PublishErr != nil {
+		err := b.PublishErr
+
+		b.lock.Unlock()
+
+		return newFakeToken(err)
+	}
+
+	msg := Message{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Payload:  data,
+	}
+
+	b.published = append(b.published, msg)
+	stalled := b.StallPublishes
+	b.lock.Unlock()
+
+	if stalled {
+		return newStalledToken()
+	}
+
+	b.Deliver(msg)
+
+	return newFakeToken(nil)
+}
+
+// Deliver delivers `msg` to all matching subscriptions without recording it, e.g. to simulate
+// a broker that redelivers a message
+func (b *FakeBroker) Deliver(msg Message) {
+	b.lock.Lock()
+	handlers := []mqtt.MessageHandler{}
+	for filter, handler := range b.routes {
+		if matchTopic(filter, msg.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	b.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler(b, &fakeMessage{msg})
+	}
+}
+
+func (b *FakeBroker) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	if err := b.getSubscribeErr(); err != nil {
+		return newFakeToken(err)
+	}
+
+	b.recordSubscription(topic)
+	b.AddRoute(topic, callback)
+
+	return newFakeToken(nil)
+}
+
+func (b *FakeBroker) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	if err := b.getSubscribeErr(); err != nil {
+		return newFakeToken(err)
+	}
+
+	for topic := range filters {
+		b.recordSubscription(topic)
+		b.AddRoute(topic, callback)
+	}
+
+	return newFakeToken(nil)
+}
+
+func (b *FakeBroker) getSubscribeErr() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.SubscribeErr == nil {
+		return nil
+	}
+
+	if b.SubscribeErrAfter > 0 {
+		b.SubscribeErrAfter--
+
+		return nil
+	}
+
+	return b.SubscribeErr
+}
+
+func (b *FakeBroker) Unsubscribe(topics ...string) mqtt.Token {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.UnsubscribeErr != nil {
+		return newFakeToken(b.UnsubscribeErr)
+	}
+
+	for _, topic := range topics {
+		delete(b.routes, topic)
+	}
+
+	return newFakeToken(nil)
+}
+
+func (b *FakeBroker) recordSubscription(topic string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.subscribed = append(b.subscribed, topic)
+}
+
+func (b *FakeBroker) AddRoute(topic string, callback mqtt.MessageHandler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.routes[topic] = callback
+}
+
+func (b *FakeBroker) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// Published returns all messages that have been published so far
+func (b *FakeBroker) Published() []Message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]Message{}, b.published...)
+}
+
+// Subscriptions returns the topic filters that currently have a subscription
+func (b *FakeBroker) Subscriptions() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	topics := []string{}
+	for topic := range b.routes {
+		topics = append(topics, topic)
+	}
+
+	return topics
+}
+
+// Subscribed returns the topic filters of all subscribe calls so far, including repeated ones
+func (b *FakeBroker) Subscribed() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]string{}, b.subscribed...)
+}
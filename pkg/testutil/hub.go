@@ -0,0 +1,77 @@
+package testutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+)
+
+type Call struct {
+	Method string
+	ID     string
+	On     bool
+}
+
+type FakeHub struct {
+	// Err is returned from all calls if set
+	Err error
+
+	calls []Call
+
+	lock sync.Mutex
+}
+
+func NewFakeHub() *FakeHub {
+	return &FakeHub{}
+}
+
+func (h *FakeHub) record(method string) func(ctx context.Context, id string, on bool) error {
+	return func(ctx context.Context, id string, on bool) error {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		h.calls = append(h.calls, Call{
+			Method: method,
+			ID:     id,
+			On:     on,
+		})
+
+		return h.Err
+	}
+}
+
+// Remote returns a services.HubRemote that records all calls made to it
+func (h *FakeHub) Remote() services.HubRemote {
+	return services.HubRemote{
+		SetFanOn:          h.record("SetFanOn"),
+		SetSprinklerOn:    h.record("SetSprinklerOn"),
+		SetDehumidifierOn: h.record("SetDehumidifierOn"),
+		SetLampOn:         h.record("SetLampOn"),
+		SetDoserOn:        h.record("SetDoserOn"),
+
+		GetFanState: h.getFanState,
+	}
+}
+
+// getFanState returns the state of the last `SetFanOn` call for `roomID`
+func (h *FakeHub) getFanState(ctx context.Context, roomID string) (bool, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := len(h.calls) - 1; i >= 0; i-- {
+		if h.calls[i].Method == "SetFanOn" && h.calls[i].ID == roomID {
+			return h.calls[i].On, h.Err
+		}
+	}
+
+	return false, h.Err
+}
+
+// Calls returns all calls that have been made so far
+func (h *FakeHub) Calls() []Call {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return append([]Call{}, h.calls...)
+}
@@ -0,0 +1,59 @@
+// Package topics builds the MQTT topics of the GreenGuardian protocol (see docs/protocol.md), so that
+// subscriptions and the topics they match can't drift apart.
+package topics
+
+import "path"
+
+// Wildcard is the single-level MQTT wildcard that takes the place of room and plant IDs in subscriptions
+const Wildcard = "+"
+
+// MultiLevelWildcard takes the place of everything below rooms, plants and zones in subscriptions if IDs may span multiple levels
+const MultiLevelWildcard = "#"
+
+// Room builds the topic of `leaf` below a room, e.g. its temperature measurements or fan commands
+func Room(prefix, thingName, roomID, leaf string) string {
+	return path.Join(prefix, thingName, "rooms", roomID, leaf)
+}
+
+func Plant(prefix, thingName, plantID, leaf string) string {
+	return path.Join(prefix, thingName, "plants", plantID, leaf)
+}
+
+func Zone(prefix, thingName, zoneID, leaf string) string {
+	return path.Join(prefix, thingName, "zones", zoneID, leaf)
+}
+
+// State builds the topic that the state of the actuator commanded by `command` is published to
+func State(command string) string {
+	return path.Join(command, "state")
+}
+
+func Ack(command string) string {
+	return path.Join(command, "ack")
+}
+
+func Status(prefix, thingName string) string {
+	return path.Join(prefix, thingName, "status")
+}
+
+func RegistrationEvents(prefix, thingName string) string {
+	return path.Join(prefix, thingName, "events", "registration")
+}
+
+func Registrations(prefix, thingName string) string {
+	return path.Join(prefix, thingName, "registrations")
+}
+
+func Heartbeat(prefix, thingName string) string {
+	return path.Join(prefix, thingName, "heartbeat")
+}
+
+func Shadow(prefix, thingName string) string {
+	return path.Join(prefix, thingName, "shadow")
+}
+
+// Shared turns `filter` into a shared subscription of `group`, so that the broker delivers each message to only one of the group's subscribers
+func Shared(group, filter string) string {
+	// We don't use `path.Join` since it would drop the leading slash of `filter`, which is part of the filter
+	return "$share/" + group + "/" + filter
+}
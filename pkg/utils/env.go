@@ -37,6 +37,16 @@ func GetIntEnvOrDefault(key string, defaultValue int) (int, error) {
 	return defaultValue, nil
 }
 
+func GetFloatEnvOrDefault(key string, defaultValue float64) (float64, error) {
+	if value, exists := os.LookupEnv(key); exists {
+		log.Printf("Using %v from environment", key)
+
+		return strconv.ParseFloat(value, 64)
+	}
+
+	return defaultValue, nil
+}
+
 func GetDurationEnvOrDefault(key string, defaultValue time.Duration) (time.Duration, error) {
 	if value, exists := os.LookupEnv(key); exists {
 		log.Printf("Using %v from environment", key)